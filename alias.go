@@ -0,0 +1,164 @@
+package ginprom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// WithMetricAlias additionally exports the metric of the collection called
+// newName under oldName, with the same help, labels and values, for the
+// migration window after a rename such as adding a prefix.  newName is the
+// full name, including the prefix set with [WithMetricPrefix], of a metric
+// the collection has when it is created; [NewMetricsCollectionE] returns an
+// error otherwise, so the optional metrics built later by middleware options
+// cannot be aliased.  oldName is registered like any other metric, so a clash
+// with an existing metric is reported at registration.  The alias is computed
+// from the renamed metric on every scrape, so both always carry the same
+// counts, but only the classic values are copied: exemplars and the buckets
+// of native histograms are not carried over.  Drop the option once consumers
+// moved to the new name.
+//
+// Example:
+//
+//	ginprom.NewMetricsCollection(
+//	    ginprom.WithMetricPrefix("myapp"),
+//	    ginprom.WithMetricAlias("http_requests_total", "myapp_http_requests_total"),
+//	)
+func WithMetricAlias(oldName, newName string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		for _, name := range []string{oldName, newName} {
+			if !model.LegacyValidation.IsValidMetricName(name) {
+				mc.setErr(fmt.Errorf("ginprom: WithMetricAlias: metric name %q is invalid", name))
+				return
+			}
+		}
+		if oldName == newName {
+			mc.setErr(fmt.Errorf("ginprom: WithMetricAlias: %q is aliased to itself", oldName))
+			return
+		}
+		if mc.aliases == nil {
+			mc.aliases = make(map[string]string)
+		}
+		mc.aliases[newName] = oldName
+	}
+}
+
+// aliasCollector re-exports metrics of a set of collectors under other
+// names.  It describes the alias names, without labels, so that registries
+// reject clashes with their other metrics; the label names of the aliases
+// are only known once the metrics have series.
+type aliasCollector struct {
+	// aliases maps the name of an aliased metric to its alias
+	aliases map[string]string
+	descs   []*prometheus.Desc
+	// aliased gathers the aliased collectors independently of the registry
+	// they are exported from.
+	aliased *prometheus.Registry
+}
+
+// newAliasCollector aliases metrics of collectors, which must be valid for
+// registration with a fresh registry.  It returns an error when an aliased
+// name is not a metric of collectors.
+func newAliasCollector(aliases map[string]string, collectors []prometheus.Collector) (*aliasCollector, error) {
+	aliased := prometheus.NewRegistry()
+	if err := registerAll(aliased, collectors); err != nil {
+		return nil, err
+	}
+	ac := &aliasCollector{aliases: aliases, aliased: aliased}
+	for name, alias := range aliases {
+		if !describesName(aliased, name) {
+			return nil, fmt.Errorf("ginprom: WithMetricAlias: the collection has no metric called %q to alias as %q", name, alias)
+		}
+		ac.descs = append(ac.descs, prometheus.NewDesc(alias, "Alias of "+name+".", nil, nil))
+	}
+	return ac, nil
+}
+
+// describesName reports whether a collector registered with reg describes a
+// metric called name.  Registries reject a descriptor whose name is already
+// described with other labels or help, so a probe descriptor is registered
+// and, when accepted, unregistered again.
+func describesName(reg *prometheus.Registry, name string) bool {
+	probe := &descCollector{desc: prometheus.NewDesc(name, "ginprom alias probe", []string{"ginprom_probe"}, nil)}
+	if err := reg.Register(probe); err != nil {
+		return true
+	}
+	reg.Unregister(probe)
+	return false
+}
+
+// descCollector describes a single descriptor and collects nothing.
+type descCollector struct {
+	desc *prometheus.Desc
+}
+
+func (dc *descCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dc.desc
+}
+
+func (dc *descCollector) Collect(chan<- prometheus.Metric) {}
+
+func (ac *aliasCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range ac.descs {
+		ch <- desc
+	}
+}
+
+func (ac *aliasCollector) Collect(ch chan<- prometheus.Metric) {
+	families, err := ac.aliased.Gather()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		return
+	}
+	for _, mf := range families {
+		alias, ok := ac.aliases[mf.GetName()]
+		if !ok {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			metric, err := aliasMetric(alias, mf, m)
+			if err != nil {
+				err = fmt.Errorf("ginprom: aliasing %s as %s: %w", mf.GetName(), alias, err)
+				metric = prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+			}
+			ch <- metric
+		}
+	}
+}
+
+// aliasMetric rebuilds m, a metric of the family mf, under name.
+func aliasMetric(name string, mf *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	labelNames := make([]string, 0, len(m.GetLabel()))
+	labelValues := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		labelNames = append(labelNames, lp.GetName())
+		labelValues = append(labelValues, lp.GetValue())
+	}
+	desc := prometheus.NewDesc(name, mf.GetHelp(), labelNames, nil)
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		buckets := make(map[float64]uint64, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, h.GetSampleCount(), h.GetSampleSum(), buckets, labelValues...)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		quantiles := make(map[float64]float64, len(s.GetQuantile()))
+		for _, q := range s.GetQuantile() {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, s.GetSampleCount(), s.GetSampleSum(), quantiles, labelValues...)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), labelValues...)
+	}
+}
@@ -0,0 +1,83 @@
+package ginprom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWithMetricAlias(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithMetricPrefix("myapp"),
+		WithMetricAlias("http_requests_total", "myapp_http_requests_total"),
+		WithMetricAlias("http_request_duration_seconds", "myapp_http_request_duration_seconds"),
+	)
+	r := newStatusRouter(mc)
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	counts := func(name string) map[string]float64 {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil {
+			t.Fatalf("expected %s to be exported", name)
+		}
+		got := map[string]float64{}
+		for _, m := range mf.GetMetric() {
+			got[labelValue(m, "status_code")] = m.GetCounter().GetValue()
+		}
+		return got
+	}
+	renamed, legacy := counts("myapp_http_requests_total"), counts("http_requests_total")
+	if len(legacy) != 2 || legacy["200"] != renamed["200"] || legacy["500"] != renamed["500"] || legacy["200"] != 2 {
+		t.Errorf("expected the alias to carry the same counts, got %v and %v", legacy, renamed)
+	}
+
+	durations := gatherFamily(t, reg, "http_request_duration_seconds")
+	if durations == nil || len(durations.GetMetric()) != 2 {
+		t.Fatalf("expected two aliased duration series, got %v", durations)
+	}
+	var samples uint64
+	for _, m := range durations.GetMetric() {
+		samples += m.GetHistogram().GetSampleCount()
+	}
+	if samples != 3 {
+		t.Errorf("expected 3 aliased duration samples, got %d", samples)
+	}
+}
+
+func TestWithMetricAlias_Invalid(t *testing.T) {
+	for _, opt := range []MetricsOption{
+		WithMetricAlias("http-requests", "http_requests_total"),
+		WithMetricAlias("http_requests_total", "http_requests_total"),
+	} {
+		if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), opt); err == nil {
+			t.Error("expected an error for an invalid alias")
+		}
+	}
+}
+
+func TestWithMetricAlias_UnknownName(t *testing.T) {
+	_, err := NewMetricsCollectionE(
+		WithCustomRegistry(prometheus.NewRegistry()),
+		WithMetricPrefix("myapp"),
+		WithMetricAlias("http_requests_total", "myapp_http_requestz_total"),
+	)
+	if err == nil || !strings.Contains(err.Error(), "myapp_http_requestz_total") {
+		t.Errorf("expected an error naming the unknown metric, got %v", err)
+	}
+}
+
+func TestWithMetricAlias_ClashAtRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "http_requests_total", Help: "Owned by the service."}))
+	_, err := NewMetricsCollectionE(
+		WithCustomRegistry(reg),
+		WithMetricPrefix("myapp"),
+		WithMetricAlias("http_requests_total", "myapp_http_requests_total"),
+	)
+	if err == nil {
+		t.Error("expected the alias to clash with the existing metric")
+	}
+}
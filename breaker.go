@@ -0,0 +1,55 @@
+package ginprom
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// overflowPath is the path label of the requests whose path arrived after
+// the circuit breaker of [WithCardinalityCircuitBreaker] tripped.
+const overflowPath = "overflow"
+
+// pathBreaker bounds the number of distinct path labels a middleware
+// records.  Once threshold paths were seen, unseen ones are reported as
+// overflowPath; paths seen before keep their own label.
+type pathBreaker struct {
+	threshold int
+
+	mu     sync.RWMutex
+	paths  map[string]struct{}
+	warned atomic.Bool
+}
+
+func newPathBreaker(threshold int) *pathBreaker {
+	return &pathBreaker{threshold: threshold, paths: make(map[string]struct{})}
+}
+
+// label returns the path label to record for path.  The first time a path is
+// refused, a warning goes to logger, or to slog.Default() when it is nil.
+func (b *pathBreaker) label(path string, logger *slog.Logger) string {
+	b.mu.RLock()
+	_, ok := b.paths[path]
+	b.mu.RUnlock()
+	if ok {
+		return path
+	}
+
+	b.mu.Lock()
+	if _, ok := b.paths[path]; !ok && len(b.paths) >= b.threshold {
+		b.mu.Unlock()
+		if !b.warned.Swap(true) {
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Warn("ginprom: too many distinct path labels; recording further paths as \"overflow\"",
+				"threshold", b.threshold,
+				"path", path,
+			)
+		}
+		return overflowPath
+	}
+	b.paths[path] = struct{}{}
+	b.mu.Unlock()
+	return path
+}
@@ -0,0 +1,62 @@
+package ginprom
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWithCardinalityCircuitBreaker(t *testing.T) {
+	var buf bytes.Buffer
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		withTestLogger(&buf),
+		WithPathAggregator(func(route, path string, status int) string { return path }),
+		WithUnmatchedRouteGrouping(false),
+		WithCardinalityCircuitBreaker(3),
+	))
+
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e", "/a"} {
+		performRequest(r, "GET", path)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] = m.GetCounter().GetValue()
+	}
+	want := map[string]float64{"/a": 2, "/b": 1, "/c": 1, "overflow": 2}
+	if len(got) != len(want) {
+		t.Fatalf("expected paths %v, got %v", want, got)
+	}
+	for path, n := range want {
+		if got[path] != n {
+			t.Errorf("%s: expected %v requests, got %v", path, n, got[path])
+		}
+	}
+
+	if n := strings.Count(buf.String(), "too many distinct path labels"); n != 1 {
+		t.Errorf("expected a single warning, got %d:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "path=/d") {
+		t.Errorf("expected the warning to name the first refused path, got %q", buf.String())
+	}
+}
+
+func TestWithCardinalityCircuitBreaker_Disabled(t *testing.T) {
+	if conf := applyOpt(WithCardinalityCircuitBreaker(0)); conf.pathBreaker != nil {
+		t.Error("expected a non-positive threshold to disable the breaker")
+	}
+	mc, reg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc, WithCardinalityCircuitBreaker(-1))
+	performRequest(r, "GET", "/ok")
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf == nil || labelValue(mf.GetMetric()[0], "path") != "/ok" {
+		t.Errorf("expected the route to be recorded, got %v", mf)
+	}
+}
@@ -0,0 +1,56 @@
+package ginprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WithCardinalityAudit registers the ginprom_series_count gauge, which reports
+// on every scrape how many series each metric of the collection currently
+// exports, labelled by metric name.  It helps spot unbounded label values,
+// such as raw URLs in the path label, before they become a problem.  Metrics
+// without any series are not reported.  Disabled by default.
+func WithCardinalityAudit(enabled bool) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.cardinalityAudit = enabled
+	}
+}
+
+// cardinalityCollector exports the number of series of a set of collectors.
+type cardinalityCollector struct {
+	desc *prometheus.Desc
+	// audited gathers the audited collectors independently of the registry
+	// they are exported from.
+	audited *prometheus.Registry
+}
+
+// newCardinalityCollector audits collectors, which must be valid for
+// registration with a fresh registry.
+func newCardinalityCollector(name string, collectors []prometheus.Collector) (*cardinalityCollector, error) {
+	audited := prometheus.NewRegistry()
+	if err := registerAll(audited, collectors); err != nil {
+		return nil, err
+	}
+	return &cardinalityCollector{
+		desc: prometheus.NewDesc(
+			name,
+			"Number of series currently exported per metric.",
+			[]string{"metric"}, nil,
+		),
+		audited: audited,
+	}, nil
+}
+
+func (cc *cardinalityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.desc
+}
+
+func (cc *cardinalityCollector) Collect(ch chan<- prometheus.Metric) {
+	families, err := cc.audited.Gather()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.desc, err)
+		return
+	}
+	for _, mf := range families {
+		ch <- prometheus.MustNewConstMetric(cc.desc, prometheus.GaugeValue, float64(len(mf.GetMetric())), mf.GetName())
+	}
+}
@@ -0,0 +1,43 @@
+package ginprom
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWithCardinalityAudit_CountsSeries(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithCardinalityAudit(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	for _, p := range []string{"/a", "/b", "/c"} {
+		r.GET(p, func(c *gin.Context) { c.Status(http.StatusOK) })
+		performRequest(r, "GET", p)
+	}
+	performRequest(r, "GET", "/a")
+
+	mf := gatherFamily(t, reg, "ginprom_series_count")
+	if mf == nil {
+		t.Fatal("expected ginprom_series_count to be exported")
+	}
+	counts := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		counts[labelValue(m, "metric")] = m.GetGauge().GetValue()
+	}
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds"} {
+		if counts[name] != 3 {
+			t.Errorf("%s: expected 3 series, got %v", name, counts[name])
+		}
+	}
+	if _, ok := counts["ginprom_series_count"]; ok {
+		t.Error("the audit gauge should not audit itself")
+	}
+}
+
+func TestWithCardinalityAudit_DisabledByDefault(t *testing.T) {
+	_, reg := newTestMetricsWithRegistry()
+	if mf := gatherFamily(t, reg, "ginprom_series_count"); mf != nil {
+		t.Errorf("expected no audit gauge by default, got %v", mf)
+	}
+}
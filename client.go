@@ -0,0 +1,288 @@
+package ginprom
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientDirection is the value of the direction label of outbound metrics.
+const clientDirection = "client"
+
+// enableClientMetrics builds and registers the outbound request collectors
+// recorded by [InstrumentRoundTripper], unless already done.  They are
+// labelled by status code, method and direction, but not by path, whose
+// cardinality is not under the control of the service.
+func (mc *MetricsCollection) enableClientMetrics() error {
+	labels := []string{mc.statusLabelName(), mc.methodLabelName(), "direction"}
+
+	err := enableVec(mc, &mc.ClientRequests, func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: mc.metricName("http_client_requests_total"),
+				Help: "Number of outbound HTTP requests.",
+			},
+			labels,
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	histograms := []struct {
+		vec     **prometheus.HistogramVec
+		name    string
+		help    string
+		buckets []float64
+	}{
+		{&mc.ClientDuration, "http_client_request_duration_seconds", "Time until the response headers of outbound HTTP requests were received, in seconds.", mc.durationBuckets},
+		{&mc.ClientRequestSize, "http_client_request_size_bytes", "Size of outbound HTTP requests, in bytes.", mc.sizeBuckets},
+		{&mc.ClientResponseSize, "http_client_response_size_bytes", "Size of the responses to outbound HTTP requests, in bytes.", mc.sizeBuckets},
+	}
+	for _, h := range histograms {
+		err := enableVec(mc, h.vec, func() *prometheus.HistogramVec {
+			return prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:    mc.metricName(h.name),
+					Help:    h.help,
+					Buckets: h.buckets,
+				},
+				labels,
+			)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientConfig holds the settings of a round tripper returned by
+// [InstrumentRoundTripper].
+type clientConfig struct {
+	traceTiming bool
+}
+
+// ClientOption is a functional option that configures the round tripper
+// returned by [InstrumentRoundTripper].
+type ClientOption func(*clientConfig)
+
+// WithClientTraceTiming breaks the latency of outbound requests down into
+// their connection phases, observed in http_client_dns_duration_seconds,
+// http_client_connect_duration_seconds and http_client_tls_duration_seconds,
+// labelled by method and direction.  These histograms are built and
+// registered by the first [InstrumentRoundTripper] call with this option,
+// which panics if they cannot be registered.  The phases are traced with
+// [net/http/httptrace] and only happen for new connections, so requests
+// reusing a pooled connection observe none of them.  Disabled by default.
+func WithClientTraceTiming(enabled bool) ClientOption {
+	return func(c *clientConfig) {
+		c.traceTiming = enabled
+	}
+}
+
+// InstrumentRoundTripper wraps next, or [http.DefaultTransport] when next is
+// nil, so that outbound requests are recorded in the client metrics of mc:
+// http_client_requests_total, http_client_request_duration_seconds,
+// http_client_request_size_bytes and http_client_response_size_bytes, all
+// labelled with direction="client".  Requests that fail without a response
+// are recorded with the "error" status code.  The client metrics are built
+// and registered by the first call, which panics if they cannot be
+// registered.
+//
+// The duration ends when the response headers are received.  The response
+// size is taken from Content-Length or, when unknown, counted as the body is
+// read and recorded once it is fully read or closed.
+//
+// Example:
+//
+//	mc := ginprom.NewMetricsCollection()
+//	client := &http.Client{Transport: ginprom.InstrumentRoundTripper(mc, nil)}
+func InstrumentRoundTripper(mc *MetricsCollection, next http.RoundTripper, opts ...ClientOption) http.RoundTripper {
+	if err := mc.enableClientMetrics(); err != nil {
+		panic(err)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t := &instrumentedTransport{mc: mc, next: next}
+	for _, opt := range opts {
+		opt(&t.conf)
+	}
+	if t.conf.traceTiming {
+		if err := mc.enablePhaseMetrics(); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
+// enablePhaseMetrics builds and registers the connection phase histograms
+// observed by [WithClientTraceTiming], unless already done.  Connection
+// phases happen before there is a status code, so they are labelled by method
+// and direction only.
+func (mc *MetricsCollection) enablePhaseMetrics() error {
+	phases := []struct {
+		vec  **prometheus.HistogramVec
+		name string
+		help string
+	}{
+		{&mc.ClientDNSDuration, "http_client_dns_duration_seconds", "Time spent resolving host names for outbound HTTP requests, in seconds."},
+		{&mc.ClientConnectDuration, "http_client_connect_duration_seconds", "Time spent establishing TCP connections for outbound HTTP requests, in seconds."},
+		{&mc.ClientTLSDuration, "http_client_tls_duration_seconds", "Time spent on TLS handshakes for outbound HTTP requests, in seconds."},
+	}
+	for _, p := range phases {
+		err := enableVec(mc, p.vec, func() *prometheus.HistogramVec {
+			return prometheus.NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:    mc.metricName(p.name),
+					Help:    p.help,
+					Buckets: mc.durationBuckets,
+				},
+				[]string{mc.methodLabelName(), "direction"},
+			)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instrumentedTransport is the round tripper returned by
+// [InstrumentRoundTripper].
+type instrumentedTransport struct {
+	mc   *MetricsCollection
+	next http.RoundTripper
+	conf clientConfig
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.conf.traceTiming {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace(req.Method)))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Seconds()
+
+	status := "error"
+	if err == nil {
+		if resp.StatusCode >= 0 && resp.StatusCode < len(statusAddr) {
+			status = statusAddr[resp.StatusCode]
+		} else {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+	}
+	lvs := []string{status, req.Method, clientDirection}
+
+	t.mc.add(t.mc.ClientRequests, "http_client_requests_total", 1, lvs...)
+	t.mc.observe(t.mc.ClientDuration, "http_client_request_duration_seconds", elapsed, lvs...)
+
+	requestSize := requestHeaderSize(req)
+	if req.ContentLength > 0 {
+		requestSize += req.ContentLength
+	}
+	t.mc.observe(t.mc.ClientRequestSize, "http_client_request_size_bytes", float64(requestSize), lvs...)
+
+	if err != nil {
+		return resp, err
+	}
+	if resp.ContentLength >= 0 || resp.Body == nil {
+		t.mc.observe(t.mc.ClientResponseSize, "http_client_response_size_bytes", float64(max(resp.ContentLength, 0)), lvs...)
+	} else {
+		resp.Body = &countingBody{ReadCloser: resp.Body, record: func(n int64) {
+			t.mc.observe(t.mc.ClientResponseSize, "http_client_response_size_bytes", float64(n), lvs...)
+		}}
+	}
+	return resp, nil
+}
+
+// trace returns the hooks observing the connection phases of a request.
+// Connections may be dialled to several addresses in parallel, so their
+// start times are kept per address.
+func (t *instrumentedTransport) trace(method string) *httptrace.ClientTrace {
+	var (
+		mu           sync.Mutex
+		dnsStart     time.Time
+		tlsStart     time.Time
+		connectStart = map[string]time.Time{}
+	)
+	observe := func(vec *prometheus.HistogramVec, metric string, since time.Time) {
+		t.mc.observe(vec, metric, time.Since(since).Seconds(), method, clientDirection)
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !dnsStart.IsZero() {
+				observe(t.mc.ClientDNSDuration, "http_client_dns_duration_seconds", dnsStart)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+" "+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if at, ok := connectStart[network+" "+addr]; ok && err == nil {
+				observe(t.mc.ClientConnectDuration, "http_client_connect_duration_seconds", at)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !tlsStart.IsZero() && err == nil {
+				observe(t.mc.ClientTLSDuration, "http_client_tls_duration_seconds", tlsStart)
+			}
+		},
+	}
+}
+
+// countingBody counts the bytes read from a body and, when record is set,
+// reports them once, at EOF or on Close, whichever comes first.
+type countingBody struct {
+	io.ReadCloser
+	n      int64
+	once   sync.Once
+	record func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.report()
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.report()
+	return b.ReadCloser.Close()
+}
+
+// report hands the count to record the first time it is called.
+func (b *countingBody) report() {
+	if b.record != nil {
+		b.once.Do(func() { b.record(b.n) })
+	}
+}
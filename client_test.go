@@ -0,0 +1,204 @@
+package ginprom
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stubTransport answers every request with resp, or fails with err.
+type stubTransport struct {
+	resp *http.Response
+	err  error
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.resp, nil
+}
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	client := &http.Client{Transport: InstrumentRoundTripper(mc, &stubTransport{resp: &http.Response{
+		StatusCode:    http.StatusCreated,
+		Body:          io.NopCloser(strings.NewReader("created")),
+		ContentLength: 7,
+	}})}
+
+	resp, err := client.Post("http://upstream.example/items", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	mf := gatherFamily(t, reg, "http_client_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one client request series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	for name, want := range map[string]string{"direction": "client", "method": "POST", "status_code": "201"} {
+		if got := labelValue(m, name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("expected 1 request, got %v", got)
+	}
+
+	if mf := gatherFamily(t, reg, "http_client_request_duration_seconds"); mf == nil {
+		t.Error("expected a client duration series")
+	}
+	if mf := gatherFamily(t, reg, "http_client_request_size_bytes"); mf == nil || mf.GetMetric()[0].GetHistogram().GetSampleSum() <= 7 {
+		t.Errorf("expected the request size to include the 7-byte body, got %v", mf)
+	}
+	mf = gatherFamily(t, reg, "http_client_response_size_bytes")
+	if mf == nil || mf.GetMetric()[0].GetHistogram().GetSampleSum() != 7 {
+		t.Errorf("expected a response size of 7, got %v", mf)
+	}
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf != nil {
+		t.Errorf("expected no server-side series, got %v", mf)
+	}
+}
+
+func TestInstrumentRoundTripper_UnknownLength(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	rt := InstrumentRoundTripper(mc, &stubTransport{resp: &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          io.NopCloser(strings.NewReader("streamed body")),
+		ContentLength: -1,
+	}})
+
+	req, _ := http.NewRequest("GET", "http://upstream.example/stream", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	if mf := gatherFamily(t, reg, "http_client_response_size_bytes"); mf != nil {
+		t.Errorf("expected no response size before the body was read, got %v", mf)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	mf := gatherFamily(t, reg, "http_client_response_size_bytes")
+	if mf == nil || mf.GetMetric()[0].GetHistogram().GetSampleCount() != 1 || mf.GetMetric()[0].GetHistogram().GetSampleSum() != 13 {
+		t.Errorf("expected one response size of 13, got %v", mf)
+	}
+}
+
+func TestInstrumentRoundTripper_Error(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	rt := InstrumentRoundTripper(mc, &stubTransport{err: errors.New("connection refused")})
+
+	req, _ := http.NewRequest("GET", "http://upstream.example/", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("expected the transport error")
+	}
+
+	mf := gatherFamily(t, reg, "http_client_requests_total")
+	if mf == nil || labelValue(mf.GetMetric()[0], "status_code") != "error" {
+		t.Errorf("expected a request labelled status_code=\"error\", got %v", mf)
+	}
+	if mf := gatherFamily(t, reg, "http_client_response_size_bytes"); mf != nil {
+		t.Errorf("expected no response size for a failed request, got %v", mf)
+	}
+}
+
+func TestWithClientTraceTiming(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	mc, reg := newTestMetricsWithRegistry()
+	client := &http.Client{Transport: InstrumentRoundTripper(mc, srv.Client().Transport, WithClientTraceTiming(true))}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	// The second request reuses the connection
+	for _, name := range []string{"http_client_tls_duration_seconds", "http_client_connect_duration_seconds"} {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("%s: expected one series, got %v", name, mf)
+		}
+		m := mf.GetMetric()[0]
+		if got := m.GetHistogram().GetSampleCount(); got != 1 {
+			t.Errorf("%s: expected one observation, got %d", name, got)
+		}
+		if labelValue(m, "method") != "GET" || labelValue(m, "direction") != "client" {
+			t.Errorf("%s: unexpected labels %v", name, m.GetLabel())
+		}
+	}
+	// The server listens on an IP address, so nothing is resolved
+	if mf := gatherFamily(t, reg, "http_client_dns_duration_seconds"); mf != nil {
+		t.Errorf("expected no DNS lookup, got %v", mf)
+	}
+}
+
+func TestWithClientTraceTiming_Disabled(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	mc, reg := newTestMetricsWithRegistry()
+	client := &http.Client{Transport: InstrumentRoundTripper(mc, srv.Client().Transport)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if mc.ClientTLSDuration != nil {
+		t.Errorf("expected no phase histograms to be built by default")
+	}
+	if mf := gatherFamily(t, reg, "http_client_tls_duration_seconds"); mf != nil {
+		t.Errorf("expected no phase timing by default, got %v", mf)
+	}
+}
+
+func TestInstrumentRoundTripper_BuiltOnDemand(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	if mc.ClientRequests != nil || mc.ClientDuration != nil || mc.ClientRequestSize != nil || mc.ClientResponseSize != nil {
+		t.Fatal("expected no client metrics before InstrumentRoundTripper")
+	}
+
+	InstrumentRoundTripper(mc, nil)
+	InstrumentRoundTripper(mc, nil)
+	if mc.ClientRequests == nil || mc.ClientDuration == nil || mc.ClientRequestSize == nil || mc.ClientResponseSize == nil {
+		t.Fatal("expected InstrumentRoundTripper to build the client metrics")
+	}
+	mc.ClientRequests.WithLabelValues("200", "GET", clientDirection).Inc()
+	if gatherFamily(t, reg, "http_client_requests_total") == nil {
+		t.Error("expected the client metrics to be registered")
+	}
+}
+
+func TestInstrumentRoundTripper_RegistrationClash(t *testing.T) {
+	reg := newTestRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "http_client_requests_total", Help: "Owned by the service."}))
+	mc, err := NewMetricsCollectionE(WithCustomRegistry(reg))
+	if err != nil {
+		t.Fatalf("expected the client metrics not to be registered with the collection, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected InstrumentRoundTripper to panic when the client metrics cannot be registered")
+		}
+		if mc.ClientRequests != nil {
+			t.Error("expected ClientRequests to stay nil after a failed registration")
+		}
+	}()
+	InstrumentRoundTripper(mc, nil)
+}
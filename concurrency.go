@@ -0,0 +1,64 @@
+package ginprom
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeLimit tracks the requests in flight for a single route template and
+// the maximum allowed concurrently.
+type routeLimit struct {
+	limit    int64
+	inFlight atomic.Int64
+}
+
+// acquire reserves a slot for a new request.  It returns false, without
+// reserving anything, when the route is already at its limit.
+func (l *routeLimit) acquire() bool {
+	if l.inFlight.Add(1) > l.limit {
+		l.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release frees a slot reserved by acquire.
+func (l *routeLimit) release() {
+	l.inFlight.Add(-1)
+}
+
+// enforceConcurrencyLimit applies the concurrency limit configured for route,
+// if any.  Rejected requests are aborted with 429 Too Many Requests and
+// counted; admitted ones are tracked in the in-flight gauge.  The returned
+// function must be called once the request completes.
+func enforceConcurrencyLimit(c *gin.Context, conf *config, route string, metrics *MetricsCollection) (done func()) {
+	limit, ok := conf.concurrencyLimits[route]
+	if !ok {
+		return func() {}
+	}
+
+	if !limit.acquire() {
+		if metrics.RejectedRequests != nil {
+			metrics.add(metrics.RejectedRequests, "http_requests_rejected_total", 1, c.Request.Method, route)
+		}
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return func() {}
+	}
+
+	// The slot is still enforced when the gauge cannot be updated
+	if metrics.InFlightRequests == nil {
+		return limit.release
+	}
+	gauge, err := metrics.InFlightRequests.GetMetricWithLabelValues(route)
+	if err != nil {
+		metrics.MetricErrors.WithLabelValues("http_requests_in_flight").Inc()
+		return limit.release
+	}
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+		limit.release()
+	}
+}
@@ -0,0 +1,100 @@
+package ginprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ---------------------------------------------------------------------------
+// WithConcurrencyLimit
+// ---------------------------------------------------------------------------
+
+func TestWithConcurrencyLimit_UnderLimit(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithConcurrencyLimit(map[string]int{"/report": 1})))
+	r.GET("/report", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 3; i++ {
+		if w := performRequest(r, "GET", "/report"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+
+	if mf := gatherFamily(t, reg, "http_requests_rejected_total"); mf != nil {
+		t.Errorf("expected no rejections, got %v", mf)
+	}
+	mf := gatherFamily(t, reg, "http_requests_in_flight")
+	if mf == nil || mf.GetMetric()[0].GetGauge().GetValue() != 0 {
+		t.Errorf("expected the in-flight gauge to return to 0, got %v", mf)
+	}
+}
+
+func TestWithConcurrencyLimit_NonPositiveIgnored(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithConcurrencyLimit(map[string]int{"/zero": 0, "/negative": -1})))
+	r.GET("/zero", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/negative", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, p := range []string{"/zero", "/negative"} {
+		if w := performRequest(r, "GET", p); w.Code != http.StatusOK {
+			t.Errorf("%s: expected the route to stay unlimited, got %d", p, w.Code)
+		}
+	}
+	if mf := gatherFamily(t, reg, "http_requests_rejected_total"); mf != nil {
+		t.Errorf("expected no rejections, got %v", mf)
+	}
+	if mf := gatherFamily(t, reg, "http_requests_in_flight"); mf != nil {
+		t.Errorf("expected ignored routes not to be tracked, got %v", mf)
+	}
+}
+
+func TestWithConcurrencyLimit_OverLimit(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithConcurrencyLimit(map[string]int{"/report": 1})))
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	r.GET("/report", func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	r.GET("/other", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- performRequest(r, "GET", "/report") }()
+	<-entered
+
+	if g := gatherFamily(t, reg, "http_requests_in_flight"); g == nil || g.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Errorf("expected one request in flight, got %v", g)
+	}
+	if w := performRequest(r, "GET", "/report"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over the limit, got %d", w.Code)
+	}
+	if w := performRequest(r, "GET", "/other"); w.Code != http.StatusOK {
+		t.Errorf("expected unlimited routes to pass, got %d", w.Code)
+	}
+
+	close(release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("expected the admitted request to succeed, got %d", w.Code)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_rejected_total")
+	if mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("expected one rejection, got %v", mf)
+	}
+	counts := map[string]bool{}
+	for _, m := range gatherFamily(t, reg, "http_requests_total").GetMetric() {
+		counts[labelValue(m, "status_code")] = true
+	}
+	if !counts["429"] {
+		t.Errorf("expected the rejection to be recorded with status 429, got %v", counts)
+	}
+}
@@ -0,0 +1,27 @@
+package ginprom
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handlerCPUTime runs the rest of the handler chain with the goroutine locked
+// to its OS thread and returns the CPU time the thread spent on it, or -1 when
+// the platform cannot measure it.
+func handlerCPUTime(c *gin.Context) time.Duration {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	before, ok := threadCPUTime()
+	c.Next()
+	if !ok {
+		return -1
+	}
+	after, ok := threadCPUTime()
+	if !ok || after < before {
+		return -1
+	}
+	return after - before
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package ginprom
+
+import (
+	"syscall"
+	"time"
+)
+
+// rusageThread is RUSAGE_THREAD, which the syscall package does not define.
+const rusageThread = 1
+
+// threadCPUTime returns the user and system CPU time consumed by the calling
+// OS thread.
+func threadCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(rusageThread, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
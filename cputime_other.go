@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ginprom
+
+import "time"
+
+// threadCPUTime is not supported on this platform.
+func threadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
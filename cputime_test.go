@@ -0,0 +1,48 @@
+package ginprom
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWithRecordCPUTime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("thread CPU time is only measured on Linux")
+	}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordCPUTime(true)))
+	r.GET("/burn", func(c *gin.Context) {
+		x := 0
+		for deadline := time.Now().Add(20 * time.Millisecond); time.Now().Before(deadline); {
+			x++
+		}
+		c.String(http.StatusOK, "%d", x)
+	})
+	performRequest(r, "GET", "/burn")
+
+	mf := gatherFamily(t, reg, "http_request_cpu_seconds")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one CPU time series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "path") != "/burn" {
+		t.Errorf("expected path /burn, got %q", labelValue(m, "path"))
+	}
+	if sum := m.GetHistogram().GetSampleSum(); sum <= 0 {
+		t.Errorf("expected non-zero CPU time, got %v", sum)
+	}
+}
+
+func TestWithRecordCPUTime_Disabled(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+
+	if mf := gatherFamily(t, reg, "http_request_cpu_seconds"); mf != nil {
+		t.Errorf("expected no CPU time by default, got %v", mf)
+	}
+}
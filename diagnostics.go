@@ -0,0 +1,50 @@
+package ginprom
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// orderingWarned is set once the ordering warning has been logged, so that a
+// misconfigured router does not flood the logs.
+var orderingWarned atomic.Bool
+
+// discardLogger drops every record; it is the default logger.
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a [slog.Handler] that is never enabled.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// log returns the logger set with [WithLogger], or a logger that discards
+// everything.
+func (c *config) log() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return discardLogger
+}
+
+// checkOrdering warns, once per process, when the response was already
+// written before the middleware ran.  As the check was explicitly asked for,
+// the warning falls back to slog.Default() when no logger was set.
+func checkOrdering(c *gin.Context, conf *config) {
+	if !c.Writer.Written() || orderingWarned.Swap(true) {
+		return
+	}
+	logger := conf.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("ginprom: response already written when the metrics middleware ran; register it before middleware that writes responses",
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+	)
+}
@@ -0,0 +1,88 @@
+package ginprom
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withTestLogger routes diagnostics of every level to a buffer.
+func withTestLogger(buf *bytes.Buffer) Option {
+	return WithLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+}
+
+func TestWithValidateOrdering_WarnsOnce(t *testing.T) {
+	orderingWarned.Store(false)
+	defer orderingWarned.Store(false)
+
+	var buf bytes.Buffer
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	// A middleware that replies before ours runs
+	r.Use(func(c *gin.Context) {
+		c.String(http.StatusOK, "early")
+		c.Writer.WriteHeaderNow()
+	})
+	r.Use(MiddlewareWithMetrics(mc, WithValidateOrdering(true), withTestLogger(&buf)))
+	r.GET("/items", func(c *gin.Context) {})
+
+	performRequest(r, "GET", "/items")
+	performRequest(r, "GET", "/items")
+
+	if n := strings.Count(buf.String(), "response already written"); n != 1 {
+		t.Errorf("expected exactly one ordering warning, got %d in %q", n, buf.String())
+	}
+}
+
+func TestWithValidateOrdering_CorrectOrderIsSilent(t *testing.T) {
+	orderingWarned.Store(false)
+	defer orderingWarned.Store(false)
+
+	var buf bytes.Buffer
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithValidateOrdering(true), withTestLogger(&buf)))
+	r.GET("/items", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	performRequest(r, "GET", "/items")
+
+	if buf.Len() != 0 {
+		t.Errorf("expected no warning, got %q", buf.String())
+	}
+}
+
+// failingReader fails every read, like a client that went away mid-upload.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWithLogger_LogsRequestSizeError(t *testing.T) {
+	var buf bytes.Buffer
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, withTestLogger(&buf)))
+	r.POST("/upload", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("POST", "/upload", failingReader{})
+	req.ContentLength = -1
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(buf.String(), "measuring request size failed") || !strings.Contains(buf.String(), "connection reset") {
+		t.Errorf("expected the body read error to be logged, got %q", buf.String())
+	}
+}
+
+func TestRecordedRequestSize_SilentByDefault(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/upload", failingReader{})
+	req.ContentLength = -1
+	if size := recordedRequestSize(defaultConf(), req); size != 0 {
+		t.Errorf("expected a failed measurement to record 0, got %d", size)
+	}
+}
@@ -0,0 +1,49 @@
+package ginprom
+
+import (
+	"sync"
+	"time"
+)
+
+// duplicateDetector remembers the idempotency keys seen during the last
+// window.  Expired keys are swept at most once per window, so memory is
+// bounded by the number of distinct keys received in two windows.
+type duplicateDetector struct {
+	header string
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDuplicateDetector(header string, window time.Duration) *duplicateDetector {
+	return &duplicateDetector{
+		header: header,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// duplicate records key as seen at now and reports whether it was already
+// seen less than a window earlier.  The window starts at the first sighting,
+// so a key repeated continuously is reported again once per window.
+func (d *duplicateDetector) duplicate(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, at := range d.seen {
+			if now.Sub(at) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if at, ok := d.seen[key]; ok && now.Sub(at) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,65 @@
+package ginprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWithDuplicateDetection(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithClock(clock.Now),
+		WithDuplicateDetection("Idempotency-Key", time.Minute),
+	))
+	r.POST("/payments", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+	send := func(key string) {
+		req := httptest.NewRequest("POST", "/payments", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("abc")
+	clock.Advance(10 * time.Second)
+	send("abc") // duplicate
+	send("def")
+	send("")
+	send("")
+
+	duplicates := func() float64 {
+		mf := gatherFamily(t, reg, "http_duplicate_requests_total")
+		if mf == nil {
+			return 0
+		}
+		return mf.GetMetric()[0].GetCounter().GetValue()
+	}
+	if got := duplicates(); got != 1 {
+		t.Fatalf("expected 1 duplicate, got %v", got)
+	}
+
+	// Once the window passed the key is forgotten
+	clock.Advance(2 * time.Minute)
+	send("abc")
+	if got := duplicates(); got != 1 {
+		t.Errorf("expected a key outside the window not to count, got %v duplicates", got)
+	}
+}
+
+func TestDuplicateDetector_EvictsExpiredKeys(t *testing.T) {
+	d := newDuplicateDetector("Idempotency-Key", time.Minute)
+	now := time.Unix(1700000000, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		d.duplicate(key, now)
+	}
+	d.duplicate("d", now.Add(2*time.Minute))
+	if len(d.seen) != 1 {
+		t.Errorf("expected expired keys to be evicted, %d left", len(d.seen))
+	}
+}
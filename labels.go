@@ -0,0 +1,500 @@
+package ginprom
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// labelExtractor contributes additional label dimensions to the four main
+// metrics.  The names are appended, in order, after the standard status_code,
+// method and path labels, and extract returns one value per name for every
+// recorded request.
+type labelExtractor struct {
+	names   []string
+	extract func(c *gin.Context) []string
+}
+
+// WithExtraLabels adds user-defined label dimensions to the four main
+// metrics.  names are appended to the standard labels and extractor is called
+// once per recorded request, after the handler chain has run, to produce the
+// matching values in the same order.  When the extractor returns a slice
+// whose length differs from len(names) every extra label is recorded as an
+// empty string.
+//
+// Collectors supplied through the WithCustom* options must declare the extra
+// label names as well.  A nil extractor, or names that are invalid, reserved
+// or already used by the four main metrics, make [NewMetricsCollectionE]
+// fail.
+//
+// Example – slice all metrics by a tenant header:
+//
+//	mc := ginprom.NewMetricsCollection(
+//	    ginprom.WithExtraLabels([]string{"tenant"}, func(c *gin.Context) []string {
+//	        return []string{c.GetHeader("X-Tenant")}
+//	    }),
+//	)
+func WithExtraLabels(names []string, extractor func(c *gin.Context) []string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		if extractor == nil {
+			mc.setErr(errors.New("ginprom: WithExtraLabels: nil extractor"))
+			return
+		}
+		used := map[string]struct{}{}
+		for _, name := range mc.labelNames() {
+			used[name] = struct{}{}
+		}
+		for _, name := range names {
+			if !model.LegacyValidation.IsValidLabelName(name) || strings.HasPrefix(name, "__") {
+				mc.setErr(fmt.Errorf("ginprom: WithExtraLabels: label name %q is invalid", name))
+				return
+			}
+			if _, ok := used[name]; ok {
+				mc.setErr(fmt.Errorf("ginprom: WithExtraLabels: label name %q is already used", name))
+				return
+			}
+			used[name] = struct{}{}
+		}
+		mc.extraLabels = append(mc.extraLabels, labelExtractor{names: append([]string(nil), names...), extract: extractor})
+	}
+}
+
+// WithHeaderValueLabel adds a labelName label to the four main metrics whose
+// value is the request header headerName, bounded to the allowed values:
+// other values are recorded as "other" and an absent header as "".
+//
+// Example – slice metrics by a known set of tenants:
+//
+//	ginprom.WithHeaderValueLabel("tenant", "X-Tenant", []string{"acme", "globex"})
+func WithHeaderValueLabel(labelName, headerName string, allowed []string) MetricsOption {
+	allow := make(map[string]struct{}, len(allowed))
+	for _, v := range allowed {
+		allow[v] = struct{}{}
+	}
+	return WithExtraLabels([]string{labelName}, func(c *gin.Context) []string {
+		v := c.GetHeader(headerName)
+		if v == "" {
+			return []string{""}
+		}
+		if _, ok := allow[v]; !ok {
+			return []string{"other"}
+		}
+		return []string{v}
+	})
+}
+
+// WithRetryCountLabel adds a "retry" label to the four main metrics that
+// flags retried requests from the retry count clients send in the header
+// named header, e.g. "X-Retry-Count".  The label is bounded to "0", "1" and
+// "2+"; a missing or invalid header is recorded as "0".
+func WithRetryCountLabel(header string) MetricsOption {
+	return WithExtraLabels([]string{"retry"}, func(c *gin.Context) []string {
+		n, err := strconv.Atoi(strings.TrimSpace(c.GetHeader(header)))
+		switch {
+		case err != nil || n <= 0:
+			return []string{"0"}
+		case n == 1:
+			return []string{"1"}
+		default:
+			return []string{"2+"}
+		}
+	})
+}
+
+// WithProtocolLabel adds an "http_version" label to the four main metrics
+// with the protocol version of the request, such as "1.0", "1.1", "2" or "3",
+// to compare HTTP/1.1 and HTTP/2 traffic.  Disabled by default.
+func WithProtocolLabel(enabled bool) MetricsOption {
+	if !enabled {
+		return func(*MetricsCollection) {}
+	}
+	return WithExtraLabels([]string{"http_version"}, func(c *gin.Context) []string {
+		return []string{protocolVersion(c.Request.ProtoMajor, c.Request.ProtoMinor)}
+	})
+}
+
+// protocolVersion formats an HTTP version the way it is usually written:
+// with the minor version for HTTP/1 and without it from HTTP/2 on.
+func protocolVersion(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major)
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+// WithTLSLabel adds a "tls" label to the four main metrics, "true" when the
+// request arrived over TLS and "false" otherwise.  Behind a TLS-terminating
+// proxy the connection itself is plaintext, so each of the proxyHeaders, e.g.
+// "X-Forwarded-Proto", is consulted as well and a first value of "https"
+// marks the request as secure.  Only name headers the proxy always sets or
+// overwrites, as clients can send them too.  Disabled by default.
+//
+// Example:
+//
+//	ginprom.WithTLSLabel(true, "X-Forwarded-Proto")
+func WithTLSLabel(enabled bool, proxyHeaders ...string) MetricsOption {
+	if !enabled {
+		return func(*MetricsCollection) {}
+	}
+	proxyHeaders = append([]string(nil), proxyHeaders...)
+	return WithExtraLabels([]string{"tls"}, func(c *gin.Context) []string {
+		if c.Request.TLS != nil {
+			return []string{"true"}
+		}
+		for _, header := range proxyHeaders {
+			proto, _, _ := strings.Cut(c.GetHeader(header), ",")
+			if strings.EqualFold(strings.TrimSpace(proto), "https") {
+				return []string{"true"}
+			}
+		}
+		return []string{"false"}
+	})
+}
+
+// WithRequestEncodingLabel adds a "request_encoding" label to the four main
+// metrics with the Content-Encoding of the request body: "gzip", "br",
+// "identity" when the header is absent, and "other" for any other encoding
+// or a list of several, keeping the label bounded whatever clients send.
+// Disabled by default.
+func WithRequestEncodingLabel(enabled bool) MetricsOption {
+	if !enabled {
+		return func(*MetricsCollection) {}
+	}
+	return WithExtraLabels([]string{"request_encoding"}, func(c *gin.Context) []string {
+		return []string{requestEncoding(c.GetHeader("Content-Encoding"))}
+	})
+}
+
+// requestEncoding maps a Content-Encoding header value to one of the values
+// of the request_encoding label.
+func requestEncoding(header string) string {
+	switch strings.ToLower(strings.TrimSpace(header)) {
+	case "", "identity":
+		return "identity"
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "br":
+		return "br"
+	default:
+		return "other"
+	}
+}
+
+// WithResponseHeaderLabel adds a label called labelName to the four main
+// metrics with the value of the response header headerName as set by the
+// handler chain.  Values are matched case-insensitively against allowed and
+// recorded as spelled there; other values collapse to "other" so the label
+// stays bounded, and responses without the header get an empty value.
+//
+// Example – split metrics by the cache outcome a caching layer reports:
+//
+//	ginprom.WithResponseHeaderLabel("cache", "X-Cache", []string{"HIT", "MISS"})
+func WithResponseHeaderLabel(labelName, headerName string, allowed []string) MetricsOption {
+	allowed = append([]string(nil), allowed...)
+	return WithExtraLabels([]string{labelName}, func(c *gin.Context) []string {
+		v := c.Writer.Header().Get(headerName)
+		if v == "" {
+			return []string{""}
+		}
+		for _, a := range allowed {
+			if strings.EqualFold(v, a) {
+				return []string{a}
+			}
+		}
+		return []string{"other"}
+	})
+}
+
+// WithEmptyBodyLabel adds an "empty_body" label to the four main metrics,
+// "true" when the handler chain wrote no response body, as for a 304 Not
+// Modified, and "false" otherwise, for cache-hit analysis.  The body size is
+// taken from gin.ResponseWriter.Size.  Disabled by default.
+func WithEmptyBodyLabel(enabled bool) MetricsOption {
+	if !enabled {
+		return func(*MetricsCollection) {}
+	}
+	return WithExtraLabels([]string{"empty_body"}, func(c *gin.Context) []string {
+		return []string{strconv.FormatBool(c.Writer.Size() <= 0)}
+	})
+}
+
+// WithRouteGroupLabel adds a "group" label to the four main metrics with the
+// leading depth segments of the matched route template, e.g. "/api/v1" for
+// "/api/v1/users/:id" at depth 2, for coarse dashboards per router group.
+// Shorter templates are used whole, and requests that matched no route are
+// labelled "ungrouped".  A non-positive depth adds no label.
+func WithRouteGroupLabel(depth int) MetricsOption {
+	if depth <= 0 {
+		return func(*MetricsCollection) {}
+	}
+	return WithExtraLabels([]string{"group"}, func(c *gin.Context) []string {
+		route := c.FullPath()
+		if route == "" {
+			return []string{"ungrouped"}
+		}
+		return []string{routeGroup(route, depth)}
+	})
+}
+
+// routeGroup returns the leading depth non-empty segments of route.
+func routeGroup(route string, depth int) string {
+	segments := 0
+	inSegment := false
+	for i := 0; i < len(route); i++ {
+		if route[i] == '/' {
+			if inSegment && segments == depth {
+				return route[:i]
+			}
+			inSegment = false
+		} else if !inSegment {
+			inSegment = true
+			segments++
+		}
+	}
+	return route
+}
+
+// WithRouteMetadata tags routes with static labels, such as the owning team,
+// for ownership dashboards.  metadata maps route templates to their labels;
+// every label name used by any route is added to the four main metrics, in
+// sorted order, and routes without a value for it record "".
+//
+// Example:
+//
+//	ginprom.WithRouteMetadata(map[string]map[string]string{
+//	    "/checkout":  {"team": "payments"},
+//	    "/users/:id": {"team": "identity", "tier": "1"},
+//	})
+func WithRouteMetadata(metadata map[string]map[string]string) MetricsOption {
+	seen := map[string]struct{}{}
+	var names []string
+	for _, labels := range metadata {
+		for name := range labels {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	values := make(map[string][]string, len(metadata))
+	for route, labels := range metadata {
+		routeValues := make([]string, len(names))
+		for i, name := range names {
+			routeValues[i] = labels[name]
+		}
+		values[route] = routeValues
+	}
+	empty := make([]string, len(names))
+
+	return WithExtraLabels(names, func(c *gin.Context) []string {
+		if v, ok := values[c.FullPath()]; ok {
+			return v
+		}
+		return empty
+	})
+}
+
+// LabelsContextKey is the Gin context key under which [WithLabels] stores the
+// label values read by [WithContextLabels].
+const LabelsContextKey = "ginprom_labels"
+
+// WithContextLabels adds the label names to the four main metrics and takes
+// their values from the labels handlers attach to the request with
+// [WithLabels], so that code deep in the call stack can label the request it
+// serves.  Only the declared names are used; other labels set by handlers are
+// ignored, and names without a value are recorded as "".
+//
+// Example:
+//
+//	mc := ginprom.NewMetricsCollection(ginprom.WithContextLabels("feature_flag"))
+//	// ... in a handler:
+//	ginprom.WithLabels(c, prometheus.Labels{"feature_flag": "new_checkout"})
+func WithContextLabels(names ...string) MetricsOption {
+	names = append([]string(nil), names...)
+	return WithExtraLabels(names, func(c *gin.Context) []string {
+		values := make([]string, len(names))
+		if labels, ok := c.Value(LabelsContextKey).(prometheus.Labels); ok {
+			for i, name := range names {
+				values[i] = labels[name]
+			}
+		}
+		return values
+	})
+}
+
+// WithLabels attaches label values to the current request for the names
+// declared with [WithContextLabels].  Repeated calls merge the labels, later
+// values replacing earlier ones.  labels is copied and may be reused.
+func WithLabels(c *gin.Context, labels prometheus.Labels) {
+	merged := prometheus.Labels{}
+	if existing, ok := c.Value(LabelsContextKey).(prometheus.Labels); ok {
+		for name, value := range existing {
+			merged[name] = value
+		}
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+	c.Set(LabelsContextKey, merged)
+}
+
+// WithPathLabelName renames the path label, e.g. to "route" or "endpoint"
+// for existing dashboards.  The new name is used by every metric carrying
+// the label.
+func WithPathLabelName(name string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.pathLabel = name
+	}
+}
+
+// WithMethodLabelName renames the method label of every metric carrying it.
+func WithMethodLabelName(name string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.methodLabel = name
+	}
+}
+
+// WithStatusLabelName renames the status_code label of every metric carrying
+// it.
+func WithStatusLabelName(name string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.statusLabel = name
+	}
+}
+
+// statusLabelName returns the name of the status_code label.
+func (mc *MetricsCollection) statusLabelName() string {
+	if mc.statusLabel != "" {
+		return mc.statusLabel
+	}
+	return "status_code"
+}
+
+// methodLabelName returns the name of the method label.
+func (mc *MetricsCollection) methodLabelName() string {
+	if mc.methodLabel != "" {
+		return mc.methodLabel
+	}
+	return "method"
+}
+
+// pathLabelName returns the name of the path label.
+func (mc *MetricsCollection) pathLabelName() string {
+	if mc.pathLabel != "" {
+		return mc.pathLabel
+	}
+	return "path"
+}
+
+// WithDisablePathLabel removes the path label from the four main metrics,
+// leaving the status code, method and extra labels, for deployments where
+// even route templates carry too many series.  Only those four lose it: the
+// auxiliary metrics, such as the SLO counters labelled by method and path,
+// keep their path label.  Collectors supplied through the WithCustom*
+// options must not declare the label either.
+func WithDisablePathLabel(disabled bool) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.disablePathLabel = disabled
+	}
+}
+
+// labelNames returns the label names shared by the four main metrics.
+func (mc *MetricsCollection) labelNames() []string {
+	names := []string{mc.statusLabelName(), mc.methodLabelName(), mc.pathLabelName()}
+	if mc.disablePathLabel {
+		names = names[:2]
+	}
+	for _, e := range mc.extraLabels {
+		names = append(names, e.names...)
+	}
+	return names
+}
+
+// labelValues returns the label values for a single observation, in the order
+// given by labelNames.  For matched routes without extra labels the slice is
+// shared between requests, see cachedLabelValues, and must not be modified.
+func (mc *MetricsCollection) labelValues(c *gin.Context, statusCode, method, path string) []string {
+	if len(mc.extraLabels) == 0 {
+		if c != nil && c.FullPath() != "" {
+			return mc.cachedLabelValues(statusCode, method, path)
+		}
+		return mc.baseLabelValues(statusCode, method, path)
+	}
+
+	lvs := mc.baseLabelValues(statusCode, method, path)
+
+	for _, e := range mc.extraLabels {
+		values := e.extract(c)
+		if len(values) != len(e.names) {
+			values = make([]string, len(e.names))
+		}
+		lvs = append(lvs, values...)
+	}
+	return lvs
+}
+
+// baseLabelValues returns the values of the standard labels of the four main
+// metrics.
+func (mc *MetricsCollection) baseLabelValues(statusCode, method, path string) []string {
+	if mc.disablePathLabel {
+		return []string{statusCode, method}
+	}
+	return []string{statusCode, method, path}
+}
+
+// maxCachedLabelSets bounds the label cache so that a path aggregator
+// returning raw URLs for matched routes cannot grow it without limit.
+const maxCachedLabelSets = 4096
+
+// labelKey identifies a cached set of label values.
+type labelKey struct {
+	statusCode string
+	method     string
+	path       string
+}
+
+// labelCache stores the label values of matched routes, whose label sets are
+// bounded by the registered routes, so that repeated requests do not
+// allocate a new slice each time.  The zero value is ready to use.
+type labelCache struct {
+	mu sync.RWMutex
+	m  map[labelKey][]string
+}
+
+// cachedLabelValues is like baseLabelValues but reuses the slice prepared
+// for an earlier request with the same values.  Past maxCachedLabelSets new
+// sets are built on every call.  The returned slice is shared and capped to
+// its length, so appending to it copies.
+func (mc *MetricsCollection) cachedLabelValues(statusCode, method, path string) []string {
+	key := labelKey{statusCode: statusCode, method: method, path: path}
+
+	mc.labelCache.mu.RLock()
+	lvs, ok := mc.labelCache.m[key]
+	mc.labelCache.mu.RUnlock()
+	if ok {
+		return lvs
+	}
+
+	lvs = mc.baseLabelValues(statusCode, method, path)
+	lvs = lvs[:len(lvs):len(lvs)]
+
+	mc.labelCache.mu.Lock()
+	if mc.labelCache.m == nil {
+		mc.labelCache.m = make(map[labelKey][]string)
+	}
+	if len(mc.labelCache.m) < maxCachedLabelSets {
+		mc.labelCache.m[key] = lvs
+	}
+	mc.labelCache.mu.Unlock()
+
+	return lvs
+}
@@ -0,0 +1,547 @@
+package ginprom
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ---------------------------------------------------------------------------
+// WithExtraLabels
+// ---------------------------------------------------------------------------
+
+func tenantLabel(c *gin.Context) []string {
+	return []string{c.GetHeader("X-Tenant")}
+}
+
+func TestWithExtraLabels_TenantHeader(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithExtraLabels([]string{"tenant"}, tenantLabel))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		req, _ := http.NewRequest("GET", "/items", nil)
+		req.Header.Set("X-Tenant", tenant)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be exported")
+	}
+	counts := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		counts[labelValue(m, "tenant")] = m.GetCounter().GetValue()
+	}
+	if counts["acme"] != 2 || counts["globex"] != 1 {
+		t.Errorf("unexpected per-tenant counts: %v", counts)
+	}
+
+	if mf := gatherFamily(t, reg, "http_request_duration_seconds"); mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected duration histogram to be split by tenant, got %v", mf)
+	}
+}
+
+func TestWithExtraLabels_WrongValueCount(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithExtraLabels([]string{"tenant", "api_version"}, tenantLabel))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/items", nil)
+	req.Header.Set("X-Tenant", "acme")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "tenant") != "" || labelValue(m, "api_version") != "" {
+		t.Errorf("expected empty extra labels on mismatch, got %v", m.GetLabel())
+	}
+}
+
+func TestWithExtraLabels_Invalid(t *testing.T) {
+	for name, opts := range map[string][]MetricsOption{
+		"nil extractor":   {WithExtraLabels([]string{"tenant"}, nil)},
+		"empty name":      {WithExtraLabels([]string{""}, tenantLabel)},
+		"invalid name":    {WithExtraLabels([]string{"x-tenant"}, tenantLabel)},
+		"reserved name":   {WithExtraLabels([]string{"__tenant"}, tenantLabel)},
+		"duplicate name":  {WithExtraLabels([]string{"tenant", "tenant"}, tenantLabel)},
+		"standard name":   {WithExtraLabels([]string{"method"}, tenantLabel)},
+		"declared before": {WithExtraLabels([]string{"tenant"}, tenantLabel), WithHeaderValueLabel("tenant", "X-Tenant", nil)},
+	} {
+		opts = append(opts, WithCustomRegistry(prometheus.NewRegistry()))
+		_, err := NewMetricsCollectionE(opts...)
+		if err == nil || !strings.Contains(err.Error(), "WithExtraLabels") {
+			t.Errorf("%s: expected an error naming WithExtraLabels, got %v", name, err)
+		}
+	}
+}
+
+func TestLabelNames_Default(t *testing.T) {
+	mc := &MetricsCollection{}
+	names := mc.labelNames()
+	if len(names) != 3 || names[0] != "status_code" || names[1] != "method" || names[2] != "path" {
+		t.Errorf("unexpected default label names: %v", names)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Label names
+// ---------------------------------------------------------------------------
+
+func TestLabelNameOptions(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithPathLabelName("route"),
+		WithMethodLabelName("verb"),
+		WithStatusLabelName("code"),
+	)
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordUnmatched(true)))
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/users/1")
+	performRequest(r, "GET", "/missing")
+
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds", "http_request_size_bytes", "http_response_size_bytes"} {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil {
+			t.Fatalf("%s: expected the metric to be recorded", name)
+		}
+		var found bool
+		for _, m := range mf.GetMetric() {
+			if labelValue(m, "route") == "/users/:id" && labelValue(m, "verb") == "GET" && labelValue(m, "code") == "200" {
+				found = true
+			}
+			if labelValue(m, "path") != "" || labelValue(m, "method") != "" {
+				t.Errorf("%s: expected the default label names to be gone, got %v", name, m.GetLabel())
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected renamed labels, got %v", name, mf.GetMetric())
+		}
+	}
+
+	mf := gatherFamily(t, reg, "http_unmatched_requests_total")
+	if mf == nil || labelValue(mf.GetMetric()[0], "verb") != "GET" {
+		t.Errorf("expected auxiliary metrics to use the renamed method label, got %v", mf)
+	}
+}
+
+func TestWithDisablePathLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithDisablePathLabel(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/users/1")
+	performRequest(r, "GET", "/items")
+
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds", "http_request_size_bytes", "http_response_size_bytes"} {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("%s: expected both routes in a single series, got %v", name, mf)
+		}
+		for _, l := range mf.GetMetric()[0].GetLabel() {
+			if l.GetName() == "path" {
+				t.Errorf("%s: expected no path label, got %v", name, mf.GetMetric()[0].GetLabel())
+			}
+		}
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if got := mf.GetMetric()[0].GetCounter().GetValue(); got != 2 {
+		t.Errorf("expected 2 requests, got %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithHeaderValueLabel
+// ---------------------------------------------------------------------------
+
+func TestWithHeaderValueLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithHeaderValueLabel("tenant", "X-Tenant", []string{"acme"}))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, tenant := range []string{"acme", "evil-corp", ""} {
+		req, _ := http.NewRequest("GET", "/items", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "tenant")] = true
+	}
+	for _, want := range []string{"acme", "other", ""} {
+		if !got[want] {
+			t.Errorf("expected tenant %q, got %v", want, got)
+		}
+	}
+	if got["evil-corp"] {
+		t.Error("expected a disallowed tenant to be recorded as other")
+	}
+}
+
+func TestWithProtocolLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithProtocolLabel(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/items")
+	req, _ := http.NewRequest("GET", "/items", nil)
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "http_version")] = true
+	}
+	if len(got) != 2 || !got["1.1"] || !got["2"] {
+		t.Errorf("expected http_version values 1.1 and 2, got %v", got)
+	}
+}
+
+func TestWithProtocolLabel_Disabled(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry(WithProtocolLabel(false))
+	if names := mc.labelNames(); len(names) != 3 {
+		t.Errorf("expected no extra label when disabled, got %v", names)
+	}
+}
+
+func TestWithRequestEncodingLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRequestEncodingLabel(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.POST("/upload", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, encoding := range []string{"gzip", "", "zstd"} {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("payload"))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "request_encoding")] = true
+	}
+	if len(got) != 3 || !got["gzip"] || !got["identity"] || !got["other"] {
+		t.Errorf("expected request_encoding values gzip, identity and other, got %v", got)
+	}
+}
+
+func TestWithResponseHeaderLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithResponseHeaderLabel("cache", "X-Cache", []string{"HIT", "MISS"}))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/cached", func(c *gin.Context) {
+		c.Header("X-Cache", c.Query("cache"))
+		c.Status(http.StatusOK)
+	})
+
+	for _, v := range []string{"HIT", "hit", "STALE", ""} {
+		performRequest(r, "GET", "/cached?cache="+v)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "cache")] = m.GetCounter().GetValue()
+	}
+	if len(got) != 3 || got["HIT"] != 2 || got["other"] != 1 || got[""] != 1 {
+		t.Errorf("expected 2 HIT, 1 other and 1 empty cache value, got %v", got)
+	}
+}
+
+func TestWithTLSLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithTLSLabel(true, "X-Forwarded-Proto"))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/direct", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/proxied", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/plain", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/direct", nil)
+	req.TLS = &tls.ConnectionState{}
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("GET", "/proxied", nil)
+	req.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("GET", "/plain", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] = labelValue(m, "tls")
+	}
+	want := map[string]string{"/direct": "true", "/proxied": "true", "/plain": "false"}
+	for path, tlsValue := range want {
+		if got[path] != tlsValue {
+			t.Errorf("%s: expected tls=%q, got %q", path, tlsValue, got[path])
+		}
+	}
+}
+
+func TestWithTLSLabel_HeaderNotTrusted(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithTLSLabel(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/items", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || labelValue(mf.GetMetric()[0], "tls") != "false" {
+		t.Errorf("expected the header to be ignored without proxy headers, got %v", mf)
+	}
+}
+
+func TestWithEmptyBodyLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithEmptyBodyLabel(true))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/cached", func(c *gin.Context) { c.Status(http.StatusNotModified) })
+	r.GET("/fresh", func(c *gin.Context) { c.String(http.StatusOK, "body") })
+	performRequest(r, "GET", "/cached")
+	performRequest(r, "GET", "/fresh")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "status_code")] = labelValue(m, "empty_body")
+	}
+	if got["304"] != "true" || got["200"] != "false" {
+		t.Errorf("expected empty_body true for the 304 and false for the 200, got %v", got)
+	}
+}
+
+func TestWithRouteGroupLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRouteGroupLabel(2))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/api/v1/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/admin", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/api/v1/users/42")
+	performRequest(r, "GET", "/admin")
+	performRequest(r, "GET", "/missing/route")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] = labelValue(m, "group")
+	}
+	if got["/api/v1/users/:id"] != "/api/v1" {
+		t.Errorf("expected group /api/v1, got %v", got)
+	}
+	if got["/admin"] != "/admin" {
+		t.Errorf("expected a short route to be its own group, got %v", got)
+	}
+	var ungrouped bool
+	for _, group := range got {
+		ungrouped = ungrouped || group == "ungrouped"
+	}
+	if !ungrouped {
+		t.Errorf("expected the unmatched request to be ungrouped, got %v", got)
+	}
+}
+
+func TestRouteGroup(t *testing.T) {
+	cases := []struct {
+		route string
+		depth int
+		want  string
+	}{
+		{"/api/v1/users/:id", 1, "/api"},
+		{"/api/v1/users/:id", 2, "/api/v1"},
+		{"/api/v1/users/:id", 9, "/api/v1/users/:id"},
+		{"/static/*filepath", 1, "/static"},
+		{"/", 1, "/"},
+	}
+	for _, tc := range cases {
+		if got := routeGroup(tc.route, tc.depth); got != tc.want {
+			t.Errorf("routeGroup(%q, %d) = %q, want %q", tc.route, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestWithRouteMetadata(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRouteMetadata(map[string]map[string]string{
+		"/checkout": {"team": "payments"},
+	}))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/checkout", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/checkout")
+	performRequest(r, "GET", "/users/1")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] = labelValue(m, "team")
+	}
+	if got["/checkout"] != "payments" {
+		t.Errorf("expected team=payments on /checkout, got %v", got)
+	}
+	if team, ok := got["/users/:id"]; !ok || team != "" {
+		t.Errorf("expected an empty team on a route without metadata, got %v", got)
+	}
+}
+
+func TestWithRouteMetadata_SortedNames(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry(WithRouteMetadata(map[string]map[string]string{
+		"/a": {"tier": "1"},
+		"/b": {"team": "x", "tier": "2"},
+	}))
+	names := mc.labelNames()
+	if len(names) != 5 || names[3] != "team" || names[4] != "tier" {
+		t.Errorf("expected the metadata label names in sorted order, got %v", names)
+	}
+}
+
+func TestWithContextLabels(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithContextLabels("feature_flag", "cohort"))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/checkout", func(c *gin.Context) {
+		WithLabels(c, prometheus.Labels{"feature_flag": "old_checkout"})
+		// Deeper code overrides the flag; undeclared labels are dropped
+		WithLabels(c, prometheus.Labels{"feature_flag": "new_checkout", "user_id": "42"})
+		c.Status(http.StatusOK)
+	})
+	r.GET("/plain", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/checkout")
+	performRequest(r, "GET", "/plain")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 2 {
+		t.Fatalf("expected two series, got %v", mf)
+	}
+	flags := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		flags[labelValue(m, "path")] = labelValue(m, "feature_flag")
+		if labelValue(m, "cohort") != "" {
+			t.Errorf("expected an empty cohort, got %q", labelValue(m, "cohort"))
+		}
+		if labelValue(m, "user_id") != "" {
+			t.Error("expected the undeclared user_id label to be ignored")
+		}
+	}
+	if flags["/checkout"] != "new_checkout" || flags["/plain"] != "" {
+		t.Errorf("unexpected feature_flag values %v", flags)
+	}
+}
+
+func TestWithRetryCountLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRetryCountLabel("X-Retry-Count"))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, count := range []string{"3", "1", "", "nope"} {
+		req, _ := http.NewRequest("GET", "/items", nil)
+		if count != "" {
+			req.Header.Set("X-Retry-Count", count)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "retry")] = m.GetCounter().GetValue()
+	}
+	want := map[string]float64{"2+": 1, "1": 1, "0": 2}
+	if len(got) != len(want) {
+		t.Fatalf("expected retry values %v, got %v", want, got)
+	}
+	for retry, n := range want {
+		if got[retry] != n {
+			t.Errorf("retry %q: expected %v requests, got %v", retry, n, got[retry])
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Label cache
+// ---------------------------------------------------------------------------
+
+func TestCachedLabelValues_Reused(t *testing.T) {
+	mc := &MetricsCollection{}
+	a := mc.cachedLabelValues("200", "GET", "/items")
+	b := mc.cachedLabelValues("200", "GET", "/items")
+	if len(a) != 3 || a[0] != "200" || a[1] != "GET" || a[2] != "/items" {
+		t.Fatalf("unexpected label values: %v", a)
+	}
+	if &a[0] != &b[0] {
+		t.Error("expected the same slice to be reused for identical label values")
+	}
+	if cap(a) != len(a) {
+		t.Errorf("expected the shared slice to be capped, got cap %d for len %d", cap(a), len(a))
+	}
+	if c := mc.cachedLabelValues("404", "GET", "/items"); c[0] != "404" {
+		t.Errorf("expected distinct values for a different status, got %v", c)
+	}
+}
+
+func TestCachedLabelValues_Bounded(t *testing.T) {
+	mc := &MetricsCollection{}
+	for i := 0; i < maxCachedLabelSets+10; i++ {
+		mc.cachedLabelValues("200", "GET", "/p/"+strconv.Itoa(i))
+	}
+	if n := len(mc.labelCache.m); n != maxCachedLabelSets {
+		t.Errorf("expected cache to stop at %d entries, got %d", maxCachedLabelSets, n)
+	}
+	if lvs := mc.cachedLabelValues("200", "GET", "/overflow"); lvs[2] != "/overflow" {
+		t.Errorf("expected correct values past the bound, got %v", lvs)
+	}
+}
@@ -1,15 +1,23 @@
 package ginprom
 
 import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"net/http"
+	"time"
 )
 
 // handlerConfig holds optional credentials for Basic Authentication on the
-// metrics endpoint.
+// metrics endpoint, along with the handler's self-instrumentation settings.
 type handlerConfig struct {
-	username string
-	password string
+	username           string
+	password           string
+	selfMetrics        bool
+	disableCompression bool
+	scrapesPerMinute   int
 }
 
 // HandlerOption is a functional option that configures the metrics HTTP
@@ -32,18 +40,195 @@ func WithBasicAuth(username, password string) HandlerOption {
 	}
 }
 
+// WithScrapeSelfMetrics instruments the metrics endpoint itself.  When
+// enabled, each scrape is timed into the ginprom_scrape_duration_seconds
+// histogram and every failed gather increments ginprom_scrape_errors_total.
+// Both collectors are registered with the default Prometheus registry, next
+// to the metrics they describe.
+func WithScrapeSelfMetrics(enabled bool) HandlerOption {
+	return func(c *handlerConfig) {
+		c.selfMetrics = enabled
+	}
+}
+
+// WithDisableCompression stops the metrics endpoint from gzip-compressing its
+// responses for clients that accept it, for example when a proxy in front of
+// it already compresses.  Compression is enabled by default and works through
+// [WithBasicAuth].
+func WithDisableCompression(disable bool) HandlerOption {
+	return func(c *handlerConfig) {
+		c.disableCompression = disable
+	}
+}
+
+// WithScrapeRateLimit limits each client, identified by its IP address, to
+// perMinute requests to the metrics endpoint per minute, to stop scrape
+// storms from a single source.  Tokens refill continuously and allow bursts
+// of up to perMinute requests; clients over the limit receive 429 Too Many
+// Requests with a Retry-After header.  The limit applies before
+// [WithBasicAuth], so it also slows down password guessing.  Requests are
+// unlimited by default, as is the case for a non-positive perMinute.
+func WithScrapeRateLimit(perMinute int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.scrapesPerMinute = perMinute
+	}
+}
+
 // GetMetricHandler returns an [http.Handler] that serves the default
 // Prometheus metrics page (equivalent to promhttp.Handler).  Pass
-// [WithBasicAuth] to require authentication before metrics are exposed.
+// [WithBasicAuth] to require authentication before metrics are exposed.  It
+// panics if the handler's own metrics cannot be registered with the default
+// registry; use [GetMetricHandlerE] to handle the error instead.
 func GetMetricHandler(opt ...HandlerOption) http.Handler {
+	handler, err := GetMetricHandlerE(opt...)
+	if err != nil {
+		panic(err)
+	}
+	return handler
+}
+
+// GetMetricHandlerE is like [GetMetricHandler] but returns an error instead
+// of panicking when the handler's own metrics cannot be registered, for
+// example because another collector already uses their names.
+func GetMetricHandlerE(opt ...HandlerOption) (http.Handler, error) {
 	conf := handlerConfig{}
 	for _, o := range opt {
 		o(&conf)
 	}
+	var (
+		handler http.Handler
+		err     error
+	)
+	if conf.selfMetrics {
+		handler, err = instrumentedMetricHandler(prometheus.DefaultRegisterer, prometheus.DefaultGatherer, conf.handlerOpts())
+	} else {
+		handler, err = instrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, conf.handlerOpts()))
+	}
+	if err != nil {
+		return nil, err
+	}
 	if (conf.username != "") && (conf.password != "") {
-		return withBasicAuth(promhttp.Handler(), conf.username, conf.password)
+		handler = withBasicAuth(handler, conf.username, conf.password)
+	}
+	if conf.scrapesPerMinute > 0 {
+		handler = withScrapeRateLimit(handler, newScrapeLimiter(conf.scrapesPerMinute))
+	}
+	return handler, nil
+}
+
+// GetMetricsAndHealthHandler returns an [http.ServeMux] serving the metrics
+// of [GetMetricHandler] on /metrics and a liveness probe on /healthz, which
+// always answers 200 OK.  The options apply to the metrics route only, so
+// [WithBasicAuth] leaves /healthz open to load balancers and orchestrators.
+// It suits minimal services that expose both on a dedicated port.
+//
+// Example:
+//
+//	go http.ListenAndServe(":9090", ginprom.GetMetricsAndHealthHandler(
+//	    ginprom.WithBasicAuth("prometheus", "s3cr3t"),
+//	))
+func GetMetricsAndHealthHandler(opt ...HandlerOption) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", GetMetricHandler(opt...))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// handlerOpts returns the promhttp options matching the configuration.
+func (c *handlerConfig) handlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{DisableCompression: c.disableCompression}
+}
+
+// instrumentMetricHandler is like promhttp.InstrumentMetricHandler, counting
+// the scrapes served by handler and those in flight, but returns an error
+// instead of panicking when its collectors cannot be registered with reg.
+func instrumentMetricHandler(reg prometheus.Registerer, handler http.Handler) (http.Handler, error) {
+	cnt := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promhttp_metric_handler_requests_total",
+			Help: "Total number of scrapes by HTTP status code.",
+		},
+		[]string{"code"},
+	)
+	// Initialize the most likely HTTP status codes
+	cnt.WithLabelValues("200")
+	cnt.WithLabelValues("500")
+	cnt.WithLabelValues("503")
+	requests, err := registerOrReuse(reg, cnt)
+	if err != nil {
+		return nil, err
+	}
+	inFlight, err := registerOrReuse(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promhttp_metric_handler_requests_in_flight",
+		Help: "Current number of scrapes being served.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return promhttp.InstrumentHandlerCounter(requests.(*prometheus.CounterVec),
+		promhttp.InstrumentHandlerInFlight(inFlight.(prometheus.Gauge), handler)), nil
+}
+
+// instrumentedMetricHandler behaves like promhttp.Handler for the given
+// registry but also records how long each scrape takes and how many gathers
+// failed.
+func instrumentedMetricHandler(reg prometheus.Registerer, gatherer prometheus.Gatherer, opts promhttp.HandlerOpts) (http.Handler, error) {
+	scrapeDuration, err := registerOrReuse(reg, prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ginprom_scrape_duration_seconds",
+			Help:    "Duration of metrics scrapes in seconds.",
+			Buckets: DefaultDurationBuckets,
+		},
+	))
+	if err != nil {
+		return nil, err
+	}
+	scrapeErrors, err := registerOrReuse(reg, prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ginprom_scrape_errors_total",
+			Help: "Number of metrics scrapes that failed to gather.",
+		},
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	counting := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			scrapeErrors.(prometheus.Counter).Inc()
+		}
+		return mfs, err
+	})
+	handler, err := instrumentMetricHandler(reg, promhttp.HandlerFor(counting, opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+		scrapeDuration.(prometheus.Histogram).Observe(time.Since(start).Seconds())
+	}), nil
+}
+
+// registerOrReuse registers c with reg and returns it.  If an equivalent
+// collector is already registered, that existing collector is returned
+// instead, so handlers can be built repeatedly against the same registry.
+func registerOrReuse(reg prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector, nil
+		}
+		return nil, fmt.Errorf("ginprom: registering metrics: %w", err)
 	}
-	return promhttp.Handler()
+	return c, nil
 }
 
 func withBasicAuth(handler http.Handler, username, password string) http.Handler {
@@ -14,23 +14,175 @@
 package ginprom
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/model"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // MetricsCollection groups the four Prometheus collectors used by the
 // middleware: a counter for total requests and three histograms for duration,
 // request size, and response size.  An optional custom registry may be set so
 // that metrics are not registered with the default global Prometheus registry.
+//
+// The other vectors are optional and stay nil until the option recording into
+// them is used, which then builds and registers them.
 type MetricsCollection struct {
 	TotalRequests *prometheus.CounterVec
-	ResponseSize  *prometheus.HistogramVec
-	RequestSize   *prometheus.HistogramVec
+	ResponseSize  *prometheus.HistogramVec // nil with WithResponseSizeSummary
+	RequestSize   *prometheus.HistogramVec // nil with WithRequestSizeSummary
 	Duration      *prometheus.HistogramVec
-	Registry      *prometheus.Registry // Optional custom registry
+
+	// UnmatchedRequests counts requests that matched no route, with
+	// WithRecordUnmatched
+	UnmatchedRequests *prometheus.CounterVec
+	// GinErrors counts the errors handlers attach to the Gin context, with
+	// WithRecordGinErrors
+	GinErrors *prometheus.CounterVec
+	// BindErrors counts requests that failed binding, with
+	// WithRecordBindErrors
+	BindErrors *prometheus.CounterVec
+
+	// ResponseCompressionRatio observes the uncompressed-to-compressed size
+	// ratio of gzip-encoded responses, with WithRecordCompressionRatio
+	ResponseCompressionRatio *prometheus.HistogramVec
+	// PathDepth observes the segments of matched route templates, with
+	// WithRecordPathDepth
+	PathDepth *prometheus.HistogramVec
+	// ResponseFlushes observes how often responses were flushed, with
+	// WithRecordFlushCount
+	ResponseFlushes *prometheus.HistogramVec
+	// ContentLengthMismatches counts responses whose Content-Length did not
+	// match the bytes written, with WithDetectContentLengthMismatch
+	ContentLengthMismatches *prometheus.CounterVec
+	// OversizeResponses counts responses above WithResponseSizeCap
+	OversizeResponses *prometheus.CounterVec
+	// ResponseWriteErrors counts responses whose body could not be written,
+	// with WithTrackWriteErrors
+	ResponseWriteErrors *prometheus.CounterVec
+
+	// InFlightRequests and RejectedRequests track the requests served and
+	// turned away by routes limited with WithConcurrencyLimit
+	InFlightRequests *prometheus.GaugeVec
+	RejectedRequests *prometheus.CounterVec
+
+	// QueueTime observes the wait reported by the load balancer, with
+	// WithQueueTimeHeader
+	QueueTime *prometheus.HistogramVec
+
+	// MetricErrors counts failed metric updates, by metric
+	MetricErrors *prometheus.CounterVec
+
+	// RouteMethods is set to 1 for every method of every route, by
+	// RegisterRouteInfo
+	RouteMethods *prometheus.GaugeVec
+
+	// AbortedRequests counts requests aborted by a handler, with
+	// WithRecordAborts
+	AbortedRequests *prometheus.CounterVec
+
+	// CPUTime observes the CPU time of the handler chain, with
+	// WithRecordCPUTime
+	CPUTime *prometheus.HistogramVec
+
+	// DuplicateRequests counts requests repeating an idempotency key, with
+	// WithDuplicateDetection
+	DuplicateRequests *prometheus.CounterVec
+
+	// MiddlewareOverhead observes the time spent recording each request, with
+	// WithSelfInstrumentation
+	MiddlewareOverhead *prometheus.HistogramVec
+
+	// Outbound requests, built by InstrumentRoundTripper
+	ClientRequests     *prometheus.CounterVec
+	ClientDuration     *prometheus.HistogramVec
+	ClientRequestSize  *prometheus.HistogramVec
+	ClientResponseSize *prometheus.HistogramVec
+
+	// Connection phases of outbound requests, with WithClientTraceTiming
+	ClientDNSDuration     *prometheus.HistogramVec
+	ClientConnectDuration *prometheus.HistogramVec
+	ClientTLSDuration     *prometheus.HistogramVec
+
+	// Size summaries, with WithRequestSizeSummary and WithResponseSizeSummary
+	RequestSizeSummary  *prometheus.SummaryVec
+	ResponseSizeSummary *prometheus.SummaryVec
+
+	// ResponseTimePercentiles exports sliding-window quantiles, with
+	// WithRecordSlidingPercentiles
+	ResponseTimePercentiles *prometheus.GaugeVec
+
+	// SLO counters, with WithSLO
+	SLOGoodRequests  *prometheus.CounterVec
+	SLOTotalRequests *prometheus.CounterVec
+
+	Registry *prometheus.Registry // Optional custom registry
+
+	// additionalRegistries also get every collector registered
+	additionalRegistries []prometheus.Registerer
+
+	// Settings recorded by MetricsOption values and used by
+	// NewMetricsCollection to build the default collectors.
+	prefix           string
+	strictPrefix     bool
+	durationBuckets  []float64
+	sizeBuckets      []float64
+	extraLabels      []labelExtractor
+	statusLabel      string
+	methodLabel      string
+	pathLabel        string
+	disablePathLabel bool
+	help             metricHelp
+
+	labelCache labelCache
+
+	// Histogram options used verbatim instead of the defaults
+	durationOpts     *prometheus.HistogramOpts
+	requestSizeOpts  *prometheus.HistogramOpts
+	responseSizeOpts *prometheus.HistogramOpts
+
+	requestSizeSummary  *summarySettings
+	responseSizeSummary *summarySettings
+
+	slidingWindow    time.Duration
+	slidingQuantiles []float64
+	sliding          *slidingPercentiles
+
+	runtimeMetrics bool
+
+	sloLatency time.Duration
+
+	splitDurationByOutcome bool
+	outcomeErrorThreshold  int
+
+	cardinalityAudit bool
+	auditor          *cardinalityCollector
+
+	// aliases maps metric names to the names they are also exported under
+	aliases map[string]string
+	aliaser *aliasCollector
+
+	// err is the first invalid setting reported by an option
+	err error
+
+	// optionalMu serialises building the optional vectors, see enableVec
+	optionalMu sync.Mutex
+
+	// closers stop what was started for the collection, see Close
+	closeMu sync.Mutex
+	closers []func(ctx context.Context) error
+	closed  bool
 }
 
 // Default histogram bucket sets used when no custom buckets are provided.
@@ -40,9 +192,26 @@ type MetricsCollection struct {
 //
 // DefaultSizeBuckets covers payload sizes from 100 bytes up to ~51 KB in 10
 // exponential steps (base 2, start 100 bytes).
+//
+// DefaultCompressionRatioBuckets covers compression ratios from 1 (no
+// savings) up to ~38 in 10 exponential steps (base 1.5).
+//
+// DefaultPathDepthBuckets has one bucket per depth from 1 to 10; deeper
+// routes land in the +Inf bucket.
+//
+// DefaultFlushBuckets covers flushes per response from 1 up to 512 in 10
+// exponential steps (base 2); responses never flushed land in the first
+// bucket.
+//
+// DefaultOverheadBuckets covers the middleware's own recording time from 1 µs
+// up to ~16 ms in 15 exponential steps (base 2).
 var (
-	DefaultDurationBuckets = prometheus.ExponentialBuckets(0.001, 2, 15)
-	DefaultSizeBuckets     = prometheus.ExponentialBuckets(100, 2, 10)
+	DefaultDurationBuckets         = prometheus.ExponentialBuckets(0.001, 2, 15)
+	DefaultSizeBuckets             = prometheus.ExponentialBuckets(100, 2, 10)
+	DefaultCompressionRatioBuckets = prometheus.ExponentialBuckets(1, 1.5, 10)
+	DefaultPathDepthBuckets        = prometheus.LinearBuckets(1, 1, 10)
+	DefaultFlushBuckets            = prometheus.ExponentialBuckets(1, 2, 10)
+	DefaultOverheadBuckets         = prometheus.ExponentialBuckets(0.000001, 2, 15)
 )
 
 var statusAddr = [1000]string{}
@@ -53,54 +222,16 @@ func init() {
 	}
 }
 
-// defaultMetricsCollection creates and returns a new MetricsCollection with default settings
+// defaultMetricsCollection creates and returns a new MetricsCollection with
+// default settings, registered with the default prometheus registry.
 func defaultMetricsCollection() *MetricsCollection {
-	mc := &MetricsCollection{
-		TotalRequests: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "http_requests_total",
-				Help: "Number of requests.",
-			},
-			[]string{"status_code", "method", "path"},
-		),
-		ResponseSize: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_response_size_bytes",
-				Help:    "Size of HTTP response in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		),
-		RequestSize: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_size_bytes",
-				Help:    "Size of HTTP request in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		),
-		Duration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_duration_seconds",
-				Help:    "Duration of HTTP requests in seconds.",
-				Buckets: DefaultDurationBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		),
-	}
-
-	// Use default prometheus registry
-	prometheus.MustRegister(mc.TotalRequests)
-	prometheus.MustRegister(mc.ResponseSize)
-	prometheus.MustRegister(mc.RequestSize)
-	prometheus.MustRegister(mc.Duration)
-
-	return mc
+	return NewMetricsCollection()
 }
 
-// NewMetricsCollection creates a [MetricsCollection] and registers all four
+// NewMetricsCollection creates a [MetricsCollection] and registers all its
 // collectors with Prometheus.  Pass [MetricsOption] functions to customise
-// metric names, buckets, or the target registry.
+// metric names, buckets, or the target registry.  It panics if registration
+// fails; use [NewMetricsCollectionE] to handle the error instead.
 //
 // Example – use a custom registry and a metric name prefix:
 //
@@ -110,71 +241,337 @@ func defaultMetricsCollection() *MetricsCollection {
 //	    ginprom.WithMetricPrefix("myservice"),
 //	)
 func NewMetricsCollection(opts ...MetricsOption) *MetricsCollection {
+	mc, err := NewMetricsCollectionE(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return mc
+}
+
+// NewMetricsCollectionE is like [NewMetricsCollection] but returns an error
+// instead of panicking when the collectors cannot be registered, for example
+// because metrics with the same names already exist in the registry.  On
+// error nothing is left registered.
+func NewMetricsCollectionE(opts ...MetricsOption) (*MetricsCollection, error) {
 	mc := &MetricsCollection{
-		// Create with nil values that will be set by options
+		durationBuckets:       DefaultDurationBuckets,
+		sizeBuckets:           DefaultSizeBuckets,
+		outcomeErrorThreshold: http.StatusInternalServerError,
+		help: metricHelp{
+			requests:     "Number of requests.",
+			duration:     "Duration of HTTP requests in seconds.",
+			requestSize:  "Size of HTTP request in bytes.",
+			responseSize: "Size of HTTP response in bytes.",
+		},
 	}
 
 	// Apply all options
 	for _, opt := range opts {
 		opt(mc)
 	}
+	if mc.err != nil {
+		return nil, mc.err
+	}
+	if !mc.strictPrefix {
+		mc.prefix = sanitizePrefix(mc.prefix)
+	}
+	if err := mc.validatePrefix(); err != nil {
+		return nil, err
+	}
+
+	labels := mc.labelNames()
+	if err := mc.validateCustomLabels(labels); err != nil {
+		return nil, err
+	}
+
+	if err := mc.buildSizeSummaries(labels); err != nil {
+		return nil, err
+	}
 
 	// If any metrics are still nil after options, create them with defaults
 	if mc.TotalRequests == nil {
 		mc.TotalRequests = prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "http_requests_total",
-				Help: "Number of requests.",
+				Name: mc.metricName("http_requests_total"),
+				Help: mc.help.requests,
 			},
-			[]string{"status_code", "method", "path"},
+			labels,
 		)
 	}
 
-	if mc.ResponseSize == nil {
+	if mc.ResponseSize == nil && mc.ResponseSizeSummary == nil {
 		mc.ResponseSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_response_size_bytes",
-				Help:    "Size of HTTP response in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
+			histogramOpts(mc.responseSizeOpts, prometheus.HistogramOpts{
+				Name:    mc.metricName("http_response_size_bytes"),
+				Help:    mc.help.responseSize,
+				Buckets: mc.sizeBuckets,
+			}),
+			labels,
 		)
 	}
 
-	if mc.RequestSize == nil {
+	if mc.RequestSize == nil && mc.RequestSizeSummary == nil {
 		mc.RequestSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_size_bytes",
-				Help:    "Size of HTTP request in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
+			histogramOpts(mc.requestSizeOpts, prometheus.HistogramOpts{
+				Name:    mc.metricName("http_request_size_bytes"),
+				Help:    mc.help.requestSize,
+				Buckets: mc.sizeBuckets,
+			}),
+			labels,
 		)
 	}
 
 	if mc.Duration == nil {
+		durationLabels := labels
+		if mc.splitDurationByOutcome {
+			durationLabels = append(labels[:len(labels):len(labels)], "outcome")
+		}
 		mc.Duration = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_duration_seconds",
-				Help:    "Duration of HTTP requests in seconds.",
-				Buckets: DefaultDurationBuckets,
+			histogramOpts(mc.durationOpts, prometheus.HistogramOpts{
+				Name:    mc.metricName("http_request_duration_seconds"),
+				Help:    mc.help.duration,
+				Buckets: mc.durationBuckets,
+			}),
+			durationLabels,
+		)
+	}
+
+	if mc.MetricErrors == nil {
+		mc.MetricErrors = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: mc.metricName("ginprom_metric_errors_total"),
+				Help: "Number of metric updates that failed and were dropped.",
+			},
+			[]string{"metric"},
+		)
+	}
+
+	if mc.slidingWindow > 0 {
+		mc.ResponseTimePercentiles = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: mc.metricName("http_request_duration_window_seconds"),
+				Help: "Quantiles of the request duration over a sliding window, in seconds.",
+			},
+			[]string{mc.pathLabelName(), "quantile"},
+		)
+		mc.sliding = newSlidingPercentiles(mc.ResponseTimePercentiles, mc.slidingWindow, mc.slidingQuantiles)
+	}
+
+	if mc.sloLatency > 0 {
+		mc.SLOGoodRequests = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: mc.metricName("ginprom_slo_good_total"),
+				Help: "Number of requests served within the latency objective without a 5xx status.",
 			},
-			[]string{"status_code", "method", "path"},
+			[]string{mc.methodLabelName(), mc.pathLabelName()},
+		)
+		mc.SLOTotalRequests = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: mc.metricName("ginprom_slo_total"),
+				Help: "Number of requests counted against the latency objective.",
+			},
+			[]string{mc.methodLabelName(), mc.pathLabelName()},
 		)
 	}
 
-	// Register with the appropriate registry
-	registry := prometheus.DefaultRegisterer
+	if mc.cardinalityAudit {
+		auditor, err := newCardinalityCollector(mc.metricName("ginprom_series_count"), mc.collectors())
+		if err != nil {
+			return nil, err
+		}
+		mc.auditor = auditor
+	}
+
+	if len(mc.aliases) > 0 {
+		aliaser, err := newAliasCollector(mc.aliases, mc.collectors())
+		if err != nil {
+			return nil, err
+		}
+		mc.aliaser = aliaser
+	}
+
+	registries := mc.registries()
+	registered := make([][]prometheus.Collector, 0, len(registries))
+	for i, reg := range registries {
+		cs, err := mc.register(reg)
+		if err != nil {
+			for j, done := range registries[:i] {
+				for _, c := range registered[j] {
+					done.Unregister(c)
+				}
+			}
+			return nil, err
+		}
+		registered = append(registered, cs)
+	}
+
+	return mc, nil
+}
+
+// registries returns the registries the collectors of mc are registered
+// with: the custom or default registry, then the additional ones.
+func (mc *MetricsCollection) registries() []prometheus.Registerer {
+	var registry prometheus.Registerer = prometheus.DefaultRegisterer
 	if mc.Registry != nil {
 		registry = mc.Registry
 	}
+	return append([]prometheus.Registerer{registry}, mc.additionalRegistries...)
+}
 
-	registry.MustRegister(mc.TotalRequests)
-	registry.MustRegister(mc.ResponseSize)
-	registry.MustRegister(mc.RequestSize)
-	registry.MustRegister(mc.Duration)
+// register registers the collectors of mc, and the runtime collectors when
+// enabled, with registry.  It returns the collectors it registered, which
+// leaves out runtime collectors the registry already had, so that they can be
+// unregistered again.
+func (mc *MetricsCollection) register(registry prometheus.Registerer) ([]prometheus.Collector, error) {
+	if err := registerAll(registry, mc.collectors()); err != nil {
+		return nil, err
+	}
+	registered := mc.collectors()
 
-	return mc
+	if mc.runtimeMetrics {
+		runtime, err := registerRuntimeCollectors(registry)
+		if err != nil {
+			for _, c := range registered {
+				registry.Unregister(c)
+			}
+			return nil, err
+		}
+		registered = append(registered, runtime...)
+	}
+	return registered, nil
+}
+
+// collectors returns the collectors built with the collection, in
+// registration order.  Optional vectors are registered on their own by
+// enableVec.
+func (mc *MetricsCollection) collectors() []prometheus.Collector {
+	var responseSize, requestSize prometheus.Collector = mc.ResponseSize, mc.RequestSize
+	if mc.ResponseSizeSummary != nil {
+		responseSize = mc.ResponseSizeSummary
+	}
+	if mc.RequestSizeSummary != nil {
+		requestSize = mc.RequestSizeSummary
+	}
+	collectors := []prometheus.Collector{
+		mc.TotalRequests,
+		responseSize,
+		requestSize,
+		mc.Duration,
+		mc.MetricErrors,
+	}
+	if mc.sliding != nil {
+		collectors = append(collectors, mc.sliding)
+	}
+	if mc.SLOGoodRequests != nil {
+		collectors = append(collectors, mc.SLOGoodRequests, mc.SLOTotalRequests)
+	}
+	if mc.auditor != nil {
+		collectors = append(collectors, mc.auditor)
+	}
+	if mc.aliaser != nil {
+		collectors = append(collectors, mc.aliaser)
+	}
+	return collectors
+}
+
+// Close stops the background work started for the collection, such as remote
+// writers started with [StartRemoteWriter], flushing their pending samples
+// first.  ctx bounds the time spent flushing.  The collectors stay registered
+// and keep recording.  Close is safe to call more than once; later calls do
+// nothing and return nil.
+func (mc *MetricsCollection) Close(ctx context.Context) error {
+	mc.closeMu.Lock()
+	if mc.closed {
+		mc.closeMu.Unlock()
+		return nil
+	}
+	mc.closed = true
+	closers := mc.closers
+	mc.closers = nil
+	mc.closeMu.Unlock()
+
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// onClose registers f to be called by Close.  It returns false, without
+// registering f, when the collection is already closed.
+func (mc *MetricsCollection) onClose(f func(ctx context.Context) error) bool {
+	mc.closeMu.Lock()
+	defer mc.closeMu.Unlock()
+	if mc.closed {
+		return false
+	}
+	mc.closers = append(mc.closers, f)
+	return true
+}
+
+// registerAll registers collectors with registry.  If any registration fails
+// the collectors registered so far are unregistered again and the error is
+// returned.
+func registerAll(registry prometheus.Registerer, collectors []prometheus.Collector) error {
+	for i, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			for _, registered := range collectors[:i] {
+				registry.Unregister(registered)
+			}
+			return fmt.Errorf("ginprom: registering metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// validatePrefix checks that the configured prefix produces valid metric
+// names.  Names are checked against the classic Prometheus rules
+// ([a-zA-Z_:][a-zA-Z0-9_:]*), which many tools still require.  All default
+// base names are valid, so checking one name built from the prefix is
+// enough.
+func (mc *MetricsCollection) validatePrefix() error {
+	if mc.prefix == "" {
+		return nil
+	}
+	if name := mc.metricName("http_requests_total"); !model.LegacyValidation.IsValidMetricName(name) {
+		return fmt.Errorf("ginprom: metric name %q is invalid, check the prefix %q passed to WithMetricPrefix", name, mc.prefix)
+	}
+	return nil
+}
+
+// sanitizePrefix turns an invalid prefix into a valid one: it is lowercased,
+// every character outside [a-z0-9_:] becomes an underscore, and a leading
+// digit gets an underscore in front, so "My-App" becomes "my_app".  Valid
+// prefixes are returned unchanged.
+func sanitizePrefix(prefix string) string {
+	if prefix == "" || model.LegacyValidation.IsValidMetricName(prefix) {
+		return prefix
+	}
+	var b strings.Builder
+	for i, r := range strings.ToLower(prefix) {
+		switch {
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		case r >= 'a' && r <= 'z', r == '_', r == ':':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// metricName returns base with the configured prefix, if any, prepended.
+func (mc *MetricsCollection) metricName(base string) string {
+	if mc.prefix == "" {
+		return base
+	}
+	return mc.prefix + "_" + base
 }
 
 // MetricsOption is a functional option that configures a [MetricsCollection].
@@ -191,9 +588,37 @@ func WithCustomRegistry(registry *prometheus.Registry) MetricsOption {
 	}
 }
 
+// WithDefaultRegistry explicitly registers the collectors with the default
+// Prometheus registry (prometheus.DefaultRegisterer and DefaultGatherer),
+// undoing an earlier [WithCustomRegistry].  This is also the behaviour when
+// neither option is given.
+func WithDefaultRegistry() MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.Registry = nil
+	}
+}
+
+// WithAdditionalRegistry also registers every collector with registry, on
+// top of the custom or default registry.  The collectors are shared, not
+// copied, so each observation is visible in all registries at no extra
+// recording cost; this is useful e.g. to expose the same metrics on the
+// process-wide endpoint and on a per-tenant one.  The option may be given
+// more than once.
+func WithAdditionalRegistry(registry prometheus.Registerer) MetricsOption {
+	return func(mc *MetricsCollection) {
+		if registry == nil {
+			mc.setErr(errors.New("ginprom: additional registry must not be nil"))
+			return
+		}
+		mc.additionalRegistries = append(mc.additionalRegistries, registry)
+	}
+}
+
 // WithCustomRequestCounter replaces the default request-count counter with the
-// provided one.  The counter must use the same label set as the middleware
-// (status_code, method, path).
+// provided one.  The counter must declare the labels of the middleware in
+// the same order (status_code, method, path, then any extra labels), as
+// values are passed by position; [NewMetricsCollectionE] returns an error
+// otherwise.
 func WithCustomRequestCounter(counter *prometheus.CounterVec) MetricsOption {
 	return func(mc *MetricsCollection) {
 		mc.TotalRequests = counter
@@ -201,8 +626,8 @@ func WithCustomRequestCounter(counter *prometheus.CounterVec) MetricsOption {
 }
 
 // WithCustomResponseSizeHistogram replaces the default response-size histogram
-// with the provided one.  The histogram must carry the same labels as the
-// middleware (status_code, method, path).
+// with the provided one.  The histogram must declare the labels of the
+// middleware in the same order, as for [WithCustomRequestCounter].
 func WithCustomResponseSizeHistogram(histogram *prometheus.HistogramVec) MetricsOption {
 	return func(mc *MetricsCollection) {
 		mc.ResponseSize = histogram
@@ -210,8 +635,8 @@ func WithCustomResponseSizeHistogram(histogram *prometheus.HistogramVec) Metrics
 }
 
 // WithCustomRequestSizeHistogram replaces the default request-size histogram
-// with the provided one.  The histogram must carry the same labels as the
-// middleware (status_code, method, path).
+// with the provided one.  The histogram must declare the labels of the
+// middleware in the same order, as for [WithCustomRequestCounter].
 func WithCustomRequestSizeHistogram(histogram *prometheus.HistogramVec) MetricsOption {
 	return func(mc *MetricsCollection) {
 		mc.RequestSize = histogram
@@ -219,120 +644,500 @@ func WithCustomRequestSizeHistogram(histogram *prometheus.HistogramVec) MetricsO
 }
 
 // WithCustomDurationHistogram replaces the default request-duration histogram
-// with the provided one.  The histogram must carry the same labels as the
-// middleware (status_code, method, path).
+// with the provided one.  The histogram must declare the labels of the
+// middleware in the same order, as for [WithCustomRequestCounter].
 func WithCustomDurationHistogram(histogram *prometheus.HistogramVec) MetricsOption {
 	return func(mc *MetricsCollection) {
 		mc.Duration = histogram
 	}
 }
 
-// WithMetricPrefix prepends prefix to all four default metric names.  For
+// validateCustomLabels checks that the vectors supplied with the
+// WithCustom... options declare labels, the label names of the collection,
+// in order, so that label values passed by position land on the right
+// label.  The duration histogram also carries the outcome label when
+// [WithSplitDurationByOutcome] is enabled.
+func (mc *MetricsCollection) validateCustomLabels(labels []string) error {
+	type custom struct {
+		option string
+		vec    *prometheus.MetricVec
+		want   []string
+	}
+	var vecs []custom
+	if mc.TotalRequests != nil {
+		vecs = append(vecs, custom{"WithCustomRequestCounter", mc.TotalRequests.MetricVec, labels})
+	}
+	if mc.ResponseSize != nil {
+		vecs = append(vecs, custom{"WithCustomResponseSizeHistogram", mc.ResponseSize.MetricVec, labels})
+	}
+	if mc.RequestSize != nil {
+		vecs = append(vecs, custom{"WithCustomRequestSizeHistogram", mc.RequestSize.MetricVec, labels})
+	}
+	if mc.Duration != nil {
+		want := labels
+		if mc.splitDurationByOutcome {
+			want = append(labels[:len(labels):len(labels)], "outcome")
+		}
+		vecs = append(vecs, custom{"WithCustomDurationHistogram", mc.Duration.MetricVec, want})
+	}
+
+	for _, v := range vecs {
+		if !declaresLabels(v.vec, v.want) {
+			return fmt.Errorf("ginprom: %s: collector does not declare the labels %q in this order", v.option, v.want)
+		}
+	}
+	return nil
+}
+
+// declaresLabels reports whether vec declares exactly the labels want, in
+// this order.  It looks up a probe child both by position and by name and
+// checks that both lookups return the same child, which holds for
+// constrained labels too and does not depend on how the client library
+// formats descriptors.  The probe child is deleted again.
+func declaresLabels(vec *prometheus.MetricVec, want []string) bool {
+	values := make([]string, len(want))
+	labels := make(prometheus.Labels, len(want))
+	for i, name := range want {
+		values[i] = "ginprom_probe_" + strconv.Itoa(i)
+		labels[name] = values[i]
+	}
+
+	byPosition, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		return false
+	}
+	defer vec.DeleteLabelValues(values...)
+	byName, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return false
+	}
+	defer vec.Delete(labels)
+	return byName == byPosition
+}
+
+// WithDurationHistogramOpts builds the request-duration histogram from opts,
+// used verbatim, instead of the default settings, giving access to every
+// field such as native histogram settings or const labels.  The middleware
+// only adds its label names, so opts.Name is not prefixed and the bucket and
+// help options do not apply.
+//
+// Example – a native histogram next to the classic buckets:
+//
+//	ginprom.WithDurationHistogramOpts(prometheus.HistogramOpts{
+//	    Name:                        "http_request_duration_seconds",
+//	    Help:                        "Request latency.",
+//	    Buckets:                     ginprom.DefaultDurationBuckets,
+//	    NativeHistogramBucketFactor: 1.1,
+//	})
+func WithDurationHistogramOpts(opts prometheus.HistogramOpts) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.durationOpts = &opts
+	}
+}
+
+// WithRequestSizeHistogramOpts is like [WithDurationHistogramOpts] for the
+// request-size histogram.  It cannot be combined with
+// [WithRequestSizeSummary].
+func WithRequestSizeHistogramOpts(opts prometheus.HistogramOpts) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.requestSizeOpts = &opts
+	}
+}
+
+// WithResponseSizeHistogramOpts is like [WithDurationHistogramOpts] for the
+// response-size histogram.  It cannot be combined with
+// [WithResponseSizeSummary].
+func WithResponseSizeHistogramOpts(opts prometheus.HistogramOpts) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.responseSizeOpts = &opts
+	}
+}
+
+// histogramOpts returns custom when set, def otherwise.
+func histogramOpts(custom *prometheus.HistogramOpts, def prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if custom != nil {
+		return *custom
+	}
+	return def
+}
+
+// WithMetricPrefix prepends prefix to all default metric names.  For
 // example, passing "myapp" will produce metrics named
 // "myapp_http_requests_total", "myapp_http_request_duration_seconds", etc.
-// This option recreates the four collectors, so it must appear before any
-// individual collector option that should apply to the prefixed names.
+// Collectors supplied through the WithCustom* options keep their own names.
+//
+// A prefix that would make invalid metric names, such as "my-app" or
+// "My App", is lowercased and its invalid characters replaced with
+// underscores, giving "my_app"; valid prefixes are used as given.  Use
+// [WithMetricPrefixStrict] to get an error instead.
 func WithMetricPrefix(prefix string) MetricsOption {
 	return func(mc *MetricsCollection) {
-		mc.TotalRequests = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: prefix + "_http_requests_total",
-				Help: "Number of requests.",
-			},
-			[]string{"status_code", "method", "path"},
-		)
-
-		mc.ResponseSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    prefix + "_http_response_size_bytes",
-				Help:    "Size of HTTP response in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
-
-		mc.RequestSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    prefix + "_http_request_size_bytes",
-				Help:    "Size of HTTP request in bytes.",
-				Buckets: DefaultSizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
+		mc.prefix = prefix
+	}
+}
 
-		mc.Duration = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    prefix + "_http_request_duration_seconds",
-				Help:    "Duration of HTTP requests in seconds.",
-				Buckets: DefaultDurationBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
+// WithMetricPrefixStrict makes [NewMetricsCollectionE] fail, and
+// [NewMetricsCollection] panic, when the prefix passed to [WithMetricPrefix]
+// would make invalid metric names, instead of sanitizing it.
+func WithMetricPrefixStrict(strict bool) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.strictPrefix = strict
 	}
 }
 
 // WithCustomBuckets replaces the bucket definitions for all three histogram
 // collectors.  durationBuckets configures the request-duration histogram;
 // sizeBuckets configures both the request-size and response-size histograms.
+// Both must be strictly increasing and free of NaN, otherwise
+// [NewMetricsCollectionE] returns an error naming the offending bucket
+// instead of the client library panicking at registration.
 func WithCustomBuckets(durationBuckets, sizeBuckets []float64) MetricsOption {
 	return func(mc *MetricsCollection) {
-		mc.ResponseSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_response_size_bytes",
-				Help:    "Size of HTTP response in bytes.",
-				Buckets: sizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
+		if err := validateBuckets(durationBuckets); err != nil {
+			mc.setErr(fmt.Errorf("ginprom: WithCustomBuckets: duration buckets: %w", err))
+			return
+		}
+		if err := validateBuckets(sizeBuckets); err != nil {
+			mc.setErr(fmt.Errorf("ginprom: WithCustomBuckets: size buckets: %w", err))
+			return
+		}
+		mc.durationBuckets = durationBuckets
+		mc.sizeBuckets = sizeBuckets
+	}
+}
 
-		mc.RequestSize = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_size_bytes",
-				Help:    "Size of HTTP request in bytes.",
-				Buckets: sizeBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
+// WithLinearDurationBuckets sets the request-duration buckets to count
+// linearly spaced boundaries, the first at start and each following one width
+// seconds higher (see [prometheus.LinearBuckets]).  count must be at least 1
+// and width positive, otherwise [NewMetricsCollectionE] returns an error.
+// Bucket options are applied in order, so the last of this option,
+// [WithCustomBuckets], [WithDurationBucketsString] and [WithSLOBuckets] to
+// touch the duration buckets wins.
+func WithLinearDurationBuckets(start, width float64, count int) MetricsOption {
+	return func(mc *MetricsCollection) {
+		switch {
+		case count < 1:
+			mc.setErr(fmt.Errorf("ginprom: WithLinearDurationBuckets: count %d is less than 1", count))
+		case !(width > 0) || math.IsNaN(start) || math.IsInf(start, 0) || math.IsInf(width, 0):
+			mc.setErr(fmt.Errorf("ginprom: WithLinearDurationBuckets: invalid start %v or width %v", start, width))
+		default:
+			mc.durationBuckets = prometheus.LinearBuckets(start, width, count)
+		}
+	}
+}
 
-		mc.Duration = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "http_request_duration_seconds",
-				Help:    "Duration of HTTP requests in seconds.",
-				Buckets: durationBuckets,
-			},
-			[]string{"status_code", "method", "path"},
-		)
+// WithExponentialSizeBuckets sets the request-size and response-size buckets
+// to count exponentially spaced boundaries, the first at start bytes and each
+// following one factor times the previous (see
+// [prometheus.ExponentialBuckets]).  count must be at least 1, start
+// positive and factor greater than 1, otherwise [NewMetricsCollectionE]
+// returns an error.  As with the other bucket options, the last one applied
+// to the size buckets wins.
+func WithExponentialSizeBuckets(start, factor float64, count int) MetricsOption {
+	return func(mc *MetricsCollection) {
+		switch {
+		case count < 1:
+			mc.setErr(fmt.Errorf("ginprom: WithExponentialSizeBuckets: count %d is less than 1", count))
+		case !(start > 0) || math.IsInf(start, 0):
+			mc.setErr(fmt.Errorf("ginprom: WithExponentialSizeBuckets: start %v is not positive", start))
+		case !(factor > 1) || math.IsInf(factor, 0):
+			mc.setErr(fmt.Errorf("ginprom: WithExponentialSizeBuckets: factor %v is not greater than 1", factor))
+		default:
+			mc.sizeBuckets = prometheus.ExponentialBuckets(start, factor, count)
+		}
 	}
 }
 
-// Global default metrics collection for backward compatibility
-var defaultMetrics *MetricsCollection
+// WithLargeResponseBuckets sets the request-size and response-size buckets
+// for services sending files or other large payloads: 11 exponential buckets
+// from 1 KiB to 1 GiB (factor 4).  As with the other bucket options, the last
+// one applied to the size buckets wins.
+func WithLargeResponseBuckets() MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 11)
+	}
+}
 
-// init initializes the default metrics collection for backward compatibility
-func init() {
-	defaultMetrics = defaultMetricsCollection()
+// WithSmallResponseBuckets sets the request-size and response-size buckets
+// for APIs exchanging small JSON documents: 10 exponential buckets from 64
+// bytes to 32 KiB (factor 2).
+func WithSmallResponseBuckets() MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.sizeBuckets = prometheus.ExponentialBuckets(64, 2, 10)
+	}
+}
+
+// WithDurationBucketsString sets the request-duration buckets from a
+// comma-separated list of boundaries in seconds, such as
+// "0.005,0.01,0.025,0.05", so that they can be taken from the environment or
+// a configuration file.  Spaces around the values are ignored.  The list must
+// be non-empty and strictly increasing, otherwise [NewMetricsCollectionE]
+// returns an error.  As with the other bucket options, the last one applied
+// wins.
+//
+// Example:
+//
+//	ginprom.WithDurationBucketsString(os.Getenv("DURATION_BUCKETS"))
+func WithDurationBucketsString(s string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		buckets, err := parseBuckets(s)
+		if err != nil {
+			mc.setErr(fmt.Errorf("ginprom: WithDurationBucketsString: %w", err))
+			return
+		}
+		mc.durationBuckets = buckets
+	}
 }
 
-// getPathWithFallback returns the most appropriate path representation for a request
-// using a cascade of fallback options to handle various routing scenarios
-func getPathWithFallback(c *gin.Context) string {
-	// Start with FullPath which returns the registered route pattern (like "/user/:id")
-	path := c.FullPath()
+// WithSizeBucketsString is like [WithDurationBucketsString] for the
+// request-size and response-size buckets, given in bytes.
+func WithSizeBucketsString(s string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		buckets, err := parseBuckets(s)
+		if err != nil {
+			mc.setErr(fmt.Errorf("ginprom: WithSizeBucketsString: %w", err))
+			return
+		}
+		mc.sizeBuckets = buckets
+	}
+}
 
-	// If FullPath is empty (route not found/registered), try the request URL path
-	if path == "" {
-		// Use the raw request path as fallback
-		if c.Request != nil && c.Request.URL != nil {
-			path = c.Request.URL.Path
+// parseBuckets parses a comma-separated list of strictly increasing bucket
+// boundaries.
+func parseBuckets(s string) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errors.New("empty bucket list")
+	}
+	fields := strings.Split(s, ",")
+	buckets := make([]float64, 0, len(fields))
+	for i, field := range fields {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || math.IsNaN(b) {
+			return nil, fmt.Errorf("invalid bucket %q at position %d", strings.TrimSpace(field), i+1)
 		}
+		buckets = append(buckets, b)
+	}
+	if err := validateBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
 
-		// If still empty (very unlikely), use a placeholder
-		if path == "" {
-			path = "/unknown"
+// validateBuckets checks that buckets are strictly increasing and contain
+// no NaN, as the client library requires.  An empty list is valid and makes
+// the library use its default buckets.
+func validateBuckets(buckets []float64) error {
+	for i, b := range buckets {
+		if math.IsNaN(b) {
+			return fmt.Errorf("invalid bucket NaN at position %d", i+1)
+		}
+		if i > 0 && b <= buckets[i-1] {
+			return fmt.Errorf("bucket %v at position %d is not greater than %v", b, i+1, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// metricHelp holds the Help text of the four main metrics.
+type metricHelp struct {
+	requests     string
+	duration     string
+	requestSize  string
+	responseSize string
+}
+
+// WithCounterHelp replaces the Help text of http_requests_total.
+func WithCounterHelp(help string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.help.requests = help
+	}
+}
+
+// WithDurationHelp replaces the Help text of http_request_duration_seconds.
+func WithDurationHelp(help string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.help.duration = help
+	}
+}
+
+// WithRequestSizeHelp replaces the Help text of http_request_size_bytes,
+// whether it is exported as a histogram or a summary.
+func WithRequestSizeHelp(help string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.help.requestSize = help
+	}
+}
+
+// WithResponseSizeHelp replaces the Help text of http_response_size_bytes,
+// whether it is exported as a histogram or a summary.
+func WithResponseSizeHelp(help string) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.help.responseSize = help
+	}
+}
+
+// WithSLOBuckets sets the request-duration buckets around latency
+// objectives, in seconds, so that histogram_quantile and error-budget queries
+// are exact at each objective.  Every objective becomes a bucket boundary,
+// surrounded by boundaries at a quarter, half, twice and four times its
+// value.  Objectives may be given in any order; duplicates are ignored.  They
+// must be positive and finite, otherwise [NewMetricsCollectionE] returns an
+// error.  Like the other bucket options, the last one applied wins.
+//
+// Example, for "95% of requests under 300ms":
+//
+//	ginprom.WithSLOBuckets(0.3)
+func WithSLOBuckets(objectives ...float64) MetricsOption {
+	return func(mc *MetricsCollection) {
+		buckets, err := sloBuckets(objectives)
+		if err != nil {
+			mc.setErr(err)
+			return
+		}
+		mc.durationBuckets = buckets
+	}
+}
+
+// sloBuckets builds the bucket set described by [WithSLOBuckets].
+func sloBuckets(objectives []float64) ([]float64, error) {
+	if len(objectives) == 0 {
+		return nil, errors.New("ginprom: WithSLOBuckets needs at least one objective")
+	}
+	set := make(map[float64]struct{})
+	for _, o := range objectives {
+		if o <= 0 || math.IsInf(o, 0) || math.IsNaN(o) {
+			return nil, fmt.Errorf("ginprom: invalid SLO objective %v, must be positive and finite", o)
+		}
+		for _, f := range []float64{0.25, 0.5, 1, 2, 4} {
+			set[o*f] = struct{}{}
+		}
+	}
+	buckets := make([]float64, 0, len(set))
+	for b := range set {
+		buckets = append(buckets, b)
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
+
+// WithSLO counts requests against a latency objective in two counters
+// labelled by method and path: ginprom_slo_total counts every request and
+// ginprom_slo_good_total those served within latency without a 5xx status.
+// Their ratio is the service level indicator used by multi-window,
+// multi-burn-rate alerts.  latency must be positive, otherwise
+// [NewMetricsCollectionE] returns an error.
+//
+// Example – error budget burn rate over 1h for a 99.9% SLO:
+//
+//	(1 - sum(rate(ginprom_slo_good_total[1h])) / sum(rate(ginprom_slo_total[1h]))) / 0.001
+func WithSLO(latency time.Duration) MetricsOption {
+	return func(mc *MetricsCollection) {
+		if latency <= 0 {
+			mc.setErr(fmt.Errorf("ginprom: SLO latency must be positive, got %v", latency))
+			return
+		}
+		mc.sloLatency = latency
+	}
+}
+
+// setErr records err unless an earlier option already failed.
+func (mc *MetricsCollection) setErr(err error) {
+	if mc.err == nil {
+		mc.err = err
+	}
+}
+
+// WithSplitDurationByOutcome adds an outcome label to
+// http_request_duration_seconds, "error" for responses whose status is at
+// least the error threshold (500 by default, see [WithOutcomeErrorThreshold])
+// and "success" otherwise.  Errors often fail fast, so mixing them with
+// successful requests skews latency percentiles; this isolates them at a
+// fraction of the cardinality of a per-status-code breakdown.  A histogram
+// passed to [WithCustomDurationHistogram] must declare the outcome label as
+// its last label.
+func WithSplitDurationByOutcome(split bool) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.splitDurationByOutcome = split
+	}
+}
+
+// WithOutcomeErrorThreshold sets the lowest status counted as an "error"
+// outcome by [WithSplitDurationByOutcome], e.g. 400 to include client errors.
+func WithOutcomeErrorThreshold(status int) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.outcomeErrorThreshold = status
+	}
+}
+
+// outcome returns the outcome label value of status.
+func (mc *MetricsCollection) outcome(status int) string {
+	if status >= mc.outcomeErrorThreshold {
+		return "error"
+	}
+	return "success"
+}
+
+// WithStandardRuntimeMetrics also registers the standard Go runtime (go_*)
+// and process (process_*) collectors, so that a single collection provides
+// the usual picture of a service.  This is mostly useful with
+// [WithCustomRegistry]: the default Prometheus registry already contains
+// both collectors, in which case they are left as they are.
+//
+// Example:
+//
+//	reg := prometheus.NewRegistry()
+//	mc := ginprom.NewMetricsCollection(
+//	    ginprom.WithCustomRegistry(reg),
+//	    ginprom.WithStandardRuntimeMetrics(),
+//	)
+func WithStandardRuntimeMetrics() MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.runtimeMetrics = true
+	}
+}
+
+// registerRuntimeCollectors registers the Go and process collectors with
+// registry, tolerating ones that are already registered, and returns those it
+// registered.
+func registerRuntimeCollectors(registry prometheus.Registerer) ([]prometheus.Collector, error) {
+	runtime := []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	}
+	var registered []prometheus.Collector
+	for _, c := range runtime {
+		if err := registry.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) {
+				continue
+			}
+			for _, r := range registered {
+				registry.Unregister(r)
+			}
+			return nil, fmt.Errorf("ginprom: registering runtime metrics: %w", err)
 		}
+		registered = append(registered, c)
 	}
+	return registered, nil
+}
+
+// defaultMetrics is the collection used by [Middleware].  It is created, and
+// registered with the default registry, by the first call to Middleware, so
+// that importing the package does not register anything.
+var (
+	defaultMetricsMu sync.Mutex
+	defaultMetrics   *MetricsCollection
+)
 
-	return path
+// defaultCollection returns the package-level collection, creating it on
+// first use.
+func defaultCollection() *MetricsCollection {
+	defaultMetricsMu.Lock()
+	defer defaultMetricsMu.Unlock()
+	if defaultMetrics == nil {
+		defaultMetrics = defaultMetricsCollection()
+	}
+	return defaultMetrics
 }
 
 // handleUnmatchedPath processes paths for routes that weren't matched by Gin router
@@ -351,23 +1156,11 @@ func handleUnmatchedPath(conf *config, routePattern, path string) (string, strin
 	return "", path
 }
 
-// Replace the existing getPathFromContext with our improved implementation
-func getPathFromContext(c *gin.Context) string {
-	path := c.FullPath()
-	if path == "" {
-		if c.Request != nil && c.Request.URL != nil {
-			path = c.Request.URL.Path
-		}
-		if path == "" {
-			path = "/unknown"
-		}
-	}
-	return path
-}
-
 // Middleware returns a Gin handler that records Prometheus metrics for every
-// request using the package-level default metric collectors registered with
-// the global Prometheus registry.
+// request into the package-level default [MetricsCollection], registered
+// with the global Prometheus registry by the first call to Middleware.  It is
+// exactly [MiddlewareWithMetrics] with that collection, so both record the
+// same series.
 //
 // Accept zero or more [Option] values to tune what is measured:
 //
@@ -376,20 +1169,72 @@ func getPathFromContext(c *gin.Context) string {
 //	    ginprom.WithAggregateStatusCode(true),
 //	))
 func Middleware(options ...Option) gin.HandlerFunc {
-	return MiddlewareWithMetrics(defaultMetrics, options...)
+	return MiddlewareWithMetrics(defaultCollection(), options...)
+}
+
+// SkipContextKey is the Gin context key that, set to true by a handler,
+// excludes the current request from all metrics.  See [Skip].
+const SkipContextKey = "ginprom_skip"
+
+// Skip excludes the current request from all metrics.  Call it from a handler
+// that knows its request should not be metered, such as an internal probe
+// served by a regular route.
+func Skip(c *gin.Context) {
+	c.Set(SkipContextKey, true)
 }
 
 // MiddlewareWithMetrics is like [Middleware] but records metrics into the
 // provided [MetricsCollection] instead of the package-level default.  Use
 // this when you need multiple independent metric namespaces, custom
 // registries, or fine-grained control over the collectors.
+//
+// Each returned handler keeps its own options, so different instances can be
+// installed on separate [gin.RouterGroup]s, e.g. a public and an admin API
+// with their own filters.  Settings of the collection itself, such as
+// buckets, need one collection per group; give them distinct prefixes
+// ([WithMetricPrefix]) or registries so that their names do not clash.
+// Install each instance on one group only, not also on the engine, or its
+// requests are recorded twice.
+//
+// Options that need more than gin.ResponseWriter exposes replace c.Writer
+// with a pooled wrapper for the duration of the request.  Handlers must then
+// not use c.Writer, or keep it for goroutines, after they returned; hijacked
+// connections and responses that were flushed or asked for CloseNotify, as
+// c.Stream does, are exempt, as their wrapper is not reused.
+//
+// The optional vectors of metrics that the options record into are built and
+// registered here, if no earlier middleware did; MiddlewareWithMetrics panics
+// when they cannot be registered.
+//
+// Example:
+//
+//	public := ginprom.NewMetricsCollection(ginprom.WithMetricPrefix("public"))
+//	admin := ginprom.NewMetricsCollection(ginprom.WithMetricPrefix("admin"),
+//	    ginprom.WithLinearDurationBuckets(0.1, 0.1, 10))
+//	r.Group("/api", ginprom.MiddlewareWithMetrics(public, ginprom.WithCommonHealthFilters()))
+//	r.Group("/admin", ginprom.MiddlewareWithMetrics(admin))
 func MiddlewareWithMetrics(metrics *MetricsCollection, options ...Option) gin.HandlerFunc {
-	conf := applyOpt(options...)
+	base := applyOpt(options...)
+	if err := metrics.enableOptional(base); err != nil {
+		panic(err)
+	}
 
 	return func(c *gin.Context) {
-		start := time.Now()
-
 		route := c.FullPath()
+		unmatched := route == ""
+
+		conf := base.forRoute(route)
+		start := conf.now()
+
+		if conf.validateOrdering {
+			checkOrdering(c, conf)
+		}
+
+		// Aborted requests still flow through c.Next, which then runs no
+		// further handlers, so they are recorded with their 429 status
+		done := enforceConcurrencyLimit(c, conf, route, metrics)
+		defer done()
+
 		path := route
 		if path == "" {
 			if c.Request != nil && c.Request.URL != nil {
@@ -403,23 +1248,116 @@ func MiddlewareWithMetrics(metrics *MetricsCollection, options ...Option) gin.Ha
 		// Process unmatched routes according to configuration
 		route, path = handleUnmatchedPath(conf, route, path)
 
-		if conf.filterPath(route, path) {
+		if conf.filterPath(route, path) || conf.ignoredPath(c.Request) {
 			c.Next()
 			return
 		}
 
-		c.Next()
+		var rw *responseWriter
+		if conf.needsResponseWriter() {
+			rw = newResponseWriter(c.Writer, conf, start)
+			c.Writer = rw
+			// Middleware running before this one must not keep seeing the
+			// wrapper once it went back to the pool.  finish also runs here
+			// so that a panicking handler does not leak the inflater.
+			defer func() {
+				c.Writer = rw.ResponseWriter
+				rw.finish()
+				rw.release()
+			}()
+		}
+
+		if conf.streamingRequestSize && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			body := &countingBody{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+			c.Set(requestBodyKey, body)
+		}
+
+		cpu := time.Duration(-1)
+		if conf.recordCPUTime {
+			cpu = handlerCPUTime(c)
+		} else {
+			c.Next()
+		}
+
+		if rw != nil {
+			// Responses without a body are only sent once the middleware
+			// returned
+			rw.stampResponseTime()
+			rw.finish()
+		}
+
+		if c.GetBool(SkipContextKey) || conf.healthCheck(c.Request, c.Writer.Status()) {
+			return
+		}
+
+		var recordStart time.Time
+		if conf.selfInstrumentation {
+			recordStart = time.Now()
+		}
+
+		if conf.queueTimeHeader != "" && metrics.QueueTime != nil {
+			if queued, ok := queueTime(c.GetHeader(conf.queueTimeHeader), start); ok {
+				metrics.observe(metrics.QueueTime, "http_request_queue_time_seconds", queued.Seconds(), c.Request.Method)
+			}
+		}
+
+		if unmatched && conf.recordUnmatched && metrics.UnmatchedRequests != nil {
+			metrics.add(metrics.UnmatchedRequests, "http_unmatched_requests_total", 1, c.Request.Method)
+		}
+
+		handleMetricsWithCollection(c, conf, rw, route, path, start, cpu, metrics)
 
-		handleMetricsWithCollection(c, conf, route, path, start, metrics)
+		if conf.selfInstrumentation && metrics.MiddlewareOverhead != nil {
+			metrics.observe(metrics.MiddlewareOverhead, "ginprom_record_duration_seconds", time.Since(recordStart).Seconds())
+		}
+
+		if rw != nil && conf.errorBodyCapture != nil {
+			if status := rw.Status(); status >= http.StatusInternalServerError {
+				conf.errorBodyCapture(c, status, rw.errorBody)
+			}
+		}
 	}
 }
 
 // Handles metrics collection after request execution with custom metrics collection
-func handleMetricsWithCollection(c *gin.Context, conf *config, route, path string, start time.Time, metrics *MetricsCollection) {
+func handleMetricsWithCollection(c *gin.Context, conf *config, rw *responseWriter, route, path string, start time.Time, cpu time.Duration, metrics *MetricsCollection) {
 	status := c.Writer.Status()
+	if conf.accurateStatus && rw != nil && rw.headerStatus != 0 {
+		status = rw.headerStatus
+	}
+	if status == 0 {
+		status = conf.zeroStatusAs
+	}
+	if conf.statusHeader != "" {
+		if v, err := strconv.Atoi(c.Writer.Header().Get(conf.statusHeader)); err == nil && v >= 100 && v < 1000 {
+			status = v
+		}
+	}
+	if conf.timeoutStatus && deadlineExceeded(c) {
+		status = http.StatusServiceUnavailable
+	}
 	var statusCode string
-	if conf.aggregateStatusCode {
+	hijacked := rw != nil && rw.hijacked
+	if hijacked && conf.webSocketMode == WebSocketSkip {
+		return
+	}
+
+	if hijacked && conf.webSocketMode == WebSocketLabel {
+		statusCode = "websocket"
+	} else if conf.upgradeMode == UpgradeLabel && isUpgradeRequest(c.Request) {
+		statusCode = "upgrade"
+	} else if conf.handleClientCancel && clientCancelled(c) {
+		if conf.skipOnClientCancel {
+			return
+		}
+		statusCode = conf.clientCancelLabel
+	} else if conf.statusMapper != nil {
+		statusCode = conf.statusMapper(status)
+	} else if conf.aggregateStatusCode {
 		statusCode = statusAddr[status/100] + "xx"
+	} else if text := http.StatusText(status); conf.statusTextLabel && text != "" {
+		statusCode = text
 	} else if status < 1000 {
 		statusCode = statusAddr[status]
 	} else {
@@ -427,61 +1365,397 @@ func handleMetricsWithCollection(c *gin.Context, conf *config, route, path strin
 	}
 
 	aggregatePath := conf.pathAggregator(route, path, status)
+	if conf.aggregateOnError && status >= http.StatusBadRequest {
+		if status < http.StatusInternalServerError {
+			aggregatePath = "path_4xx"
+		} else {
+			aggregatePath = "path_5xx"
+		}
+	}
+	if conf.detailedRoutes != nil {
+		if _, ok := conf.detailedRoutes[route]; !ok {
+			aggregatePath = "other"
+		}
+	}
+	if name, ok := conf.routeNames[aggregatePath]; ok {
+		aggregatePath = name
+	}
+	if conf.pathBreaker != nil {
+		aggregatePath = conf.pathBreaker.label(aggregatePath, conf.logger)
+	}
 	method := c.Request.Method
 
+	// Responses whose status was not selected are dropped, optionally still
+	// counting them in the requests counter
+	if conf.statusFilter != nil && !conf.statusFilter(status) {
+		if conf.countAllStatusCodes {
+			metrics.add(metrics.TotalRequests, "http_requests_total", 1, metrics.labelValues(c, statusCode, method, aggregatePath)...)
+		}
+		return
+	}
+
 	// Collect metrics based on configuration with custom metrics collection
-	recordRequestMetricsWithCollection(conf, c, statusCode, method, aggregatePath, start, metrics)
+	recordRequestMetricsWithCollection(conf, c, rw, status, statusCode, method, aggregatePath, start, cpu, metrics)
+
+	if conf.errorMetrics != nil && status >= http.StatusInternalServerError {
+		recordErrorMetrics(conf, c, status, statusCode, method, aggregatePath, start, conf.errorMetrics)
+	}
 }
 
-// Records request-related metrics with custom metrics collection
-func recordRequestMetricsWithCollection(conf *config, c *gin.Context, statusCode, method, path string, start time.Time, metrics *MetricsCollection) {
+// recordErrorMetrics records a server error into the collection set with
+// [WithErrorOnlyMetrics].
+func recordErrorMetrics(conf *config, c *gin.Context, status int, statusCode, method, path string, start time.Time, metrics *MetricsCollection) {
+	lvs := metrics.labelValues(c, statusCode, method, path)
+	metrics.add(metrics.TotalRequests, "http_requests_total", 1, lvs...)
+
+	if conf.recordDuration {
+		if metrics.splitDurationByOutcome {
+			lvs = append(lvs, metrics.outcome(status))
+		}
+		metrics.observe(metrics.Duration, "http_request_duration_seconds", conf.now().Sub(start).Seconds(), lvs...)
+	}
+}
+
+// queueTime parses an X-Request-Start style header value, a Unix timestamp
+// optionally prefixed with "t=", and returns how long before now it lies.
+// Seconds, milliseconds, microseconds and nanoseconds are told apart by
+// magnitude.  Malformed values and timestamps in the future are rejected.
+func queueTime(header string, now time.Time) (time.Duration, bool) {
+	v, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(header), "t="), 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) {
+		return 0, false
+	}
+
+	var nanos float64
+	switch {
+	case v > 1e17:
+		nanos = v
+	case v > 1e14:
+		nanos = v * 1e3
+	case v > 1e11:
+		nanos = v * 1e6
+	default:
+		nanos = v * 1e9
+	}
+
+	queued := now.Sub(time.Unix(0, int64(nanos)))
+	if queued < 0 {
+		return 0, false
+	}
+	return queued, true
+}
+
+// pathDepth returns the number of non-empty "/"-separated segments in route.
+func pathDepth(route string) int {
+	depth := 0
+	inSegment := false
+	for i := 0; i < len(route); i++ {
+		if route[i] == '/' {
+			inSegment = false
+		} else if !inSegment {
+			inSegment = true
+			depth++
+		}
+	}
+	return depth
+}
+
+// clientCancelled reports whether the client went away before the request
+// completed, in which case the status written by the handler was never seen.
+func clientCancelled(c *gin.Context) bool {
+	if c.Request == nil {
+		return false
+	}
+	return errors.Is(c.Request.Context().Err(), context.Canceled)
+}
+
+// deadlineExceeded reports whether the request context expired because of
+// its deadline, as when an http.TimeoutHandler gave up on the request.
+func deadlineExceeded(c *gin.Context) bool {
+	if c.Request == nil {
+		return false
+	}
+	return errors.Is(c.Request.Context().Err(), context.DeadlineExceeded)
+}
+
+// notifyDurationObserver hands a recorded duration to the observer set with
+// [WithDurationObserver], recovering from any panic in it.
+func notifyDurationObserver(conf *config, route, method string, status int, d time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			conf.log().Warn("ginprom: duration observer panicked", "route", route, "panic", r)
+		}
+	}()
+	conf.durationObserver(route, method, status, d)
+}
+
+// Records request-related metrics with custom metrics collection.  cpu is the
+// CPU time of the handler chain, negative when it was not measured.
+func recordRequestMetricsWithCollection(conf *config, c *gin.Context, rw *responseWriter, status int, statusCode, method, path string, start time.Time, cpu time.Duration, metrics *MetricsCollection) {
+	lvs := metrics.labelValues(c, statusCode, method, path)
+
 	// Increment total requests
-	metrics.TotalRequests.WithLabelValues(statusCode, method, path).Inc()
+	metrics.add(metrics.TotalRequests, "http_requests_total", 1, lvs...)
 
-	// Record response size
-	if conf.recordResponseSize {
-		metrics.ResponseSize.WithLabelValues(statusCode, method, path).Observe(float64(c.Writer.Size()))
+	// Count requests aborted further down the chain
+	if conf.recordAborts && metrics.AbortedRequests != nil && c.IsAborted() {
+		metrics.add(metrics.AbortedRequests, "http_aborted_requests_total", 1, method, path)
+	}
+
+	// Count requests replaying an idempotency key
+	if d := conf.duplicates; d != nil && metrics.DuplicateRequests != nil {
+		if key := c.GetHeader(d.header); key != "" && d.duplicate(key, start) {
+			metrics.add(metrics.DuplicateRequests, "http_duplicate_requests_total", 1, method, path)
+		}
+	}
+
+	// Count errors attached by handlers
+	if conf.recordGinErrors && metrics.GinErrors != nil && len(c.Errors) > 0 {
+		metrics.add(metrics.GinErrors, "http_gin_errors_total", float64(len(c.Errors)), method, path)
+	}
+
+	// Count requests whose input could not be bound
+	if conf.recordBindErrors && metrics.BindErrors != nil && len(c.Errors.ByType(gin.ErrorTypeBind)) > 0 {
+		metrics.add(metrics.BindErrors, "http_bind_errors_total", 1, path)
+	}
+
+	// Sizes do not describe tunnels and upgraded protocols
+	upgrade := conf.upgradeMode != UpgradeRecord && isUpgradeRequest(c.Request)
+	sampled := conf.sampled(status)
+
+	// Record response size, which is meaningless once the connection was
+	// hijacked
+	if conf.recordResponseSize && sampled && !upgrade && !(rw != nil && rw.hijacked && conf.webSocketMode == WebSocketLabel) {
+		var exemplar prometheus.Labels
+		if conf.responseSizeExemplars {
+			exemplar = requestExemplar(conf, c)
+		}
+		size := recordedResponseSize(conf, c.Writer, rw)
+		if conf.responseSizeCap > 0 && size > conf.responseSizeCap {
+			size = conf.responseSizeCap
+			if metrics.OversizeResponses != nil {
+				metrics.add(metrics.OversizeResponses, "http_oversize_responses_total", 1, method, path)
+			}
+		}
+		metrics.observeWithExemplar(metrics.responseSizeObserver(), "http_response_size_bytes", float64(size), exemplar, lvs...)
 	}
 
 	// Record request size
-	if conf.recordRequestSize {
-		metrics.RequestSize.WithLabelValues(statusCode, method, path).Observe(float64(getRequestSize(c.Request)))
+	if conf.recordRequestSize && sampled && !upgrade {
+		var size int64
+		if conf.streamingRequestSize {
+			size = streamedRequestSize(conf, c)
+		} else {
+			size = recordedRequestSize(conf, c.Request)
+		}
+		metrics.observe(metrics.requestSizeObserver(), "http_request_size_bytes", float64(size), lvs...)
 	}
 
 	// Record duration
-	if conf.recordDuration {
-		metrics.Duration.WithLabelValues(statusCode, method, path).Observe(time.Since(start).Seconds())
+	duration := conf.now().Sub(start)
+	elapsed := duration.Seconds()
+	if conf.recordDuration && sampled && !(upgrade && conf.upgradeMode == UpgradeSkip) {
+		durationLvs := lvs
+		if metrics.splitDurationByOutcome {
+			durationLvs = append(lvs[:len(lvs):len(lvs)], metrics.outcome(status))
+		}
+		var exemplar prometheus.Labels
+		if conf.exemplarPolicy != nil && conf.exemplarPolicy(status, duration) {
+			exemplar = requestExemplar(conf, c)
+		}
+		metrics.observeWithExemplar(metrics.Duration, "http_request_duration_seconds", elapsed, exemplar, durationLvs...)
+		if conf.durationObserver != nil {
+			notifyDurationObserver(conf, path, method, status, duration)
+		}
+		if metrics.sliding != nil {
+			metrics.sliding.observe(path, elapsed)
+		}
+	}
+
+	// Count the request against the latency objective
+	if metrics.sloLatency > 0 {
+		metrics.add(metrics.SLOTotalRequests, "ginprom_slo_total", 1, method, path)
+		if elapsed <= metrics.sloLatency.Seconds() && status < http.StatusInternalServerError {
+			metrics.add(metrics.SLOGoodRequests, "ginprom_slo_good_total", 1, method, path)
+		}
+	}
+
+	// Record the CPU time of the handler chain
+	if cpu >= 0 && metrics.CPUTime != nil {
+		metrics.observe(metrics.CPUTime, "http_request_cpu_seconds", cpu.Seconds(), method, path)
+	}
+
+	// Record the depth of the matched route template
+	if conf.recordPathDepth && metrics.PathDepth != nil {
+		if route := c.FullPath(); route != "" {
+			metrics.observe(metrics.PathDepth, "http_route_path_depth", float64(pathDepth(route)), method)
+		}
+	}
+
+	// Record how often streaming responses were flushed
+	if conf.recordFlushCount && metrics.ResponseFlushes != nil && rw != nil {
+		metrics.observe(metrics.ResponseFlushes, "http_response_flushes", float64(rw.flushes), method, path)
+	}
+
+	// Count responses that lied about their length
+	if conf.detectContentLengthMismatch && metrics.ContentLengthMismatches != nil && rw != nil && rw.contentLengthMismatch(c.Request) {
+		metrics.add(metrics.ContentLengthMismatches, "http_content_length_mismatches_total", 1, method, path)
+	}
+
+	// Count responses the client did not receive in full
+	if conf.trackWriteErrors && metrics.ResponseWriteErrors != nil && rw != nil && rw.writeFailed {
+		metrics.add(metrics.ResponseWriteErrors, "http_response_write_errors_total", 1, path)
+	}
+
+	// Record compression savings of gzip-encoded responses
+	if conf.recordCompressionRatio && metrics.ResponseCompressionRatio != nil && rw != nil {
+		if ratio, ok := rw.compressionRatio(); ok {
+			metrics.observe(metrics.ResponseCompressionRatio, "http_response_compression_ratio", ratio, method, path)
+		}
 	}
 }
 
-// Keep the old functions for backward compatibility
-func handleMetrics(c *gin.Context, conf *config, route, path string, start time.Time) {
-	handleMetricsWithCollection(c, conf, route, path, start, defaultMetrics)
+// add adds v to the child of vec selected by lvs.  Failures to get the child,
+// e.g. because a custom collector has a different label set or a registry
+// limit was reached, are counted in MetricErrors under the metric's default
+// name instead of panicking.
+func (mc *MetricsCollection) add(vec *prometheus.CounterVec, metric string, v float64, lvs ...string) {
+	counter, err := vec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		mc.MetricErrors.WithLabelValues(metric).Inc()
+		return
+	}
+	counter.Add(v)
 }
 
-func recordRequestMetrics(conf *config, c *gin.Context, params []string, start time.Time) {
-	if len(params) < 3 {
+// observe is like add for histograms and summaries.
+func (mc *MetricsCollection) observe(vec prometheus.ObserverVec, metric string, v float64, lvs ...string) {
+	observer, err := vec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		mc.MetricErrors.WithLabelValues(metric).Inc()
 		return
 	}
-	recordRequestMetricsWithCollection(conf, c, params[0], params[1], params[2], start, defaultMetrics)
+	observer.Observe(v)
 }
 
-var (
-	totalRequests *prometheus.CounterVec
-	responseSize  *prometheus.HistogramVec
-	requestSize   *prometheus.HistogramVec
-	duration      *prometheus.HistogramVec
-)
+// observeWithExemplar is like observe but attaches exemplar, when not nil, to
+// the observation if the collector supports exemplars.
+func (mc *MetricsCollection) observeWithExemplar(vec prometheus.ObserverVec, metric string, v float64, exemplar prometheus.Labels, lvs ...string) {
+	observer, err := vec.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		mc.MetricErrors.WithLabelValues(metric).Inc()
+		return
+	}
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	observer.Observe(v)
+}
+
+// requestExemplar returns the exemplar labels of the request, built from the
+// trace ID and request ID sources configured.
+func requestExemplar(conf *config, c *gin.Context) prometheus.Labels {
+	var traceID, requestID string
+	if conf.exemplarTraceID != nil {
+		traceID = conf.exemplarTraceID(c)
+	}
+	if conf.requestIDHeader != "" {
+		requestID = c.GetHeader(conf.requestIDHeader)
+	}
+	return exemplarLabels(traceID, requestID)
+}
+
+// exemplarLabels returns the exemplar labels for traceID and requestID,
+// leaving out empty values and values that would make an invalid exemplar,
+// which the client library rejects with a panic.  The request ID is dropped
+// first when both do not fit.  It returns nil when no label is left.
+func exemplarLabels(traceID, requestID string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	room := prometheus.ExemplarMaxRunes
+	for _, l := range [...]struct{ name, value string }{{"trace_id", traceID}, {"request_id", requestID}} {
+		if l.value == "" || !utf8.ValidString(l.value) {
+			continue
+		}
+		if n := len(l.name) + utf8.RuneCountInString(l.value); n <= room {
+			labels[l.name] = l.value
+			room -= n
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// recordedRequestSize returns the request size recorded by the middleware, honouring
+// the options that restrict how it may be measured.
+func recordedRequestSize(conf *config, r *http.Request) int64 {
+	switch conf.requestSizeMode {
+	case RequestSizeHeadersOnly:
+		return requestHeaderSize(r)
+	case RequestSizeBodyOnly:
+		if r.ContentLength != -1 || conf.requestSizeFromContentLengthOnly {
+			return max(r.ContentLength, 0)
+		}
+		size, err := calculateBodySizeStream(r)
+		if err != nil {
+			conf.log().Debug("ginprom: measuring request size failed, recording 0", "path", r.URL.Path, "error", err)
+			return 0
+		}
+		return size
+	}
 
-// Safely retrieves request size, falling back if Content-Length is unavailable
-func getRequestSize(r *http.Request) int64 {
 	if r.ContentLength != -1 {
 		return r.ContentLength
 	}
+	if conf.requestSizeFromContentLengthOnly {
+		return requestHeaderSize(r)
+	}
 
 	size, err := calculateRequestSize(r)
 	if err != nil {
-		return 0 // Fallback to 0 if calculation fails
+		conf.log().Debug("ginprom: measuring request size failed, recording 0", "path", r.URL.Path, "error", err)
+		return 0
+	}
+	return size
+}
+
+// requestBodyKey is the Gin context key of the counting wrapper installed
+// around the request body by [WithStreamingRequestSize].
+const requestBodyKey = "ginprom_request_body"
+
+// streamedRequestSize returns the request size from the body bytes the
+// handler chain read, following the request size mode.
+func streamedRequestSize(conf *config, c *gin.Context) int64 {
+	var read int64
+	if body, ok := c.Value(requestBodyKey).(*countingBody); ok {
+		read = body.n
+	}
+	switch conf.requestSizeMode {
+	case RequestSizeHeadersOnly:
+		return requestHeaderSize(c.Request)
+	case RequestSizeBodyOnly:
+		return read
+	}
+	return requestHeaderSize(c.Request) + read
+}
+
+// recordedResponseSize returns the response size recorded by the middleware,
+// honouring the options that change how it is measured.  rw is the wrapper
+// installed by the middleware, if any.
+func recordedResponseSize(conf *config, w gin.ResponseWriter, rw *responseWriter) int64 {
+	size := int64(w.Size())
+	if conf.exactResponseSize && rw != nil {
+		size = rw.wireBytes
+	}
+	if size <= 0 && conf.responseSizeFromHeaderFallback {
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && n > 0 {
+			size = n
+		}
+	}
+	if conf.includeTrailers {
+		size += trailerSize(w.Header())
 	}
 	return size
 }
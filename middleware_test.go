@@ -1,15 +1,23 @@
 package ginprom
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func init() {
@@ -26,55 +34,45 @@ func newTestMetrics() *MetricsCollection {
 	return NewMetricsCollection(WithCustomRegistry(newTestRegistry()))
 }
 
-// performRequest fires a GET request against the provided router and returns the response.
-func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest(method, path, nil)
-	r.ServeHTTP(w, req)
-	return w
+// newTestMetricsWithRegistry returns a MetricsCollection together with the
+// isolated registry it is registered on, so tests can gather its output.
+func newTestMetricsWithRegistry(opts ...MetricsOption) (*MetricsCollection, *prometheus.Registry) {
+	reg := newTestRegistry()
+	return NewMetricsCollection(append([]MetricsOption{WithCustomRegistry(reg)}, opts...)...), reg
 }
 
-// ---------------------------------------------------------------------------
-// getPathWithFallback
-// ---------------------------------------------------------------------------
-
-func TestGetPathWithFallback_RegisteredRoute(t *testing.T) {
-	r := gin.New()
-	var capturedPath string
-	r.GET("/ping", func(c *gin.Context) {
-		capturedPath = getPathWithFallback(c)
-		c.Status(http.StatusOK)
-	})
-	performRequest(r, "GET", "/ping")
-	if capturedPath != "/ping" {
-		t.Errorf("expected /ping, got %q", capturedPath)
+// gatherFamily returns the metric family called name from reg, or nil when
+// the family has no series.
+func gatherFamily(t *testing.T, reg prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf
+		}
 	}
+	return nil
 }
 
-func TestGetPathWithFallback_UnregisteredRoute(t *testing.T) {
-	r := gin.New()
-	r.NoRoute(func(c *gin.Context) {
-		path := getPathWithFallback(c)
-		// FullPath is empty for unregistered routes; should fall back to URL path
-		if !strings.HasPrefix(path, "/") {
-			t.Errorf("expected a path starting with '/', got %q", path)
+// labelValue returns the value of the label called name on m.
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
 		}
-		c.Status(http.StatusNotFound)
-	})
-	performRequest(r, "GET", "/does-not-exist")
+	}
+	return ""
 }
 
-func TestGetPathWithFallback_WithParam(t *testing.T) {
-	r := gin.New()
-	var capturedPath string
-	r.GET("/users/:id", func(c *gin.Context) {
-		capturedPath = getPathWithFallback(c)
-		c.Status(http.StatusOK)
-	})
-	performRequest(r, "GET", "/users/42")
-	if capturedPath != "/users/:id" {
-		t.Errorf("expected /users/:id, got %q", capturedPath)
-	}
+// performRequest fires a GET request against the provided router and returns the response.
+func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	r.ServeHTTP(w, req)
+	return w
 }
 
 // ---------------------------------------------------------------------------
@@ -205,7 +203,7 @@ func TestMiddlewareWithMetrics_CustomPathAggregator(t *testing.T) {
 }
 
 func TestMiddleware_DefaultUsesGlobalMetrics(t *testing.T) {
-	// Middleware() uses the package-level defaultMetrics; just ensure no panic.
+	// Middleware() uses the package-level default collection; just ensure no panic.
 	r := gin.New()
 	r.Use(Middleware())
 	r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
@@ -215,6 +213,93 @@ func TestMiddleware_DefaultUsesGlobalMetrics(t *testing.T) {
 	}
 }
 
+// resetDefaultCollection starts the test from a package that was imported
+// but never used: the package-level collection is dropped and the global
+// Prometheus registry replaced by an empty one, so that nothing registered
+// by earlier tests, optional vectors included, is left behind.  Both are
+// restored when the test ends.
+func resetDefaultCollection(t *testing.T) {
+	t.Helper()
+	defaultMetricsMu.Lock()
+	saved := defaultMetrics
+	defaultMetrics = nil
+	defaultMetricsMu.Unlock()
+
+	registerer, gatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	reg := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = reg, reg
+
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registerer, gatherer
+		defaultMetricsMu.Lock()
+		defaultMetrics = saved
+		defaultMetricsMu.Unlock()
+	})
+}
+
+// defaultRegistered reports whether the default registry holds the
+// http_requests_total counter of the package-level collection.
+func defaultRegistered(t *testing.T) bool {
+	t.Helper()
+	probe := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of requests.",
+	}, []string{"status_code", "method", "path"})
+	if err := prometheus.DefaultRegisterer.Register(probe); err != nil {
+		return true
+	}
+	prometheus.DefaultRegisterer.Unregister(probe)
+	return false
+}
+
+func TestMiddleware_LazyRegistration(t *testing.T) {
+	resetDefaultCollection(t)
+
+	if defaultRegistered(t) {
+		t.Fatal("expected nothing registered before the first Middleware call")
+	}
+	Middleware()
+	if !defaultRegistered(t) {
+		t.Error("expected Middleware to register the default collection")
+	}
+	Middleware()
+}
+
+func TestMiddleware_MatchesDefaultCollection(t *testing.T) {
+	resetDefaultCollection(t)
+	mc, reg := newTestMetricsWithRegistry()
+	for _, h := range []gin.HandlerFunc{Middleware(), MiddlewareWithMetrics(mc)} {
+		r := gin.New()
+		r.Use(h)
+		r.GET("/same-series", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+		performRequest(r, "GET", "/same-series")
+	}
+
+	// series returns the label sets of the /same-series requests by family
+	series := func(g prometheus.Gatherer) map[string]string {
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatalf("gather failed: %v", err)
+		}
+		out := map[string]string{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if labelValue(m, "path") == "/same-series" {
+					out[mf.GetName()] = fmt.Sprint(m.GetLabel())
+				}
+			}
+		}
+		return out
+	}
+	want, got := series(reg), series(prometheus.DefaultGatherer)
+	if len(want) == 0 {
+		t.Fatal("expected series from the default collection")
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected Middleware() to record\n%v\ngot\n%v", want, got)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // NewMetricsCollection with options
 // ---------------------------------------------------------------------------
@@ -236,6 +321,46 @@ func TestNewMetricsCollection_Defaults(t *testing.T) {
 	}
 }
 
+func TestNewMetricsCollectionE_Conflict(t *testing.T) {
+	reg := newTestRegistry()
+	// An identical but distinct duration histogram makes the fourth
+	// registration fail after three collectors were already registered.
+	conflicting := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "http_request_duration_seconds",
+			Help: "Duration of HTTP requests in seconds.",
+		},
+		[]string{"status_code", "method", "path"},
+	)
+	reg.MustRegister(conflicting)
+
+	mc, err := NewMetricsCollectionE(WithCustomRegistry(reg))
+	if err == nil {
+		t.Fatal("expected a registration error")
+	}
+	if mc != nil {
+		t.Error("expected no collection on error")
+	}
+
+	// The collectors registered before the conflict must have been rolled
+	// back, so a retry succeeds once the conflict is gone.
+	reg.Unregister(conflicting)
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(reg)); err != nil {
+		t.Errorf("expected retry to succeed, got %v", err)
+	}
+}
+
+func TestNewMetricsCollection_PanicsOnConflict(t *testing.T) {
+	reg := newTestRegistry()
+	NewMetricsCollection(WithCustomRegistry(reg))
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewMetricsCollection to panic on conflict")
+		}
+	}()
+	NewMetricsCollection(WithCustomRegistry(reg))
+}
+
 func TestNewMetricsCollection_WithPrefix(t *testing.T) {
 	reg := newTestRegistry()
 	mc := NewMetricsCollection(
@@ -275,6 +400,61 @@ func TestNewMetricsCollection_WithCustomCounter(t *testing.T) {
 	}
 }
 
+func TestNewMetricsCollection_CustomCounterLabelOrder(t *testing.T) {
+	swapped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "custom_requests_total", Help: "custom"},
+		[]string{"method", "status_code", "path"},
+	)
+	_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithCustomRequestCounter(swapped))
+	if err == nil || !strings.Contains(err.Error(), "WithCustomRequestCounter") || !strings.Contains(err.Error(), `["status_code" "method" "path"]`) {
+		t.Errorf("expected an error naming the mismatched labels, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewMetricsCollection to panic on a mismatched custom counter")
+		}
+	}()
+	NewMetricsCollection(WithCustomRegistry(prometheus.NewRegistry()), WithCustomRequestCounter(swapped))
+}
+
+func TestNewMetricsCollection_CustomCounterConstrainedLabels(t *testing.T) {
+	constrained := func(order ...string) *prometheus.CounterVec {
+		return prometheus.V2.NewCounterVec(prometheus.CounterVecOpts{
+			CounterOpts: prometheus.CounterOpts{Name: "custom_requests_total", Help: "custom"},
+			VariableLabels: prometheus.ConstrainedLabels{
+				{Name: order[0]},
+				{Name: order[1], Constraint: strings.ToUpper},
+				{Name: order[2]},
+			},
+		})
+	}
+
+	reg := newTestRegistry()
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(reg), WithCustomRequestCounter(constrained("status_code", "method", "path"))); err != nil {
+		t.Errorf("unexpected error for constrained labels in the right order: %v", err)
+	}
+	if mf := gatherFamily(t, reg, "custom_requests_total"); mf != nil {
+		t.Errorf("expected the label check to leave no series behind, got %v", mf)
+	}
+
+	swapped := constrained("method", "status_code", "path")
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithCustomRequestCounter(swapped)); err == nil {
+		t.Error("expected an error for constrained labels in the wrong order")
+	}
+}
+
+func TestNewMetricsCollection_CustomDurationWithOutcome(t *testing.T) {
+	durations := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "custom_duration", Help: "h"},
+		[]string{"status_code", "method", "path", "outcome"},
+	)
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()),
+		WithSplitDurationByOutcome(true), WithCustomDurationHistogram(durations)); err != nil {
+		t.Errorf("unexpected error for a duration histogram with the outcome label: %v", err)
+	}
+}
+
 func TestNewMetricsCollection_WithCustomHistograms(t *testing.T) {
 	reg := newTestRegistry()
 
@@ -309,6 +489,56 @@ func TestNewMetricsCollection_WithCustomHistograms(t *testing.T) {
 	}
 }
 
+func equalBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewMetricsCollection_WithLinearDurationBuckets(t *testing.T) {
+	mc := NewMetricsCollection(
+		WithCustomRegistry(newTestRegistry()),
+		WithLinearDurationBuckets(0.05, 0.05, 6),
+	)
+	if want := prometheus.LinearBuckets(0.05, 0.05, 6); !equalBuckets(mc.durationBuckets, want) {
+		t.Errorf("expected %v, got %v", want, mc.durationBuckets)
+	}
+	if !equalBuckets(mc.sizeBuckets, DefaultSizeBuckets) {
+		t.Errorf("size buckets should be untouched, got %v", mc.sizeBuckets)
+	}
+}
+
+func TestNewMetricsCollection_WithExponentialSizeBuckets(t *testing.T) {
+	mc := NewMetricsCollection(
+		WithCustomRegistry(newTestRegistry()),
+		WithExponentialSizeBuckets(256, 4, 8),
+	)
+	if want := prometheus.ExponentialBuckets(256, 4, 8); !equalBuckets(mc.sizeBuckets, want) {
+		t.Errorf("expected %v, got %v", want, mc.sizeBuckets)
+	}
+}
+
+func TestNewMetricsCollection_BucketOptionsLastWins(t *testing.T) {
+	mc := NewMetricsCollection(
+		WithCustomRegistry(newTestRegistry()),
+		WithLinearDurationBuckets(1, 1, 3),
+		WithCustomBuckets([]float64{0.5, 5}, []float64{10, 100}),
+		WithExponentialSizeBuckets(1, 10, 3),
+	)
+	if !equalBuckets(mc.durationBuckets, []float64{0.5, 5}) {
+		t.Errorf("expected WithCustomBuckets to win for durations, got %v", mc.durationBuckets)
+	}
+	if !equalBuckets(mc.sizeBuckets, []float64{1, 10, 100}) {
+		t.Errorf("expected WithExponentialSizeBuckets to win for sizes, got %v", mc.sizeBuckets)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // WithUnmatchedRouteMarking / WithUnmatchedRouteGrouping options
 // ---------------------------------------------------------------------------
@@ -328,31 +558,31 @@ func TestWithUnmatchedRouteGrouping(t *testing.T) {
 }
 
 // ---------------------------------------------------------------------------
-// getRequestSize
+// recordedRequestSize
 // ---------------------------------------------------------------------------
 
-func TestGetRequestSize_KnownContentLength(t *testing.T) {
+func TestRecordedRequestSize_KnownContentLength(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
 	req.ContentLength = 5
-	size := getRequestSize(req)
+	size := recordedRequestSize(defaultConf(), req)
 	if size != 5 {
 		t.Errorf("expected 5, got %d", size)
 	}
 }
 
-func TestGetRequestSize_ZeroContentLength(t *testing.T) {
+func TestRecordedRequestSize_ZeroContentLength(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	req.ContentLength = 0
-	size := getRequestSize(req)
+	size := recordedRequestSize(defaultConf(), req)
 	if size != 0 {
 		t.Errorf("expected 0, got %d", size)
 	}
 }
 
-func TestGetRequestSize_UnknownContentLength(t *testing.T) {
+func TestRecordedRequestSize_UnknownContentLength(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/", strings.NewReader("body data"))
 	req.ContentLength = -1
-	size := getRequestSize(req)
+	size := recordedRequestSize(defaultConf(), req)
 	if size <= 0 {
 		t.Errorf("expected positive size, got %d", size)
 	}
@@ -394,6 +624,62 @@ func TestGetMetricHandler_WithBasicAuth_WrongPassword(t *testing.T) {
 	}
 }
 
+func TestGetMetricHandler_WithBasicAuth_KeepsGzip(t *testing.T) {
+	handler := GetMetricHandler(WithBasicAuth("admin", "secret"))
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected a gzip response through the auth wrapper, got %q", got)
+	}
+	if _, err := gzip.NewReader(w.Body); err != nil {
+		t.Errorf("expected a valid gzip body: %v", err)
+	}
+}
+
+func TestGetMetricHandler_WithDisableCompression(t *testing.T) {
+	handler := GetMetricHandler(WithBasicAuth("admin", "secret"), WithDisableCompression(true))
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("expected an uncompressed response, got Content-Encoding %q", got)
+	}
+}
+
+func TestGetMetricsAndHealthHandler(t *testing.T) {
+	handler := GetMetricsAndHealthHandler(WithBasicAuth("admin", "secret"))
+	serve := func(path, credentials string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if credentials != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := serve("/healthz", ""); code != http.StatusOK {
+		t.Errorf("expected an unauthenticated 200 from /healthz, got %d", code)
+	}
+	if code := serve("/metrics", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 from /metrics without credentials, got %d", code)
+	}
+	if code := serve("/metrics", "admin:secret"); code != http.StatusOK {
+		t.Errorf("expected 200 from /metrics with credentials, got %d", code)
+	}
+	if code := serve("/other", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 for other paths, got %d", code)
+	}
+}
+
 func TestGetMetricHandler_WithBasicAuth_NoCredentials(t *testing.T) {
 	handler := GetMetricHandler(WithBasicAuth("admin", "secret"))
 	req := httptest.NewRequest("GET", "/metrics", nil)
@@ -415,6 +701,67 @@ func TestGetMetricHandler_WithBasicAuth_WrongUsername(t *testing.T) {
 	}
 }
 
+func TestGetMetricHandler_WithScrapeSelfMetrics(t *testing.T) {
+	handler := GetMetricHandler(WithScrapeSelfMetrics(true))
+
+	// The first scrape is observed once it completes, so it shows up in the
+	// body of the second one.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if i == 1 && !strings.Contains(w.Body.String(), "ginprom_scrape_duration_seconds_count") {
+			t.Error("expected ginprom_scrape_duration_seconds in the scrape output")
+		}
+	}
+
+	// Building a second instrumented handler must reuse the collectors.
+	GetMetricHandler(WithScrapeSelfMetrics(true))
+}
+
+func TestGetMetricHandlerE_RegistrationClash(t *testing.T) {
+	resetDefaultCollection(t)
+	prometheus.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ginprom_scrape_duration_seconds",
+		Help: "Owned by the service.",
+	}))
+
+	if _, err := GetMetricHandlerE(WithScrapeSelfMetrics(true)); err == nil {
+		t.Error("expected an error when the scrape metrics cannot be registered")
+	}
+	if _, err := GetMetricHandlerE(); err != nil {
+		t.Errorf("expected the handler without self metrics to build, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected GetMetricHandler to panic on the same error")
+		}
+	}()
+	GetMetricHandler(WithScrapeSelfMetrics(true))
+}
+
+func TestInstrumentedMetricHandler_CountsErrors(t *testing.T) {
+	reg := newTestRegistry()
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, fmt.Errorf("boom")
+	})
+	handler, err := instrumentedMetricHandler(reg, failing, (&handlerConfig{}).handlerOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	mf := gatherFamily(t, reg, "ginprom_scrape_errors_total")
+	if mf == nil || mf.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("expected one scrape error, got %v", mf)
+	}
+	if mf := gatherFamily(t, reg, "ginprom_scrape_duration_seconds"); mf == nil {
+		t.Error("expected the failed scrape to be timed")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Options
 // ---------------------------------------------------------------------------
@@ -502,6 +849,91 @@ func TestWithPathAggregator_Custom(t *testing.T) {
 	}
 }
 
+func TestWithPathAggregatorChain(t *testing.T) {
+	conf := applyOpt(WithPathAggregatorChain(
+		func(route, path string, status int) string { return strings.ToLower(path) },
+		func(route, path string, status int) string { return fmt.Sprintf("%s_%d", path, status) },
+	))
+	if got := conf.pathAggregator("/Users/:id", "/Users/42", 200); got != "/users/42_200" {
+		t.Errorf("expected /users/42_200, got %q", got)
+	}
+}
+
+func TestWithRouteRenamer(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRouteRenamer(map[string]string{
+		"/v1/resource/:resourceId/sub/:subId": "resource_sub",
+	})))
+	r.GET("/v1/resource/:resourceId/sub/:subId", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/v1/other", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/v1/resource/7/sub/9")
+	performRequest(r, "GET", "/v1/other")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total")
+	}
+	paths := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		paths[labelValue(m, "path")] = true
+	}
+	if !paths["resource_sub"] || !paths["/v1/other"] || len(paths) != 2 {
+		t.Errorf("expected paths resource_sub and /v1/other, got %v", paths)
+	}
+}
+
+func TestWithAggregatePathOnError(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithAggregatePathOnError(true)))
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	r.GET("/orders/:id", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/users/1")
+	performRequest(r, "GET", "/orders/1")
+	performRequest(r, "GET", "/ok")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total")
+	}
+	got := map[string]string{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "status_code")] = labelValue(m, "path")
+	}
+	want := map[string]string{"500": "path_5xx", "404": "path_4xx", "200": "/ok"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected paths %v, got %v", want, got)
+	}
+}
+
+func TestWithDetailedRoutes(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithDetailedRoutes([]string{"/checkout"})))
+	r.GET("/checkout", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/orders/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/checkout")
+	performRequest(r, "GET", "/users/1")
+	performRequest(r, "GET", "/orders/1")
+	performRequest(r, "GET", "/missing")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] += m.GetCounter().GetValue()
+	}
+	want := map[string]float64{"/checkout": 1, "other": 3}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected paths %v, got %v", want, got)
+	}
+}
+
 func TestDefaultPathAggregator_MissingRoute(t *testing.T) {
 	conf := defaultConf()
 	// 4xx without route
@@ -527,3 +959,1854 @@ func TestWithUnmatchedRouteHandling(t *testing.T) {
 		t.Error("expected handleUnmatchedRoutes false")
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Client cancellation
+// ---------------------------------------------------------------------------
+
+// performCancelledRequest serves a request whose context is already cancelled.
+func performCancelledRequest(r http.Handler, method, path string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, method, path, nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestWithSkipOnClientCancel_Skip(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithSkipOnClientCancel(true)))
+	r.GET("/slow", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performCancelledRequest(r, "GET", "/slow")
+
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf != nil {
+		t.Errorf("expected no series for a cancelled request, got %d", len(mf.GetMetric()))
+	}
+}
+
+func TestWithSkipOnClientCancel_Label(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithSkipOnClientCancel(false)))
+	r.GET("/slow", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performCancelledRequest(r, "GET", "/slow")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "client_closed" {
+		t.Errorf("expected status_code client_closed, got %q", got)
+	}
+}
+
+func TestWithClientCancelLabel_Custom(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithClientCancelLabel("499")))
+	r.GET("/slow", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performCancelledRequest(r, "GET", "/slow")
+	performRequest(r, "GET", "/slow")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be exported")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "status_code")] = true
+	}
+	if !got["499"] || !got["200"] {
+		t.Errorf("expected status codes 499 and 200, got %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// UnmatchedRequests
+// ---------------------------------------------------------------------------
+
+func TestUnmatchedRequests_CountsOnlyNoRoute(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordUnmatched(true)))
+	r.GET("/missing-item", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+
+	performRequest(r, "GET", "/scanner/wp-login.php")
+	performRequest(r, "POST", "/scanner/.env")
+	performRequest(r, "GET", "/missing-item")
+
+	mf := gatherFamily(t, reg, "http_unmatched_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_unmatched_requests_total to be exported")
+	}
+	var total float64
+	for _, m := range mf.GetMetric() {
+		total += m.GetCounter().GetValue()
+	}
+	if total != 2 {
+		t.Errorf("expected 2 unmatched requests, got %v", total)
+	}
+}
+
+func TestUnmatchedRequests_WithPrefix(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithMetricPrefix("myapp"))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordUnmatched(true)))
+
+	performRequest(r, "GET", "/ghost")
+
+	if mf := gatherFamily(t, reg, "myapp_http_unmatched_requests_total"); mf == nil {
+		t.Error("expected myapp_http_unmatched_requests_total to be exported")
+	}
+}
+
+func TestNewMetricsCollection_PrefixAndBucketsCompose(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithMetricPrefix("myapp"),
+		WithCustomBuckets([]float64{0.1, 1}, []float64{100, 1000}),
+	)
+	mc.Duration.WithLabelValues("200", "GET", "/").Observe(0.5)
+
+	mf := gatherFamily(t, reg, "myapp_http_request_duration_seconds")
+	if mf == nil {
+		t.Fatal("expected prefix to survive WithCustomBuckets")
+	}
+	if got := len(mf.GetMetric()[0].GetHistogram().GetBucket()); got != 2 {
+		t.Errorf("expected 2 duration buckets, got %d", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Status code selection
+// ---------------------------------------------------------------------------
+
+func newStatusRouter(mc *MetricsCollection, options ...Option) *gin.Engine {
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, options...))
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	return r
+}
+
+func TestWithRecordOnlyStatusCodes(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc, WithRecordOnlyStatusCodes(http.StatusInternalServerError))
+
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds"} {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("%s: expected exactly one series, got %v", name, mf)
+		}
+		if got := labelValue(mf.GetMetric()[0], "status_code"); got != "500" {
+			t.Errorf("%s: expected only status 500, got %q", name, got)
+		}
+	}
+}
+
+func TestWithStatusCodePredicate_CountAll(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc,
+		WithStatusCodePredicate(func(status int) bool { return status >= 400 }),
+		WithCountAllStatusCodes(true),
+	)
+
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected the counter to record both statuses, got %v", mf)
+	}
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one duration series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "500" {
+		t.Errorf("expected duration only for status 500, got %q", got)
+	}
+}
+
+func TestWithErrorOnlyMetrics(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	errMC, errReg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc, WithErrorOnlyMetrics(errMC))
+
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected the main collection to record both requests, got %v", mf)
+	}
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds"} {
+		mf := gatherFamily(t, errReg, name)
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected exactly one %s series in the error collection, got %v", name, mf)
+		}
+		if got := labelValue(mf.GetMetric()[0], "status_code"); got != "500" {
+			t.Errorf("expected only the 500 in %s, got %q", name, got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// GinErrors
+// ---------------------------------------------------------------------------
+
+func TestWithRecordGinErrors(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordGinErrors(true)))
+	r.GET("/broken", func(c *gin.Context) {
+		_ = c.Error(fmt.Errorf("first"))
+		_ = c.Error(fmt.Errorf("second"))
+		c.Status(http.StatusInternalServerError)
+	})
+	r.GET("/fine", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/broken")
+	performRequest(r, "GET", "/fine")
+
+	mf := gatherFamily(t, reg, "http_gin_errors_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Errorf("expected 2 errors, got %v", got)
+	}
+	if got := labelValue(m, "path"); got != "/broken" {
+		t.Errorf("expected path /broken, got %q", got)
+	}
+}
+
+func TestWithRecordBindErrors(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordBindErrors(true)))
+	r.POST("/items", func(c *gin.Context) {
+		var item struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&item); err != nil {
+			_ = c.Error(err).SetType(gin.ErrorTypeBind)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+	r.GET("/other", func(c *gin.Context) {
+		_ = c.Error(fmt.Errorf("not a bind error"))
+		c.Status(http.StatusInternalServerError)
+	})
+
+	for _, body := range []string{`{"name":"a"}`, `{}`, `not json`} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/items", strings.NewReader(body)))
+	}
+	performRequest(r, "GET", "/other")
+
+	mf := gatherFamily(t, reg, "http_bind_errors_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "path") != "/items" || m.GetCounter().GetValue() != 2 {
+		t.Errorf("expected 2 bind errors for /items, got %v", m)
+	}
+}
+
+func TestOptionalMetrics_BuiltOnDemand(t *testing.T) {
+	cases := []struct {
+		metric string
+		option Option
+		built  func(mc *MetricsCollection) bool
+	}{
+		{"http_gin_errors_total", WithRecordGinErrors(true), func(mc *MetricsCollection) bool { return mc.GinErrors != nil }},
+		{"http_bind_errors_total", WithRecordBindErrors(true), func(mc *MetricsCollection) bool { return mc.BindErrors != nil }},
+		{"http_response_compression_ratio", WithRecordCompressionRatio(true), func(mc *MetricsCollection) bool { return mc.ResponseCompressionRatio != nil }},
+		{"http_route_path_depth", WithRecordPathDepth(true), func(mc *MetricsCollection) bool { return mc.PathDepth != nil }},
+		{"http_response_flushes", WithRecordFlushCount(true), func(mc *MetricsCollection) bool { return mc.ResponseFlushes != nil }},
+		{"http_content_length_mismatches_total", WithDetectContentLengthMismatch(true), func(mc *MetricsCollection) bool { return mc.ContentLengthMismatches != nil }},
+		{"http_oversize_responses_total", WithResponseSizeCap(1024), func(mc *MetricsCollection) bool { return mc.OversizeResponses != nil }},
+		{"http_response_write_errors_total", WithTrackWriteErrors(true), func(mc *MetricsCollection) bool { return mc.ResponseWriteErrors != nil }},
+		{"http_request_queue_time_seconds", WithQueueTimeHeader("X-Request-Start"), func(mc *MetricsCollection) bool { return mc.QueueTime != nil }},
+		{"http_aborted_requests_total", WithRecordAborts(true), func(mc *MetricsCollection) bool { return mc.AbortedRequests != nil }},
+		{"http_request_cpu_seconds", WithRecordCPUTime(true), func(mc *MetricsCollection) bool { return mc.CPUTime != nil }},
+		{"http_duplicate_requests_total", WithDuplicateDetection("Idempotency-Key", time.Minute), func(mc *MetricsCollection) bool { return mc.DuplicateRequests != nil }},
+		{"ginprom_record_duration_seconds", WithSelfInstrumentation(true), func(mc *MetricsCollection) bool { return mc.MiddlewareOverhead != nil }},
+		{"http_requests_in_flight", WithConcurrencyLimit(map[string]int{"/slow": 1}), func(mc *MetricsCollection) bool { return mc.InFlightRequests != nil }},
+		{"http_requests_rejected_total", WithConcurrencyLimit(map[string]int{"/slow": 1}), func(mc *MetricsCollection) bool { return mc.RejectedRequests != nil }},
+		{"http_unmatched_requests_total", WithRecordUnmatched(true), func(mc *MetricsCollection) bool { return mc.UnmatchedRequests != nil }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.metric, func(t *testing.T) {
+			// A service's own metric of the same name does not clash until
+			// the option is used
+			reg := newTestRegistry()
+			reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: tc.metric, Help: "Owned by the service."}))
+			mc, err := NewMetricsCollectionE(WithCustomRegistry(reg))
+			if err != nil {
+				t.Fatalf("expected %s not to be registered by default, got %v", tc.metric, err)
+			}
+			MiddlewareWithMetrics(mc)
+			if tc.built(mc) {
+				t.Fatalf("expected %s not to be built without its option", tc.metric)
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Error("expected the middleware to panic on the clash")
+					}
+				}()
+				MiddlewareWithMetrics(mc, tc.option)
+			}()
+			if tc.built(mc) {
+				t.Errorf("expected %s to be left unset after the failed registration", tc.metric)
+			}
+
+			mc = newTestMetrics()
+			MiddlewareWithMetrics(mc, tc.option)
+			MiddlewareWithMetrics(mc, tc.option)
+			if !tc.built(mc) {
+				t.Errorf("expected %s to be built by its option", tc.metric)
+			}
+		})
+	}
+}
+
+func TestWithRecordGinErrors_DisabledByDefault(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/broken", func(c *gin.Context) {
+		_ = c.Error(fmt.Errorf("ignored"))
+		c.Status(http.StatusInternalServerError)
+	})
+
+	performRequest(r, "GET", "/broken")
+
+	if mf := gatherFamily(t, reg, "http_gin_errors_total"); mf != nil {
+		t.Errorf("expected no gin error series by default, got %v", mf)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// PathDepth
+// ---------------------------------------------------------------------------
+
+func TestPathDepth(t *testing.T) {
+	cases := map[string]int{
+		"/":                 0,
+		"/a":                1,
+		"/a/b/c":            3,
+		"/users/:id/posts/": 3,
+		"/static/*filepath": 2,
+	}
+	for route, want := range cases {
+		if got := pathDepth(route); got != want {
+			t.Errorf("pathDepth(%q) = %d, want %d", route, got, want)
+		}
+	}
+}
+
+func TestWithRecordPathDepth(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordPathDepth(true)))
+	r.GET("/a/b/c", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/a/b/c")
+	performRequest(r, "GET", "/not/a/route/at/all")
+
+	mf := gatherFamily(t, reg, "http_route_path_depth")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	h := mf.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() != 3 {
+		t.Errorf("expected a single observation of 3, got count=%d sum=%v", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithSelfInstrumentation
+// ---------------------------------------------------------------------------
+
+func TestWithSelfInstrumentation(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		mc, reg := newTestMetricsWithRegistry()
+		r := newStatusRouter(mc, WithSelfInstrumentation(enabled))
+		performRequest(r, "GET", "/ok")
+		performRequest(r, "GET", "/fail")
+
+		mf := gatherFamily(t, reg, "ginprom_record_duration_seconds")
+		if !enabled {
+			if mf != nil {
+				t.Errorf("expected no self-metric when disabled, got %v", mf)
+			}
+			continue
+		}
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected one self-metric series, got %v", mf)
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 2 || h.GetSampleSum() <= 0 {
+			t.Errorf("expected two positive observations, got count=%d sum=%v", h.GetSampleCount(), h.GetSampleSum())
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithErrorAwareSampling
+// ---------------------------------------------------------------------------
+
+func TestWithErrorAwareSampling(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc, WithErrorAwareSampling(0))
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	for _, name := range []string{"http_request_duration_seconds", "http_request_size_bytes", "http_response_size_bytes"} {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil || len(mf.GetMetric()) != 1 || labelValue(mf.GetMetric()[0], "status_code") != "500" {
+			t.Errorf("%s: expected only the 500 to be observed, got %v", name, mf)
+		}
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected both requests to be counted, got %v", mf)
+	}
+}
+
+func TestConfigSampled(t *testing.T) {
+	conf := applyOpt()
+	if !conf.sampled(http.StatusOK) {
+		t.Error("expected every request to be sampled by default")
+	}
+	conf = applyOpt(WithErrorAwareSampling(-1))
+	if conf.sampled(http.StatusOK) || conf.sampled(http.StatusFound) {
+		t.Error("expected no success to be sampled at rate 0")
+	}
+	if !conf.sampled(http.StatusNotFound) || !conf.sampled(http.StatusBadGateway) {
+		t.Error("expected errors to always be sampled")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithResponseSizeExemplars
+// ---------------------------------------------------------------------------
+
+func TestWithResponseSizeExemplars(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithResponseSizeExemplars(func(c *gin.Context) string {
+		return c.GetHeader("X-Trace-Id")
+	})))
+	r.GET("/big", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("x", 5000)) })
+
+	req, _ := http.NewRequest("GET", "/big", nil)
+	req.Header.Set("X-Trace-Id", "4bf92f3577b34da6a3ce929d0e0e4736")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	// Requests without a trace ID are observed without an exemplar
+	performRequest(r, "GET", "/big")
+
+	mf := gatherFamily(t, reg, "http_response_size_bytes")
+	if mf == nil {
+		t.Fatal("expected a response size series")
+	}
+	h := mf.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 2 {
+		t.Errorf("expected 2 observations, got %d", h.GetSampleCount())
+	}
+	var exemplars []string
+	for _, b := range h.GetBucket() {
+		if e := b.GetExemplar(); e != nil {
+			for _, l := range e.GetLabel() {
+				if l.GetName() == "trace_id" {
+					exemplars = append(exemplars, l.GetValue())
+				}
+			}
+			if e.GetValue() != 5000 {
+				t.Errorf("expected the exemplar to carry the size 5000, got %v", e.GetValue())
+			}
+		}
+	}
+	if len(exemplars) != 1 || exemplars[0] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected a single exemplar with the trace ID, got %v", exemplars)
+	}
+
+	if mf := gatherFamily(t, reg, "http_request_duration_seconds"); mf != nil {
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			if b.GetExemplar() != nil {
+				t.Error("expected no exemplar on the duration histogram")
+			}
+		}
+	}
+}
+
+func TestExemplarLabels(t *testing.T) {
+	if exemplarLabels("", "") != nil {
+		t.Error("expected no exemplar for an empty trace ID")
+	}
+	if exemplarLabels(strings.Repeat("a", 200), "") != nil {
+		t.Error("expected no exemplar for an oversized trace ID")
+	}
+	if exemplarLabels("\xff", "") != nil {
+		t.Error("expected no exemplar for an invalid UTF-8 trace ID")
+	}
+	if e := exemplarLabels("abc", ""); len(e) != 1 || e["trace_id"] != "abc" {
+		t.Errorf("expected a trace_id exemplar, got %v", e)
+	}
+	if e := exemplarLabels("", "req-1"); len(e) != 1 || e["request_id"] != "req-1" {
+		t.Errorf("expected a request_id exemplar, got %v", e)
+	}
+	if e := exemplarLabels(strings.Repeat("a", 100), strings.Repeat("b", 20)); len(e) != 1 || e["trace_id"] == "" {
+		t.Errorf("expected the request ID to be dropped when both do not fit, got %v", e)
+	}
+}
+
+func TestWithRequestIDExemplar(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithResponseSizeExemplars(func(c *gin.Context) string { return c.GetHeader("X-Trace-Id") }),
+		WithRequestIDExemplar("X-Request-ID"),
+	))
+	r.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "x") })
+	r.GET("/big", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("x", 5000)) })
+
+	req, _ := http.NewRequest("GET", "/big", nil)
+	req.Header.Set("X-Trace-Id", "4bf92f3577b34da6a3ce929d0e0e4736")
+	req.Header.Set("X-Request-ID", "req-42")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("GET", "/small", nil)
+	req.Header.Set("X-Trace-Id", "0af7651916cd43dd8448eb211c80319c")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_response_size_bytes")
+	if mf == nil {
+		t.Fatal("expected response size series")
+	}
+	exemplars := map[string]map[string]string{}
+	for _, m := range mf.GetMetric() {
+		for _, b := range m.GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				labels := map[string]string{}
+				for _, l := range e.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				exemplars[labelValue(m, "path")] = labels
+			}
+		}
+	}
+	if got := exemplars["/big"]; got["request_id"] != "req-42" || got["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the exemplar to carry the trace and request IDs, got %v", got)
+	}
+	if got := exemplars["/small"]; got["trace_id"] == "" || len(got) != 1 {
+		t.Errorf("expected no request_id without the header, got %v", got)
+	}
+}
+
+func TestWithExemplarPolicy(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithClock(clock.Now),
+		WithRequestIDExemplar("X-Request-ID"),
+		WithExemplarPolicy(func(_ int, d time.Duration) bool { return d > time.Second }),
+	))
+	r.GET("/fast", func(c *gin.Context) {
+		clock.Advance(100 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	r.GET("/slow", func(c *gin.Context) {
+		clock.Advance(3 * time.Second)
+		c.Status(http.StatusOK)
+	})
+
+	for _, p := range []string{"/fast", "/slow"} {
+		req, _ := http.NewRequest("GET", p, nil)
+		req.Header.Set("X-Request-ID", "req"+p)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil {
+		t.Fatal("expected duration series")
+	}
+	exemplars := map[string][]string{}
+	for _, m := range mf.GetMetric() {
+		for _, b := range m.GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				for _, l := range e.GetLabel() {
+					exemplars[labelValue(m, "path")] = append(exemplars[labelValue(m, "path")], l.GetValue())
+				}
+				if e.GetValue() != 3 {
+					t.Errorf("expected the exemplar to carry the duration 3s, got %v", e.GetValue())
+				}
+			}
+		}
+	}
+	if got := exemplars["/slow"]; len(got) != 1 || got[0] != "req/slow" {
+		t.Errorf("expected one exemplar for the slow request, got %v", got)
+	}
+	if got := exemplars["/fast"]; got != nil {
+		t.Errorf("expected no exemplar for the fast request, got %v", got)
+	}
+}
+
+func TestWithExemplarPolicy_TraceIDWithoutSizeExemplars(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithExemplarTraceID(func(c *gin.Context) string { return c.GetHeader("X-Trace-Id") }),
+		WithExemplarPolicy(func(status int, _ time.Duration) bool { return status >= 500 }),
+	))
+	r.GET("/fail", func(c *gin.Context) { c.String(http.StatusInternalServerError, strings.Repeat("x", 5000)) })
+
+	req, _ := http.NewRequest("GET", "/fail", nil)
+	req.Header.Set("X-Trace-Id", "4bf92f3577b34da6a3ce929d0e0e4736")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	exemplarTraces := func(name string) []string {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil {
+			t.Fatalf("expected %s to be recorded", name)
+		}
+		var traces []string
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				for _, l := range e.GetLabel() {
+					traces = append(traces, l.GetValue())
+				}
+			}
+		}
+		return traces
+	}
+	if got := exemplarTraces("http_request_duration_seconds"); len(got) != 1 || got[0] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected a duration exemplar with the trace ID, got %v", got)
+	}
+	if got := exemplarTraces("http_response_size_bytes"); got != nil {
+		t.Errorf("expected no response size exemplar, got %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithClock
+// ---------------------------------------------------------------------------
+
+// fakeClock is a manually advanced clock for deterministic durations.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.now }
+
+func (f *fakeClock) Advance(d time.Duration) { f.now = f.now.Add(d) }
+
+func TestWithClock_DeterministicDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithClock(clock.Now)))
+	r.GET("/work", func(c *gin.Context) {
+		clock.Advance(250 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+
+	performRequest(r, "GET", "/work")
+
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil {
+		t.Fatal("expected http_request_duration_seconds to be exported")
+	}
+	if got := mf.GetMetric()[0].GetHistogram().GetSampleSum(); got != 0.25 {
+		t.Errorf("expected an observed duration of 0.25s, got %v", got)
+	}
+}
+
+func TestWithClock_NilIgnored(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithClock(nil)))
+	r.GET("/work", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/work")
+
+	if mf := gatherFamily(t, reg, "http_request_duration_seconds"); mf == nil {
+		t.Error("expected the request to be timed with the default clock")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithDurationObserver
+// ---------------------------------------------------------------------------
+
+func TestWithDurationObserver(t *testing.T) {
+	type observation struct {
+		route, method string
+		status        int
+		d             time.Duration
+	}
+	var got []observation
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithClock(clock.Now),
+		WithDurationObserver(func(route, method string, status int, d time.Duration) {
+			got = append(got, observation{route, method, status, d})
+		}),
+	))
+	r.POST("/users/:id", func(c *gin.Context) {
+		clock.Advance(120 * time.Millisecond)
+		c.Status(http.StatusAccepted)
+	})
+	performRequest(r, "POST", "/users/7")
+
+	want := observation{"/users/:id", "POST", http.StatusAccepted, 120 * time.Millisecond}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if mf := gatherFamily(t, reg, "http_request_duration_seconds"); mf == nil || mf.GetMetric()[0].GetHistogram().GetSampleSum() != 0.12 {
+		t.Errorf("expected the histogram to be observed as well, got %v", mf)
+	}
+}
+
+func TestWithDurationObserver_PanicIsolated(t *testing.T) {
+	var buf bytes.Buffer
+	mc, reg := newTestMetricsWithRegistry()
+	r := newStatusRouter(mc,
+		withTestLogger(&buf),
+		WithDurationObserver(func(string, string, int, time.Duration) { panic("sink down") }),
+	)
+	w := performRequest(r, "GET", "/ok")
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the request to succeed, got %d", w.Code)
+	}
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf == nil {
+		t.Error("expected the request to be recorded")
+	}
+	if !strings.Contains(buf.String(), "sink down") {
+		t.Errorf("expected the panic to be logged, got %q", buf.String())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithStatusTextLabel
+// ---------------------------------------------------------------------------
+
+func TestWithStatusTextLabel(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithStatusTextLabel(true)))
+	r.GET("/status/:code", func(c *gin.Context) {
+		code, _ := strconv.Atoi(c.Param("code"))
+		c.Status(code)
+	})
+
+	for _, code := range []string{"200", "404", "799"} {
+		performRequest(r, "GET", "/status/"+code)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "status_code")] = true
+	}
+	for _, want := range []string{"OK", "Not Found", "799"} {
+		if !got[want] {
+			t.Errorf("expected status_code %q, got %v", want, got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithStatusFromHeader
+// ---------------------------------------------------------------------------
+
+func TestWithStatusFromHeader(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithStatusFromHeader("X-Upstream-Status")))
+	r.GET("/proxied", func(c *gin.Context) {
+		c.Header("X-Upstream-Status", "503")
+		c.Status(http.StatusOK)
+	})
+	r.GET("/invalid", func(c *gin.Context) {
+		c.Header("X-Upstream-Status", "oops")
+		c.Status(http.StatusOK)
+	})
+	r.GET("/absent", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, p := range []string{"/proxied", "/invalid", "/absent"} {
+		performRequest(r, "GET", p)
+	}
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil {
+		t.Fatal("expected http_requests_total to be recorded")
+	}
+	want := map[string]string{"/proxied": "503", "/invalid": "200", "/absent": "200"}
+	for _, m := range mf.GetMetric() {
+		path := labelValue(m, "path")
+		if got := labelValue(m, "status_code"); got != want[path] {
+			t.Errorf("%s: expected status_code %q, got %q", path, want[path], got)
+		}
+	}
+	if len(mf.GetMetric()) != len(want) {
+		t.Errorf("expected %d series, got %d", len(want), len(mf.GetMetric()))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithTimeoutStatusDetection
+// ---------------------------------------------------------------------------
+
+func TestWithTimeoutStatusDetection(t *testing.T) {
+	statusFor := func(opts ...Option) (sent int, recorded string) {
+		mc, reg := newTestMetricsWithRegistry()
+		done := make(chan struct{})
+		r := gin.New()
+		// Registered first so that it returns once the request was recorded
+		r.Use(func(c *gin.Context) {
+			defer close(done)
+			c.Next()
+		})
+		r.Use(MiddlewareWithMetrics(mc, opts...))
+		r.GET("/slow", func(c *gin.Context) {
+			<-c.Request.Context().Done()
+			c.String(http.StatusOK, "too late")
+		})
+
+		w := httptest.NewRecorder()
+		http.TimeoutHandler(r, 10*time.Millisecond, "timeout").ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		<-done
+
+		mf := gatherFamily(t, reg, "http_requests_total")
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected one series, got %v", mf)
+		}
+		return w.Code, labelValue(mf.GetMetric()[0], "status_code")
+	}
+
+	sent, recorded := statusFor(WithTimeoutStatusDetection(true))
+	if sent != http.StatusServiceUnavailable || recorded != "503" {
+		t.Errorf("expected 503 to be sent and recorded, got sent=%d recorded=%q", sent, recorded)
+	}
+	if _, recorded := statusFor(); recorded != "200" {
+		t.Errorf("expected the writer status by default, got %q", recorded)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithSLOBuckets
+// ---------------------------------------------------------------------------
+
+func TestWithSLOBuckets_ContainsObjectives(t *testing.T) {
+	objectives := []float64{0.3, 0.1, 0.3, 1}
+	mc, _ := newTestMetricsWithRegistry(WithSLOBuckets(objectives...))
+
+	set := map[float64]bool{}
+	for i, b := range mc.durationBuckets {
+		if i > 0 && b <= mc.durationBuckets[i-1] {
+			t.Fatalf("buckets not strictly increasing: %v", mc.durationBuckets)
+		}
+		set[b] = true
+	}
+	for _, o := range objectives {
+		if !set[o] || !set[o/2] || !set[o*2] {
+			t.Errorf("expected %v and its neighbours in %v", o, mc.durationBuckets)
+		}
+	}
+}
+
+func TestWithSLOBuckets_InvalidObjective(t *testing.T) {
+	for _, objectives := range [][]float64{nil, {0.3, 0}, {-1}} {
+		_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithSLOBuckets(objectives...))
+		if err == nil {
+			t.Errorf("expected an error for objectives %v", objectives)
+		}
+	}
+}
+
+func TestWithHistogramOpts(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithMetricPrefix("ignored"),
+		WithDurationHistogramOpts(prometheus.HistogramOpts{
+			Name:        "custom_latency_seconds",
+			Help:        "Custom latency.",
+			ConstLabels: prometheus.Labels{"service": "api"},
+			Buckets:     []float64{0.1, 1},
+		}),
+		WithResponseSizeHistogramOpts(prometheus.HistogramOpts{
+			Name:    "custom_response_bytes",
+			Help:    "Custom response size.",
+			Buckets: []float64{10},
+		}),
+	)
+
+	descs := make(chan *prometheus.Desc, 1)
+	mc.Duration.Describe(descs)
+	want := prometheus.NewDesc("custom_latency_seconds", "Custom latency.",
+		[]string{"status_code", "method", "path"}, prometheus.Labels{"service": "api"})
+	if got := (<-descs).String(); got != want.String() {
+		t.Errorf("expected descriptor %s, got %s", want, got)
+	}
+
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+	mf := gatherFamily(t, reg, "custom_latency_seconds")
+	if mf == nil {
+		t.Fatal("expected the custom duration histogram")
+	}
+	if got := len(mf.GetMetric()[0].GetHistogram().GetBucket()); got != 2 {
+		t.Errorf("expected the 2 custom buckets, got %d", got)
+	}
+	if gatherFamily(t, reg, "custom_response_bytes") == nil {
+		t.Error("expected the custom response-size histogram")
+	}
+	if gatherFamily(t, reg, "ignored_http_request_size_bytes") == nil {
+		t.Error("expected the request-size histogram to keep its defaults")
+	}
+
+	_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()),
+		WithRequestSizeHistogramOpts(prometheus.HistogramOpts{Name: "x", Help: "x"}),
+		WithRequestSizeSummary(nil, 0))
+	if err == nil {
+		t.Error("expected an error combining histogram opts with a summary")
+	}
+}
+
+func TestWithSizeBucketPresets(t *testing.T) {
+	large, _ := newTestMetricsWithRegistry(WithLargeResponseBuckets())
+	if top := large.sizeBuckets[len(large.sizeBuckets)-1]; top <= 1e8 {
+		t.Errorf("expected the large preset to reach beyond 1e8 bytes, got %v", top)
+	}
+	small, _ := newTestMetricsWithRegistry(WithSmallResponseBuckets())
+	if top := small.sizeBuckets[len(small.sizeBuckets)-1]; top >= DefaultSizeBuckets[len(DefaultSizeBuckets)-1] {
+		t.Errorf("expected the small preset to stop below the default buckets, got %v", top)
+	}
+	if fmt.Sprint(large.durationBuckets) != fmt.Sprint(DefaultDurationBuckets) {
+		t.Error("expected the presets to leave the duration buckets alone")
+	}
+}
+
+func TestWithBucketsString(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry(
+		WithDurationBucketsString("0.005, 0.01,0.025 ,0.05"),
+		WithSizeBucketsString("100,1000,1e4"),
+	)
+	if got, want := fmt.Sprint(mc.durationBuckets), "[0.005 0.01 0.025 0.05]"; got != want {
+		t.Errorf("expected duration buckets %s, got %s", want, got)
+	}
+	if got, want := fmt.Sprint(mc.sizeBuckets), "[100 1000 10000]"; got != want {
+		t.Errorf("expected size buckets %s, got %s", want, got)
+	}
+}
+
+func TestWithBucketsString_Malformed(t *testing.T) {
+	for _, s := range []string{"", "0.1,abc", "0.1,,0.2", "0.5,0.1", "0.1,0.1", "NaN"} {
+		for _, opt := range []MetricsOption{WithDurationBucketsString(s), WithSizeBucketsString(s)} {
+			if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), opt); err == nil {
+				t.Errorf("expected an error for buckets %q", s)
+			}
+		}
+	}
+
+	_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithDurationBucketsString("0.1,abc"))
+	if err == nil || !strings.Contains(err.Error(), `"abc"`) {
+		t.Errorf("expected the error to name the malformed value, got %v", err)
+	}
+}
+
+func TestBucketGenerators_InvalidArguments(t *testing.T) {
+	for name, opt := range map[string]MetricsOption{
+		"linear count":       WithLinearDurationBuckets(0.1, 0.1, 0),
+		"linear width":       WithLinearDurationBuckets(0.1, 0, 5),
+		"exponential count":  WithExponentialSizeBuckets(100, 2, 0),
+		"exponential start":  WithExponentialSizeBuckets(0, 2, 5),
+		"exponential factor": WithExponentialSizeBuckets(100, 1, 5),
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: expected an error, got a panic: %v", name, r)
+				}
+			}()
+			if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), opt); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}()
+	}
+}
+
+func TestWithCustomBuckets_Unsorted(t *testing.T) {
+	_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()),
+		WithCustomBuckets([]float64{0.1, 1, 0.5}, []float64{100, 1000}))
+	if err == nil || !strings.Contains(err.Error(), "duration buckets") || !strings.Contains(err.Error(), "position 3") {
+		t.Errorf("expected an error naming the unsorted duration bucket, got %v", err)
+	}
+
+	_, err = NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()),
+		WithCustomBuckets([]float64{0.1, 1}, []float64{100, math.NaN()}))
+	if err == nil || !strings.Contains(err.Error(), "size buckets") {
+		t.Errorf("expected an error for a NaN size bucket, got %v", err)
+	}
+}
+
+func TestWithCustomBuckets_Valid(t *testing.T) {
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()),
+		WithCustomBuckets([]float64{0.1, 0.5, 1}, []float64{100, 1000, math.Inf(1)})); err != nil {
+		t.Errorf("unexpected error for valid buckets: %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Metric name validation
+// ---------------------------------------------------------------------------
+
+func TestWithMetricPrefix_ValidKeepsTotalSuffix(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithMetricPrefix("my_service"))
+	r := newStatusRouter(mc)
+	performRequest(r, "GET", "/ok")
+
+	if mf := gatherFamily(t, reg, "my_service_http_requests_total"); mf == nil {
+		t.Error("expected the prefixed counter to keep its _total suffix")
+	}
+}
+
+func TestWithMetricPrefix_Invalid(t *testing.T) {
+	_, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithMetricPrefix("my-service"), WithMetricPrefixStrict(true))
+	if err == nil {
+		t.Fatal("expected an error for a prefix containing a dash")
+	}
+	if !strings.Contains(err.Error(), "my-service_http_requests_total") {
+		t.Errorf("expected the error to name the offending metric, got %q", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewMetricsCollection to panic on an invalid prefix")
+		}
+	}()
+	NewMetricsCollection(WithCustomRegistry(prometheus.NewRegistry()), WithMetricPrefix("1service"), WithMetricPrefixStrict(true))
+}
+
+func TestWithMetricPrefix_Sanitized(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithMetricPrefix("my-app"))
+	r := newStatusRouter(mc)
+	performRequest(r, "GET", "/ok")
+
+	if mf := gatherFamily(t, reg, "my_app_http_requests_total"); mf == nil {
+		t.Error("expected the prefix my-app to be sanitized to my_app")
+	}
+}
+
+func TestSanitizePrefix(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"my-app":   "my_app",
+		"My App":   "my_app",
+		"1service": "_1service",
+		"api.v2":   "api_v2",
+		"MyApp":    "MyApp",
+		"ns:sub":   "ns:sub",
+	}
+	for prefix, want := range cases {
+		if got := sanitizePrefix(prefix); got != want {
+			t.Errorf("sanitizePrefix(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithStatusCodeMapper
+// ---------------------------------------------------------------------------
+
+func TestWithStatusCodeMapper(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	mapper := func(code int) string {
+		if code == http.StatusUnauthorized || code == http.StatusForbidden {
+			return "auth_error"
+		}
+		return strconv.Itoa(code)
+	}
+	r := gin.New()
+	// The mapper wins over the aggregate option
+	r.Use(MiddlewareWithMetrics(mc, WithAggregateStatusCode(true), WithStatusCodeMapper(mapper)))
+	r.GET("/secret", func(c *gin.Context) { c.Status(http.StatusForbidden) })
+	performRequest(r, "GET", "/secret")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "auth_error" {
+		t.Errorf("expected status_code %q, got %q", "auth_error", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithQueueTimeHeader
+// ---------------------------------------------------------------------------
+
+func TestQueueTime_Units(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	arrived := now.Add(-250 * time.Millisecond)
+	cases := []string{
+		"t=" + strconv.FormatFloat(float64(arrived.UnixNano())/1e9, 'f', 3, 64),
+		strconv.FormatInt(arrived.UnixMilli(), 10),
+		"t=" + strconv.FormatInt(arrived.UnixMicro(), 10),
+		strconv.FormatInt(arrived.UnixNano(), 10),
+	}
+	for _, header := range cases {
+		got, ok := queueTime(header, now)
+		if !ok || got < 249*time.Millisecond || got > 251*time.Millisecond {
+			t.Errorf("%q: expected ~250ms, got %v (ok=%v)", header, got, ok)
+		}
+	}
+	for _, header := range []string{"", "t=soon", "-5", strconv.FormatInt(now.Add(time.Minute).UnixMilli(), 10)} {
+		if _, ok := queueTime(header, now); ok {
+			t.Errorf("%q: expected the value to be rejected", header)
+		}
+	}
+}
+
+func TestWithQueueTimeHeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithQueueTimeHeader("X-Request-Start"), WithClock(clock.Now)))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req, _ := http.NewRequest("GET", "/items", nil)
+	req.Header.Set("X-Request-Start", "t="+strconv.FormatInt(clock.now.Add(-2*time.Second).UnixMilli(), 10))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	malformed, _ := http.NewRequest("GET", "/items", nil)
+	malformed.Header.Set("X-Request-Start", "garbage")
+	r.ServeHTTP(httptest.NewRecorder(), malformed)
+
+	mf := gatherFamily(t, reg, "http_request_queue_time_seconds")
+	if mf == nil {
+		t.Fatal("expected the queue time to be recorded")
+	}
+	h := mf.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() != 2 {
+		t.Errorf("expected one 2s observation, got count=%d sum=%v", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithResponseSizeFromHeaderFallback
+// ---------------------------------------------------------------------------
+
+func TestWithResponseSizeFromHeaderFallback(t *testing.T) {
+	sizeFor := func(options ...Option) float64 {
+		mc, reg := newTestMetricsWithRegistry()
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, options...))
+		// Like a sendfile download: the length is announced but the writer
+		// sees no bytes
+		r.GET("/download", func(c *gin.Context) {
+			c.Header("Content-Length", "1048576")
+			c.Writer.WriteHeaderNow()
+		})
+		performRequest(r, "GET", "/download")
+
+		mf := gatherFamily(t, reg, "http_response_size_bytes")
+		if mf == nil {
+			t.Fatal("expected the response size to be recorded")
+		}
+		return mf.GetMetric()[0].GetHistogram().GetSampleSum()
+	}
+
+	if got := sizeFor(); got != 0 {
+		t.Errorf("expected the writer size by default, got %v", got)
+	}
+	if got := sizeFor(WithResponseSizeFromHeaderFallback(true)); got != 1048576 {
+		t.Errorf("expected the Content-Length fallback, got %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithResponseSizeCap
+// ---------------------------------------------------------------------------
+
+func TestWithResponseSizeCap(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithResponseSizeCap(1000)))
+	r.GET("/huge", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("x", 5000)) })
+	r.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("x", 10)) })
+	performRequest(r, "GET", "/huge")
+	performRequest(r, "GET", "/small")
+
+	mf := gatherFamily(t, reg, "http_response_size_bytes")
+	if mf == nil {
+		t.Fatal("expected the response size to be recorded")
+	}
+	sums := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		sums[labelValue(m, "path")] = m.GetHistogram().GetSampleSum()
+	}
+	if sums["/huge"] != 1000 || sums["/small"] != 10 {
+		t.Errorf("expected the huge response to be capped at 1000, got %v", sums)
+	}
+
+	mf = gatherFamily(t, reg, "http_oversize_responses_total")
+	if mf == nil || len(mf.GetMetric()) != 1 || labelValue(mf.GetMetric()[0], "path") != "/huge" || mf.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("expected one oversize response on /huge, got %v", mf)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Help text options
+// ---------------------------------------------------------------------------
+
+func TestHelpTextOptions(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithCounterHelp("Requests served by the catalog API."),
+		WithDurationHelp("Catalog API latency."),
+		WithRequestSizeHelp("Catalog API request size."),
+		WithResponseSizeHelp("Catalog API response size."),
+	)
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+
+	want := map[string]string{
+		"http_requests_total":           "Requests served by the catalog API.",
+		"http_request_duration_seconds": "Catalog API latency.",
+		"http_request_size_bytes":       "Catalog API request size.",
+		"http_response_size_bytes":      "Catalog API response size.",
+	}
+	for name, help := range want {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil {
+			t.Fatalf("%s: expected the metric to be recorded", name)
+		}
+		if mf.GetHelp() != help {
+			t.Errorf("%s: expected help %q, got %q", name, help, mf.GetHelp())
+		}
+	}
+}
+
+func TestHelpTextDefaults(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+
+	if mf := gatherFamily(t, reg, "http_requests_total"); mf == nil || mf.GetHelp() != "Number of requests." {
+		t.Errorf("expected the default counter help, got %v", mf)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Failed metric updates
+// ---------------------------------------------------------------------------
+
+func TestFailingVec_CountedInsteadOfPanicking(t *testing.T) {
+	// A counter with a label set the middleware cannot fill, swapped in after
+	// construction since WithCustomRequestCounter rejects it
+	broken := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "broken_requests_total"}, []string{"only_one"})
+	mc, reg := newTestMetricsWithRegistry()
+	mc.TotalRequests = broken
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("expected no panic, got %v", r)
+			}
+		}()
+		performRequest(newStatusRouter(mc), "GET", "/ok")
+	}()
+
+	mf := gatherFamily(t, reg, "ginprom_metric_errors_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one error series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "metric") != "http_requests_total" || m.GetCounter().GetValue() != 1 {
+		t.Errorf("expected one error for http_requests_total, got %v", m)
+	}
+	if gatherFamily(t, reg, "http_request_duration_seconds") == nil {
+		t.Error("expected the other metrics to be recorded")
+	}
+}
+
+func TestFailingAuxiliaryVecs_CountedInsteadOfPanicking(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	broken := []string{"a", "b", "c"}
+	mc.QueueTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "broken_queue_time"}, broken)
+	mc.UnmatchedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "broken_unmatched_total"}, broken)
+	mc.RejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "broken_rejected_total"}, broken)
+	mc.InFlightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "broken_in_flight"}, broken)
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithQueueTimeHeader("X-Request-Start"),
+		WithConcurrencyLimit(map[string]int{"/ok": 1}),
+		WithRecordUnmatched(true),
+	))
+	r.GET("/ok", func(c *gin.Context) {
+		// A second request while this one holds the only slot is rejected
+		if c.Query("nested") == "" {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok?nested=1", nil))
+		}
+		c.Status(http.StatusOK)
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("expected no panic, got %v", r)
+			}
+		}()
+		req, _ := http.NewRequest("GET", "/ok", nil)
+		req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		performRequest(r, "GET", "/missing")
+	}()
+
+	mf := gatherFamily(t, reg, "ginprom_metric_errors_total")
+	if mf == nil {
+		t.Fatal("expected failed updates to be counted")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "metric")] = m.GetCounter().GetValue()
+	}
+	for _, name := range []string{"http_request_queue_time_seconds", "http_unmatched_requests_total", "http_requests_rejected_total", "http_requests_in_flight"} {
+		if got[name] != 1 {
+			t.Errorf("expected one failed update of %s, got %v", name, got[name])
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Skip
+// ---------------------------------------------------------------------------
+
+func TestSkip_NoSeries(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/probe", func(c *gin.Context) {
+		Skip(c)
+		c.Status(http.StatusOK)
+	})
+	r.NoRoute(func(c *gin.Context) {
+		c.Set(SkipContextKey, true)
+		c.Status(http.StatusNotFound)
+	})
+
+	performRequest(r, "GET", "/probe")
+	performRequest(r, "GET", "/missing")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, mf := range families {
+		if len(mf.GetMetric()) > 0 {
+			t.Errorf("expected no series for skipped requests, got %s", mf.GetName())
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithStandardRuntimeMetrics
+// ---------------------------------------------------------------------------
+
+func TestWithStandardRuntimeMetrics(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithStandardRuntimeMetrics())
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+
+	for _, name := range []string{"go_goroutines", "http_requests_total"} {
+		if gatherFamily(t, reg, name) == nil {
+			t.Errorf("expected %s to be exported", name)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithZeroStatusAs
+// ---------------------------------------------------------------------------
+
+// zeroStatusWriter reports a status of 0 until something is written, like
+// some third-party writers do.
+type zeroStatusWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *zeroStatusWriter) Status() int {
+	if !w.Written() {
+		return 0
+	}
+	return w.ResponseWriter.Status()
+}
+
+func TestWithZeroStatusAs(t *testing.T) {
+	statusFor := func(options ...Option) string {
+		mc, reg := newTestMetricsWithRegistry()
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, options...))
+		r.Use(func(c *gin.Context) {
+			c.Writer = &zeroStatusWriter{ResponseWriter: c.Writer}
+		})
+		// Returns without calling any write method
+		r.GET("/noop", func(c *gin.Context) {})
+		performRequest(r, "GET", "/noop")
+
+		mf := gatherFamily(t, reg, "http_requests_total")
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected exactly one series, got %v", mf)
+		}
+		return labelValue(mf.GetMetric()[0], "status_code")
+	}
+
+	if got := statusFor(); got != "200" {
+		t.Errorf("expected a zero status to be recorded as 200, got %q", got)
+	}
+	if got := statusFor(WithZeroStatusAs(http.StatusNoContent)); got != "204" {
+		t.Errorf("expected a zero status to be recorded as 204, got %q", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithIgnorePathPrefixes
+// ---------------------------------------------------------------------------
+
+func TestWithIgnorePathPrefixes(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	// Applied before WithFilterRoutes, which must not replace it
+	r.Use(MiddlewareWithMetrics(mc,
+		WithIgnorePathPrefixes([]string{"/debug/", "/swagger/"}),
+		WithFilterRoutes([]string{"/healthz"}),
+	))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/debug/pprof/:profile", ok)
+	r.GET("/healthz", ok)
+	r.GET("/api", ok)
+
+	performRequest(r, "GET", "/debug/pprof/heap")
+	performRequest(r, "GET", "/healthz")
+	performRequest(r, "GET", "/api")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "path"); got != "/api" {
+		t.Errorf("expected only /api to be recorded, got %q", got)
+	}
+}
+
+func TestWithCommonHealthFilters(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithCommonHealthFilters(),
+		WithIgnorePathPrefixes([]string{"/debug/"}),
+	))
+	ready := http.StatusOK
+	r.GET("/readyz", func(c *gin.Context) { c.Status(ready) })
+	r.GET("/debug/vars", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/api", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/readyz")
+	performRequest(r, "GET", "/debug/vars")
+	performRequest(r, "GET", "/api")
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "path"); got != "/api" {
+		t.Errorf("expected only /api to be recorded, got %q", got)
+	}
+
+	// Failing probes stay visible
+	ready = http.StatusServiceUnavailable
+	performRequest(r, "GET", "/readyz")
+	mf = gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected the failing /readyz to be recorded, got %v", mf)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithDefaultRegistry
+// ---------------------------------------------------------------------------
+
+func TestWithDefaultRegistry(t *testing.T) {
+	custom := prometheus.NewRegistry()
+	mc := NewMetricsCollection(
+		WithCustomRegistry(custom),
+		WithDefaultRegistry(),
+		WithMetricPrefix("default_registry_test"),
+	)
+	defer func() {
+		for _, c := range mc.collectors() {
+			prometheus.DefaultRegisterer.Unregister(c)
+		}
+	}()
+	if mc.Registry != nil {
+		t.Fatal("expected WithDefaultRegistry to clear the custom registry")
+	}
+
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+
+	if gatherFamily(t, prometheus.DefaultGatherer, "default_registry_test_http_requests_total") == nil {
+		t.Error("expected the metrics on the default registry")
+	}
+	if gatherFamily(t, custom, "default_registry_test_http_requests_total") != nil {
+		t.Error("expected nothing on the custom registry")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithAdditionalRegistry
+// ---------------------------------------------------------------------------
+
+func TestWithAdditionalRegistry(t *testing.T) {
+	tenant := prometheus.NewRegistry()
+	mc, reg := newTestMetricsWithRegistry(WithAdditionalRegistry(tenant))
+	r := newStatusRouter(mc)
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	for _, path := range []string{"/ok", "/fail"} {
+		var counts [2]float64
+		for i, g := range []prometheus.Gatherer{reg, tenant} {
+			mf := gatherFamily(t, g, "http_requests_total")
+			if mf == nil {
+				t.Fatalf("expected http_requests_total on registry %d", i)
+			}
+			for _, m := range mf.GetMetric() {
+				if labelValue(m, "path") == path {
+					counts[i] = m.GetCounter().GetValue()
+				}
+			}
+		}
+		if counts[0] == 0 || counts[0] != counts[1] {
+			t.Errorf("path %s: expected identical non-zero counts, got %v and %v", path, counts[0], counts[1])
+		}
+	}
+}
+
+func TestWithAdditionalRegistry_ConflictUnregisters(t *testing.T) {
+	tenant := prometheus.NewRegistry()
+	tenant.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "http_requests_total", Help: "taken"}))
+	reg := prometheus.NewRegistry()
+
+	_, err := NewMetricsCollectionE(WithCustomRegistry(reg), WithAdditionalRegistry(tenant))
+	if err == nil {
+		t.Fatal("expected an error for a conflicting additional registry")
+	}
+	mfs, _ := reg.Gather()
+	if len(mfs) != 0 {
+		t.Errorf("expected the primary registry to be cleaned up, got %d families", len(mfs))
+	}
+	if _, err := NewMetricsCollectionE(WithAdditionalRegistry(nil)); err == nil {
+		t.Error("expected an error for a nil registry")
+	}
+}
+
+func TestWithAdditionalRegistry_ConflictUnregistersRuntimeCollectors(t *testing.T) {
+	tenant := prometheus.NewRegistry()
+	tenant.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "http_requests_total", Help: "taken"}))
+	reg := prometheus.NewRegistry()
+
+	_, err := NewMetricsCollectionE(WithCustomRegistry(reg), WithAdditionalRegistry(tenant), WithStandardRuntimeMetrics())
+	if err == nil {
+		t.Fatal("expected an error for a conflicting additional registry")
+	}
+	if mfs, _ := reg.Gather(); len(mfs) != 0 {
+		t.Errorf("expected the runtime collectors to be unregistered too, got %d families", len(mfs))
+	}
+
+	// A retry with the conflict resolved must not trip over leftovers
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(reg), WithAdditionalRegistry(prometheus.NewRegistry()), WithStandardRuntimeMetrics()); err != nil {
+		t.Errorf("expected the retry to succeed, got %v", err)
+	}
+}
+
+func TestWithStandardRuntimeMetrics_RollbackKeepsExistingCollectors(t *testing.T) {
+	tenant := prometheus.NewRegistry()
+	tenant.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "http_requests_total", Help: "taken"}))
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector())
+
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(reg), WithAdditionalRegistry(tenant), WithStandardRuntimeMetrics()); err == nil {
+		t.Fatal("expected an error for a conflicting additional registry")
+	}
+	if gatherFamily(t, reg, "go_goroutines") == nil {
+		t.Error("expected the Go collector registered beforehand to stay")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithSplitDurationByOutcome
+// ---------------------------------------------------------------------------
+
+func TestWithSplitDurationByOutcome(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithSplitDurationByOutcome(true))
+	r := newStatusRouter(mc)
+	performRequest(r, "GET", "/ok")
+	performRequest(r, "GET", "/fail")
+
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()) != 2 {
+		t.Fatalf("expected two duration series, got %v", mf)
+	}
+	want := map[string]string{"200": "success", "500": "error"}
+	for _, m := range mf.GetMetric() {
+		status := labelValue(m, "status_code")
+		if got := labelValue(m, "outcome"); got != want[status] {
+			t.Errorf("status %s: expected outcome %q, got %q", status, want[status], got)
+		}
+	}
+
+	// The other metrics keep their label set
+	if mf := gatherFamily(t, reg, "http_requests_total"); labelValue(mf.GetMetric()[0], "outcome") != "" {
+		t.Error("expected no outcome label on http_requests_total")
+	}
+}
+
+func TestWithOutcomeErrorThreshold(t *testing.T) {
+	mc := &MetricsCollection{}
+	WithOutcomeErrorThreshold(http.StatusBadRequest)(mc)
+	if got := mc.outcome(http.StatusNotFound); got != "error" {
+		t.Errorf("expected 404 to be an error with a 400 threshold, got %q", got)
+	}
+	if got := mc.outcome(http.StatusOK); got != "success" {
+		t.Errorf("expected 200 to be a success, got %q", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithRecordAborts
+// ---------------------------------------------------------------------------
+
+func TestWithRecordAborts(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordAborts(true)))
+	r.Use(func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+		}
+	})
+	r.GET("/private", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/private")
+	req, _ := http.NewRequest("GET", "/private", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_aborted_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one aborted series, got %v", mf)
+	}
+	if got := mf.GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("expected one aborted request, got %v", got)
+	}
+
+	mf = gatherFamily(t, reg, "http_requests_total")
+	var unauthorized bool
+	for _, m := range mf.GetMetric() {
+		unauthorized = unauthorized || labelValue(m, "status_code") == "401"
+	}
+	if !unauthorized {
+		t.Error("expected the aborted request to be recorded with its 401 status")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithUpgradeHandling
+// ---------------------------------------------------------------------------
+
+// performUpgradeRequest sends a request asking for a WebSocket upgrade to a
+// handler that answers with a plain 400, as when the handshake is refused.
+func performUpgradeRequest(mc *MetricsCollection, opts ...Option) {
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, opts...))
+	r.GET("/ws", func(c *gin.Context) {
+		c.String(http.StatusBadRequest, "not a websocket handshake")
+	})
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestWithUpgradeHandling_Skip(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performUpgradeRequest(mc, WithUpgradeHandling(UpgradeSkip))
+
+	for _, name := range []string{"http_request_size_bytes", "http_response_size_bytes", "http_request_duration_seconds"} {
+		if mf := gatherFamily(t, reg, name); mf != nil {
+			t.Errorf("%s: expected no series for an upgrade request, got %v", name, mf)
+		}
+	}
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected the upgrade request to be counted, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "400" {
+		t.Errorf("expected status_code %q, got %q", "400", got)
+	}
+}
+
+func TestWithUpgradeHandling_Label(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performUpgradeRequest(mc, WithUpgradeHandling(UpgradeLabel))
+
+	for _, name := range []string{"http_request_size_bytes", "http_response_size_bytes"} {
+		if mf := gatherFamily(t, reg, name); mf != nil {
+			t.Errorf("%s: expected no series for an upgrade request, got %v", name, mf)
+		}
+	}
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one duration series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "upgrade" {
+		t.Errorf("expected status_code %q, got %q", "upgrade", got)
+	}
+}
+
+func TestWithUpgradeHandling_DefaultRecords(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performUpgradeRequest(mc)
+
+	if mf := gatherFamily(t, reg, "http_response_size_bytes"); mf == nil {
+		t.Error("expected upgrade requests to be recorded by default")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Close
+// ---------------------------------------------------------------------------
+
+func TestMetricsCollectionClose_Idempotent(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	if err := mc.Close(context.Background()); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	if err := mc.Close(context.Background()); err != nil {
+		t.Errorf("expected a second Close to be a no-op, got %v", err)
+	}
+
+	// The collectors keep recording after Close
+	performRequest(newStatusRouter(mc), "GET", "/ok")
+}
+
+// ---------------------------------------------------------------------------
+// WithSLO
+// ---------------------------------------------------------------------------
+
+func TestWithSLO(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, reg := newTestMetricsWithRegistry(WithSLO(300 * time.Millisecond))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithClock(clock.Now)))
+	r.GET("/fast", func(c *gin.Context) {
+		clock.Advance(100 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	r.GET("/slow", func(c *gin.Context) {
+		clock.Advance(time.Second)
+		c.Status(http.StatusOK)
+	})
+	r.GET("/broken", func(c *gin.Context) {
+		clock.Advance(10 * time.Millisecond)
+		c.Status(http.StatusInternalServerError)
+	})
+	for _, path := range []string{"/fast", "/slow", "/broken"} {
+		performRequest(r, "GET", path)
+	}
+
+	count := func(name string) map[string]float64 {
+		counts := map[string]float64{}
+		if mf := gatherFamily(t, reg, name); mf != nil {
+			for _, m := range mf.GetMetric() {
+				counts[labelValue(m, "path")] = m.GetCounter().GetValue()
+			}
+		}
+		return counts
+	}
+	total, good := count("ginprom_slo_total"), count("ginprom_slo_good_total")
+	for _, path := range []string{"/fast", "/slow", "/broken"} {
+		if total[path] != 1 {
+			t.Errorf("%s: expected 1 request in ginprom_slo_total, got %v", path, total[path])
+		}
+	}
+	if good["/fast"] != 1 || good["/slow"] != 0 || good["/broken"] != 0 {
+		t.Errorf("expected only /fast to be good, got %v", good)
+	}
+}
+
+func TestWithSLO_Invalid(t *testing.T) {
+	if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), WithSLO(0)); err == nil {
+		t.Error("expected an error for a zero latency objective")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Router groups
+// ---------------------------------------------------------------------------
+
+func TestMiddlewareWithMetrics_PerRouterGroup(t *testing.T) {
+	reg := newTestRegistry()
+	public := NewMetricsCollection(WithCustomRegistry(reg), WithMetricPrefix("public"))
+	admin := NewMetricsCollection(WithCustomRegistry(reg), WithMetricPrefix("admin"),
+		WithCustomBuckets([]float64{0.5, 1}, []float64{1000}))
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	api := r.Group("/api", MiddlewareWithMetrics(public, WithFilterRoutes([]string{"/api/health"})))
+	api.GET("/items", ok)
+	api.GET("/health", ok)
+	adm := r.Group("/admin", MiddlewareWithMetrics(admin, WithAggregateStatusCode(true)))
+	adm.GET("/users", ok)
+
+	performRequest(r, "GET", "/api/items")
+	performRequest(r, "GET", "/api/health")
+	performRequest(r, "GET", "/admin/users")
+
+	mf := gatherFamily(t, reg, "public_http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one public series, got %v", mf)
+	}
+	if m := mf.GetMetric()[0]; labelValue(m, "path") != "/api/items" || labelValue(m, "status_code") != "200" {
+		t.Errorf("unexpected public series %v", m)
+	}
+
+	mf = gatherFamily(t, reg, "admin_http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one admin series, got %v", mf)
+	}
+	if m := mf.GetMetric()[0]; labelValue(m, "path") != "/admin/users" || labelValue(m, "status_code") != "2xx" {
+		t.Errorf("unexpected admin series %v", m)
+	}
+
+	mf = gatherFamily(t, reg, "admin_http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()[0].GetHistogram().GetBucket()) != 2 {
+		t.Errorf("expected the admin buckets, got %v", mf)
+	}
+	mf = gatherFamily(t, reg, "public_http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()[0].GetHistogram().GetBucket()) != len(DefaultDurationBuckets) {
+		t.Errorf("expected the default buckets on the public API, got %v", mf)
+	}
+}
@@ -0,0 +1,311 @@
+package ginprom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// optionalVecs lists the vectors of a collection that are only built, and
+// registered, once a middleware is created with an option recording into
+// them, so that metric names a service never uses are not taken in its
+// registry.
+var optionalVecs = []struct {
+	// enabled reports whether the middleware configured by c records into
+	// the vector
+	enabled func(c *config) bool
+	enable  func(mc *MetricsCollection) error
+}{
+	{
+		enabled: func(c *config) bool { return c.recordGinErrors },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.GinErrors, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_gin_errors_total"),
+						Help: "Number of errors attached to the Gin context by handlers.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordBindErrors },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.BindErrors, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_bind_errors_total"),
+						Help: "Number of requests that failed binding.",
+					},
+					[]string{mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordCompressionRatio },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.ResponseCompressionRatio, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("http_response_compression_ratio"),
+						Help:    "Ratio of uncompressed to compressed size of gzip-encoded responses.",
+						Buckets: DefaultCompressionRatioBuckets,
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordPathDepth },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.PathDepth, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("http_route_path_depth"),
+						Help:    "Number of path segments in the matched route template.",
+						Buckets: DefaultPathDepthBuckets,
+					},
+					[]string{mc.methodLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordFlushCount },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.ResponseFlushes, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("http_response_flushes"),
+						Help:    "Number of times the response was flushed to the client.",
+						Buckets: DefaultFlushBuckets,
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.detectContentLengthMismatch },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.ContentLengthMismatches, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_content_length_mismatches_total"),
+						Help: "Number of responses whose Content-Length header did not match the bytes written.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.responseSizeCap > 0 },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.OversizeResponses, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_oversize_responses_total"),
+						Help: "Number of responses larger than the response size cap.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.trackWriteErrors },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.ResponseWriteErrors, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_response_write_errors_total"),
+						Help: "Number of responses for which writing the body to the client failed.",
+					},
+					[]string{mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.queueTimeHeader != "" },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.QueueTime, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("http_request_queue_time_seconds"),
+						Help:    "Time requests waited between the load balancer and the handler, in seconds.",
+						Buckets: mc.durationBuckets,
+					},
+					[]string{mc.methodLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordAborts },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.AbortedRequests, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_aborted_requests_total"),
+						Help: "Number of requests aborted by a handler.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordCPUTime },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.CPUTime, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("http_request_cpu_seconds"),
+						Help:    "CPU time spent by the handler chain on the request goroutine, in seconds.",
+						Buckets: mc.durationBuckets,
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.duplicates != nil },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.DuplicateRequests, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_duplicate_requests_total"),
+						Help: "Number of requests repeating an idempotency key seen shortly before.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.selfInstrumentation },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.MiddlewareOverhead, func() *prometheus.HistogramVec {
+				return prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:    mc.metricName("ginprom_record_duration_seconds"),
+						Help:    "Time the middleware spent recording a request, in seconds.",
+						Buckets: DefaultOverheadBuckets,
+					},
+					nil,
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return len(c.concurrencyLimits) > 0 },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.InFlightRequests, func() *prometheus.GaugeVec {
+				return prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{
+						Name: mc.metricName("http_requests_in_flight"),
+						Help: "Number of requests currently served by concurrency-limited routes.",
+					},
+					[]string{mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return len(c.concurrencyLimits) > 0 },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.RejectedRequests, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_requests_rejected_total"),
+						Help: "Number of requests rejected because their route was at its concurrency limit.",
+					},
+					[]string{mc.methodLabelName(), mc.pathLabelName()},
+				)
+			})
+		},
+	},
+	{
+		enabled: func(c *config) bool { return c.recordUnmatched },
+		enable: func(mc *MetricsCollection) error {
+			return enableVec(mc, &mc.UnmatchedRequests, func() *prometheus.CounterVec {
+				return prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name: mc.metricName("http_unmatched_requests_total"),
+						Help: "Number of requests that did not match any route.",
+					},
+					[]string{mc.methodLabelName()},
+				)
+			})
+		},
+	},
+}
+
+// enableOptional builds and registers the optional vectors that the
+// middleware configured by conf, including its per-route overrides, records
+// into.  Vectors that are already set, by an earlier middleware or by the
+// user, are kept as they are.
+func (mc *MetricsCollection) enableOptional(conf *config) error {
+	confs := []*config{conf}
+	for _, rconf := range conf.routeOverrides {
+		confs = append(confs, rconf)
+	}
+	for _, v := range optionalVecs {
+		for _, c := range confs {
+			if v.enabled(c) {
+				if err := v.enable(mc); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// enableVec sets *vec to the collector returned by build and registers it,
+// unless *vec is already set.  On error *vec is left nil.
+func enableVec[T prometheus.Collector](mc *MetricsCollection, vec *T, build func() T) error {
+	mc.optionalMu.Lock()
+	defer mc.optionalMu.Unlock()
+
+	var unset T
+	if any(*vec) != any(unset) {
+		return nil
+	}
+	c := build()
+	if err := mc.registerOptional(c); err != nil {
+		return err
+	}
+	*vec = c
+	return nil
+}
+
+// registerOptional registers c, built after the collection, with the
+// registries of the collection and with those the cardinality audit and the
+// metric aliases gather from.  On error c is left unregistered everywhere.
+func (mc *MetricsCollection) registerOptional(c prometheus.Collector) error {
+	registries := mc.registries()
+	if mc.auditor != nil {
+		registries = append(registries, mc.auditor.audited)
+	}
+	if mc.aliaser != nil {
+		registries = append(registries, mc.aliaser.aliased)
+	}
+	for i, reg := range registries {
+		if err := reg.Register(c); err != nil {
+			for _, done := range registries[:i] {
+				done.Unregister(c)
+			}
+			return fmt.Errorf("ginprom: registering metrics: %w", err)
+		}
+	}
+	return nil
+}
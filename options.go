@@ -1,13 +1,50 @@
 package ginprom
 
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
 // config is a configuration struct used for setting up service tracking options and behaviors.
 type config struct {
-	recordRequestSize   bool
-	recordResponseSize  bool
-	recordDuration      bool
-	filterPath          func(string, string) bool
-	pathAggregator      func(string, string, int) string
+	recordRequestSize  bool
+	recordResponseSize bool
+	recordDuration     bool
+	filterPath         func(string, string) bool
+	pathAggregator     func(string, string, int) string
+	routeNames         map[string]string
+	// detailedRoutes, when set, lists the only routes keeping their own path
+	// label; the others are recorded as "other"
+	detailedRoutes      map[string]struct{}
+	aggregateOnError    bool
 	aggregateStatusCode bool
+	// ignorePathPrefixes filters requests whose URL path starts with any of
+	// the prefixes, in addition to filterPath
+	ignorePathPrefixes []string
+
+	// healthCheckPaths are URL paths whose successful responses are not
+	// recorded
+	healthCheckPaths map[string]struct{}
+
+	// statusHeader names a response header whose value overrides the writer
+	// status when it holds a valid status code
+	statusHeader string
+
+	// timeoutStatus records 503 for requests whose deadline expired while
+	// the handler chain ran
+	timeoutStatus bool
+	// zeroStatusAs replaces a status of 0, reported by writers when nothing
+	// was written
+	zeroStatusAs int
+	// statusMapper computes the status_code label value when set
+	statusMapper func(int) string
+	// statusTextLabel uses http.StatusText as the status_code label value
+	statusTextLabel bool
 	// markUnmatchedRoutes determines if unmatched routes should be marked with a special prefix
 	markUnmatchedRoutes bool
 	// unmatchedRoutesGrouping determines if unmatched routes should be grouped
@@ -19,6 +56,145 @@ type config struct {
 	// groupUnmatchedRoutes determines if unmatched routes should be grouped
 	// into a single metric to prevent cardinality explosion
 	groupUnmatchedRoutes bool
+
+	// handleClientCancel determines if requests whose context was cancelled
+	// by the client are treated specially
+	handleClientCancel bool
+	// skipOnClientCancel drops cancelled requests instead of relabelling them
+	skipOnClientCancel bool
+	// clientCancelLabel is the status label used for cancelled requests
+	clientCancelLabel string
+
+	// statusFilter selects the response statuses that are recorded; nil
+	// records every status
+	statusFilter func(int) bool
+	// countAllStatusCodes keeps counting requests in the requests counter
+	// even when statusFilter rejects their status
+	countAllStatusCodes bool
+
+	// errorBodyCapture receives the first errorBodyMaxBytes of server error
+	// response bodies
+	errorBodyCapture  func(c *gin.Context, status int, body []byte)
+	errorBodyMaxBytes int
+
+	// duplicates counts requests repeating an idempotency key
+	duplicates *duplicateDetector
+
+	// recordCPUTime measures the CPU time of the handler chain
+	recordCPUTime bool
+
+	// durationObserver receives every recorded duration
+	durationObserver func(route, method string, status int, d time.Duration)
+
+	// selfInstrumentation times the middleware's own recording work
+	selfInstrumentation bool
+
+	// responseSizeExemplars attaches exemplars to response size observations
+	responseSizeExemplars bool
+	// exemplarTraceID returns the trace ID attached to exemplars
+	exemplarTraceID func(c *gin.Context) string
+	// requestIDHeader names the request header added to exemplars
+	requestIDHeader string
+	// exemplarPolicy selects the durations observed with an exemplar
+	exemplarPolicy func(status int, d time.Duration) bool
+
+	// pathBreaker caps the number of distinct path labels
+	pathBreaker *pathBreaker
+
+	// successSampleRate is the fraction of requests below 400 whose
+	// histograms are observed
+	successSampleRate float64
+
+	// recordAborts counts requests aborted with c.Abort
+	recordAborts bool
+
+	// recordUnmatched counts the requests that matched no route
+	recordUnmatched bool
+
+	// recordGinErrors counts the errors attached to the Gin context
+	recordGinErrors bool
+
+	// recordBindErrors counts the requests that failed binding
+	recordBindErrors bool
+
+	// recordCompressionRatio observes the compression ratio of gzip-encoded
+	// responses
+	recordCompressionRatio bool
+
+	// detectContentLengthMismatch compares the declared Content-Length with
+	// the bytes written
+	detectContentLengthMismatch bool
+
+	// responseTimeHeader names the response header carrying the elapsed
+	// time, empty when it is not set
+	responseTimeHeader string
+
+	// trackWriteErrors counts the responses whose body could not be written
+	trackWriteErrors bool
+
+	// requestSizeMode selects what the request size counts
+	requestSizeMode RequestSizeMode
+
+	// requestSizeFromContentLengthOnly never reads the request body to
+	// measure its size
+	requestSizeFromContentLengthOnly bool
+
+	// streamingRequestSize counts the body bytes the handler chain reads
+	streamingRequestSize bool
+
+	// responseSizeFromHeaderFallback uses the Content-Length response header
+	// when the writer reports no bytes
+	responseSizeFromHeaderFallback bool
+
+	// exactResponseSize counts the bytes written through the wrapped writer
+	// instead of trusting gin.ResponseWriter.Size
+	exactResponseSize bool
+
+	// accurateStatus takes the status from the WriteHeader calls seen by the
+	// wrapped writer instead of trusting gin.ResponseWriter.Status
+	accurateStatus bool
+
+	// errorMetrics additionally records server errors when not nil
+	errorMetrics *MetricsCollection
+
+	// responseSizeCap caps the observed response size; 0 means no cap
+	responseSizeCap int64
+
+	// includeTrailers adds the size of response trailers to the response size
+	includeTrailers bool
+
+	// recordFlushCount observes the number of flushes per response
+	recordFlushCount bool
+
+	// recordPathDepth observes the number of segments of the route template
+	recordPathDepth bool
+
+	// webSocketMode selects how hijacked connections are recorded
+	webSocketMode WebSocketMode
+
+	// upgradeMode selects how CONNECT and Upgrade requests are recorded
+	upgradeMode UpgradeMode
+
+	// routeConfig holds per-route overrides, resolved into routeOverrides
+	// once all options were applied
+	routeConfig    *RouteConfig
+	routeOverrides map[string]*config
+
+	// validateOrdering warns when the response was written before the
+	// middleware ran
+	validateOrdering bool
+	// logger receives diagnostics; they are dropped when nil
+	logger *slog.Logger
+
+	// queueTimeHeader names the request header carrying the time the load
+	// balancer received the request
+	queueTimeHeader string
+
+	// now is the clock used to time requests
+	now func() time.Time
+
+	// concurrencyLimits caps the requests in flight per route template
+	concurrencyLimits map[string]*routeLimit
 }
 
 // Option is a functional option that configures the [Middleware] or
@@ -83,6 +259,75 @@ func WithPathAggregator(aggregator func(string, string, int) string) Option {
 	}
 }
 
+// WithAggregatePathOnError records every 4xx response under the "path_4xx"
+// path and every 5xx one under "path_5xx", like the default aggregator does
+// for unmatched requests, even when a route matched.  Successful responses
+// keep their route, while error storms hitting many routes cannot explode
+// the cardinality.  It overrides the path aggregator for those responses.
+func WithAggregatePathOnError(enabled bool) Option {
+	return func(c *config) {
+		c.aggregateOnError = enabled
+	}
+}
+
+// WithRouteRenamer replaces path label values found in names with their
+// mapped value, e.g. "/v1/resource/:resourceId/sub/:subId" with
+// "resource_sub".  It applies to the value returned by the path aggregator,
+// which is the route template by default; values without a mapping are kept.
+//
+// Example:
+//
+//	ginprom.WithRouteRenamer(map[string]string{
+//	    "/v1/resource/:resourceId/sub/:subId": "resource_sub",
+//	})
+func WithRouteRenamer(names map[string]string) Option {
+	return func(c *config) {
+		c.routeNames = make(map[string]string, len(names))
+		for route, name := range names {
+			c.routeNames[route] = name
+		}
+	}
+}
+
+// WithDetailedRoutes restricts the path label to the listed route templates:
+// requests to any other route, and requests that matched no route, are
+// recorded under the single "other" path label.  It bounds the cardinality
+// of large applications to the routes worth a dashboard.  The listed routes
+// still go through [WithRouteRenamer].
+//
+// Example:
+//
+//	ginprom.WithDetailedRoutes([]string{"/checkout", "/api/v1/orders/:id"})
+func WithDetailedRoutes(routes []string) Option {
+	return func(c *config) {
+		c.detailedRoutes = make(map[string]struct{}, len(routes))
+		for _, route := range routes {
+			c.detailedRoutes[route] = struct{}{}
+		}
+	}
+}
+
+// WithPathAggregatorChain composes several path aggregators into one and
+// installs it like [WithPathAggregator].  The aggregators run in order: the
+// first receives the original (route, path, statusCode) triple and every
+// following one receives the previous aggregator's output as its path
+// argument.  The label value is the output of the last aggregator.
+//
+// Example – lowercase the path, then mask numeric IDs:
+//
+//	ginprom.WithPathAggregatorChain(
+//	    func(route, path string, status int) string { return strings.ToLower(path) },
+//	    func(route, path string, status int) string { return idPattern.ReplaceAllString(path, ":id") },
+//	)
+func WithPathAggregatorChain(aggregators ...func(route, path string, statusCode int) string) Option {
+	return WithPathAggregator(func(route, path string, statusCode int) string {
+		for _, aggregate := range aggregators {
+			path = aggregate(route, path, statusCode)
+		}
+		return path
+	})
+}
+
 // WithAggregateStatusCode controls status-code label granularity.  When
 // enabled, individual codes are bucketed into class labels such as "2xx",
 // "4xx", "5xx", reducing metric cardinality at the cost of less specific
@@ -93,6 +338,77 @@ func WithAggregateStatusCode(aggregate bool) Option {
 	}
 }
 
+// WithZeroStatusAs sets the status recorded when the response writer reports
+// a status of 0, which some writers do when the handler returned without
+// writing anything.  It defaults to 200, the status Go's HTTP server sends in
+// that case.
+func WithZeroStatusAs(code int) Option {
+	return func(c *config) {
+		c.zeroStatusAs = code
+	}
+}
+
+// WithStatusCodeMapper computes the status_code label value with mapper,
+// allowing arbitrary groupings such as "auth_error" for 401 and 403.  It
+// takes precedence over [WithAggregateStatusCode] and [WithStatusTextLabel];
+// client-cancelled and hijacked requests keep their dedicated labels.
+//
+// Example:
+//
+//	ginprom.WithStatusCodeMapper(func(code int) string {
+//	    switch {
+//	    case code == 401 || code == 403:
+//	        return "auth_error"
+//	    case code >= 500:
+//	        return "server_error"
+//	    }
+//	    return strconv.Itoa(code)
+//	})
+func WithStatusCodeMapper(mapper func(statusCode int) string) Option {
+	return func(c *config) {
+		c.statusMapper = mapper
+	}
+}
+
+// WithStatusTextLabel makes the status_code label carry the status text
+// (e.g. "Not Found") instead of the numeric code (e.g. "404").  Codes without
+// a standard text keep their numeric form.  [WithAggregateStatusCode] takes
+// precedence when both are enabled.  Disabled by default.
+func WithStatusTextLabel(enabled bool) Option {
+	return func(c *config) {
+		c.statusTextLabel = enabled
+	}
+}
+
+// WithStatusFromHeader takes the recorded status from the named response
+// header instead of c.Writer.Status(), for middleware that reports the real
+// status out of band (e.g. after a reverse proxy rewrote it).  Absent headers
+// and values that are not a three-digit status code fall back to the writer
+// status.
+func WithStatusFromHeader(headerName string) Option {
+	return func(c *config) {
+		c.statusHeader = headerName
+	}
+}
+
+// WithTimeoutStatusDetection records the 503 Service Unavailable sent by an
+// [http.TimeoutHandler] wrapping the router.  Once that handler times out it
+// replies to the client itself, while Gin's writer still reports whatever the
+// handler chain set, such as the default 200.  The detection is best-effort:
+// a request is taken as timed out when its context deadline expired by the
+// time the handler chain returned, which also matches deadlines set by
+// middleware of the application.  Disabled by default.
+//
+// Example:
+//
+//	r.Use(ginprom.Middleware(ginprom.WithTimeoutStatusDetection(true)))
+//	srv := &http.Server{Handler: http.TimeoutHandler(r, 5*time.Second, "timeout")}
+func WithTimeoutStatusDetection(enabled bool) Option {
+	return func(c *config) {
+		c.timeoutStatus = enabled
+	}
+}
+
 // WithFilterRoutes registers a list of exact Gin route patterns that should be
 // excluded from metrics collection.  The match is performed against the
 // registered pattern (e.g. "/health"), not the raw request URL.
@@ -115,6 +431,60 @@ func WithFilterRoutes(routes []string) Option {
 	}
 }
 
+// WithIgnorePathPrefixes excludes from metrics the requests whose URL path
+// (not route pattern) starts with any of prefixes, e.g. "/debug/" or
+// "/swagger/".  It composes with [WithFilterRoutes] and [WithFilterPath]: a
+// request is skipped when any of them matches.  Repeated uses add prefixes.
+func WithIgnorePathPrefixes(prefixes []string) Option {
+	return func(c *config) {
+		c.ignorePathPrefixes = append(c.ignorePathPrefixes, prefixes...)
+	}
+}
+
+// ignoredPath reports whether r matches a prefix of [WithIgnorePathPrefixes].
+func (c *config) ignoredPath(r *http.Request) bool {
+	if len(c.ignorePathPrefixes) == 0 || r == nil || r.URL == nil {
+		return false
+	}
+	for _, prefix := range c.ignorePathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommonHealthCheckPaths are the URL paths filtered by
+// [WithCommonHealthFilters].
+var CommonHealthCheckPaths = []string{"/healthz", "/livez", "/readyz", "/health", "/ping", "/metrics"}
+
+// WithCommonHealthFilters excludes from metrics the successful (status below
+// 400) requests to the usual health-check and scrape endpoints listed in
+// [CommonHealthCheckPaths], which load balancers and Prometheus call far more
+// often than real clients.  Failing probes are still recorded, so outages stay
+// visible.  Paths are matched exactly against the URL path.  It composes with
+// the other filter options.
+func WithCommonHealthFilters() Option {
+	return func(c *config) {
+		if c.healthCheckPaths == nil {
+			c.healthCheckPaths = make(map[string]struct{}, len(CommonHealthCheckPaths))
+		}
+		for _, p := range CommonHealthCheckPaths {
+			c.healthCheckPaths[p] = struct{}{}
+		}
+	}
+}
+
+// healthCheck reports whether r is a request to one of the paths of
+// [WithCommonHealthFilters] that was answered with a successful status.
+func (c *config) healthCheck(r *http.Request, status int) bool {
+	if len(c.healthCheckPaths) == 0 || r == nil || r.URL == nil {
+		return false
+	}
+	_, ok := c.healthCheckPaths[r.URL.Path]
+	return ok && status < http.StatusBadRequest
+}
+
 // WithUnmatchedRouteHandling controls whether requests that do not match any
 // registered Gin route are still counted in metrics.  When enabled (the
 // default), such requests are grouped under an "/unmatched/*" label (see also
@@ -126,6 +496,632 @@ func WithUnmatchedRouteHandling(enabled bool) Option {
 	}
 }
 
+// WithRecordUnmatched counts, in http_unmatched_requests_total labelled by
+// method, the requests that matched no route, such as scanners probing for
+// well-known files, independently of how [WithUnmatchedRouteHandling] labels
+// them in the other metrics.  Disabled by default.
+func WithRecordUnmatched(record bool) Option {
+	return func(c *config) {
+		c.recordUnmatched = record
+	}
+}
+
+// WithSkipOnClientCancel controls how requests are recorded when the client
+// disconnects before the handler finishes, i.e. when the request context
+// reports [context.Canceled].  When skip is true such requests are dropped
+// from all metrics; when false they are recorded under the status label
+// "client_closed" (see [WithClientCancelLabel]) instead of whatever status the
+// handler happened to write.  Without this option cancelled requests are
+// recorded like any other.
+func WithSkipOnClientCancel(skip bool) Option {
+	return func(c *config) {
+		c.handleClientCancel = true
+		c.skipOnClientCancel = skip
+	}
+}
+
+// WithClientCancelLabel sets the status label used for requests cancelled by
+// the client.  It implies client-cancel handling, so it may be used on its own
+// instead of WithSkipOnClientCancel(false).  The default label is
+// "client_closed".
+func WithClientCancelLabel(label string) Option {
+	return func(c *config) {
+		c.handleClientCancel = true
+		c.clientCancelLabel = label
+	}
+}
+
+// WithRecordOnlyStatusCodes restricts metrics recording to responses whose
+// status code is one of codes.  Responses with any other status are skipped
+// entirely unless [WithCountAllStatusCodes] is enabled.
+//
+// Example – only record the error responses of a noisy endpoint:
+//
+//	ginprom.WithRecordOnlyStatusCodes(400, 404, 500, 502, 503)
+func WithRecordOnlyStatusCodes(codes ...int) Option {
+	selected := make(map[int]struct{}, len(codes))
+	for _, code := range codes {
+		selected[code] = struct{}{}
+	}
+	return WithStatusCodePredicate(func(status int) bool {
+		_, ok := selected[status]
+		return ok
+	})
+}
+
+// WithStatusCodePredicate is the predicate form of
+// [WithRecordOnlyStatusCodes]: metrics are recorded only for responses whose
+// status code makes predicate return true.
+//
+// Example – only record 4xx and 5xx responses:
+//
+//	ginprom.WithStatusCodePredicate(func(status int) bool { return status >= 400 })
+func WithStatusCodePredicate(predicate func(int) bool) Option {
+	return func(c *config) {
+		c.statusFilter = predicate
+	}
+}
+
+// WithCountAllStatusCodes keeps the requests counter complete when a status
+// filter is installed with [WithRecordOnlyStatusCodes] or
+// [WithStatusCodePredicate].  When enabled, responses whose status was not
+// selected are still counted in http_requests_total; only the histograms are
+// skipped.  Disabled by default.
+func WithCountAllStatusCodes(count bool) Option {
+	return func(c *config) {
+		c.countAllStatusCodes = count
+	}
+}
+
+// WithRecordGinErrors enables counting of the errors handlers attach to the
+// Gin context with c.Error.  Each recorded request adds len(c.Errors) to the
+// http_gin_errors_total counter, labelled by method and path.  Disabled by
+// default.
+func WithRecordGinErrors(record bool) Option {
+	return func(c *config) {
+		c.recordGinErrors = record
+	}
+}
+
+// WithRecordBindErrors counts, in http_bind_errors_total labelled by path,
+// the requests with at least one error of type gin.ErrorTypeBind attached,
+// as c.Bind, c.BindJSON and the other Must Bind methods do when the request
+// cannot be decoded or fails validation.  The Should Bind methods only
+// return the error; attach it with c.Error(err).SetType(gin.ErrorTypeBind)
+// to have it counted.  Disabled by default.
+func WithRecordBindErrors(record bool) Option {
+	return func(c *config) {
+		c.recordBindErrors = record
+	}
+}
+
+// WithErrorBodyCapture calls cb for every recorded response with a status of
+// 500 or above, passing up to maxBytes of its body, for error analysis.  The
+// body is only copied for such responses, so other traffic is not slowed
+// down beyond the wrapping of the response writer (see
+// [MiddlewareWithMetrics]).  cb runs on the request goroutine after the
+// handler chain returned and may keep body.
+func WithErrorBodyCapture(maxBytes int, cb func(c *gin.Context, status int, body []byte)) Option {
+	return func(c *config) {
+		c.errorBodyCapture = cb
+		c.errorBodyMaxBytes = maxBytes
+	}
+}
+
+// WithErrorOnlyMetrics additionally records every response with a status of
+// 500 or above into mc, for instance registered on a dedicated registry with
+// its own retention for alerting.  Only the requests counter and the duration
+// histogram of mc are recorded, with the labels mc is configured with; the
+// collection passed to [MiddlewareWithMetrics] keeps recording every request
+// as before.  Passing nil disables the secondary recording.
+func WithErrorOnlyMetrics(mc *MetricsCollection) Option {
+	return func(c *config) {
+		c.errorMetrics = mc
+	}
+}
+
+// WithRecordCPUTime observes the CPU time spent by the handler chain in the
+// http_request_cpu_seconds histogram, labelled by method and path, to tell
+// CPU-bound routes from ones waiting on I/O.
+//
+// The CPU time is read from the thread's resource usage, so the request
+// goroutine is locked to its OS thread while the chain runs; work done on
+// other goroutines is not counted.  This is only supported on Linux; on
+// other platforms the histogram stays empty.  Disabled by default.
+func WithRecordCPUTime(enabled bool) Option {
+	return func(c *config) {
+		c.recordCPUTime = enabled
+	}
+}
+
+// WithDurationObserver calls observer with every duration recorded in
+// http_request_duration_seconds, to bridge latencies to another telemetry
+// backend such as StatsD or OpenTelemetry.  route is the path label value and
+// status the response status.  observer runs synchronously on the request
+// goroutine, so it should be quick; a panic in it is recovered and logged to
+// the logger set with [WithLogger] without affecting the request or the
+// other metrics.
+//
+// Example:
+//
+//	ginprom.WithDurationObserver(func(route, method string, status int, d time.Duration) {
+//	    statsd.Timing("http.request", d, "route:"+route, "method:"+method)
+//	})
+func WithDurationObserver(observer func(route, method string, status int, d time.Duration)) Option {
+	return func(c *config) {
+		c.durationObserver = observer
+	}
+}
+
+// WithSelfInstrumentation observes, in the ginprom_record_duration_seconds
+// histogram, the time the middleware spends recording each request once the
+// handler chain returned, to keep an eye on its own overhead.  The time is
+// always taken from the wall clock, whatever [WithClock] is set to.
+// Disabled by default.
+func WithSelfInstrumentation(enabled bool) Option {
+	return func(c *config) {
+		c.selfInstrumentation = enabled
+	}
+}
+
+// WithErrorAwareSampling observes the duration, request size and response
+// size histograms for only a random rate fraction of the 1xx, 2xx and 3xx
+// responses, while 4xx and 5xx responses are always observed, to cut the
+// cost of busy success paths without losing sight of errors.  The requests
+// counter keeps counting every request.  rate is clamped to [0, 1]; the
+// default of 1 observes every request.
+func WithErrorAwareSampling(rate float64) Option {
+	return func(c *config) {
+		c.successSampleRate = min(max(rate, 0), 1)
+	}
+}
+
+// WithResponseSizeExemplars attaches exemplars to the response size
+// histogram so that unusually large responses can be correlated with their
+// traces.  traceID is called once per observed request and its non-empty
+// results are attached under the trace_id exemplar label; IDs too long for an
+// exemplar are dropped.  Exemplars are only exposed in the OpenMetrics format,
+// for instance by a promhttp handler with EnableOpenMetrics set, and are not
+// attached to the summary installed by [WithResponseSizeSummary].  traceID
+// replaces the extractor set with [WithExemplarTraceID], so it also provides
+// the trace ID of the duration exemplars selected with [WithExemplarPolicy].
+// Passing nil turns response size exemplars off and keeps the extractor.
+//
+// Example – take the trace ID from a W3C traceparent header:
+//
+//	ginprom.WithResponseSizeExemplars(func(c *gin.Context) string {
+//	    if parts := strings.Split(c.GetHeader("traceparent"), "-"); len(parts) == 4 {
+//	        return parts[1]
+//	    }
+//	    return ""
+//	})
+func WithResponseSizeExemplars(traceID func(c *gin.Context) string) Option {
+	return func(c *config) {
+		c.responseSizeExemplars = traceID != nil
+		if traceID != nil {
+			c.exemplarTraceID = traceID
+		}
+	}
+}
+
+// WithExemplarTraceID sets the function returning the trace ID attached
+// under the trace_id label to every exemplar, whichever option attaches
+// them, without enabling any exemplar on its own.  Empty results and IDs too
+// long for an exemplar are left out.
+//
+// Example – duration exemplars for slow requests only, linked to traces:
+//
+//	ginprom.WithExemplarTraceID(traceIDFromContext),
+//	ginprom.WithExemplarPolicy(func(_ int, d time.Duration) bool { return d > time.Second })
+func WithExemplarTraceID(traceID func(c *gin.Context) string) Option {
+	return func(c *config) {
+		c.exemplarTraceID = traceID
+	}
+}
+
+// WithRequestIDExemplar adds the request ID found in the request header named
+// header, e.g. "X-Request-ID", to the exemplars attached by
+// [WithResponseSizeExemplars] and [WithExemplarPolicy], under the request_id
+// exemplar label.  Request IDs are unbounded and so never become metric
+// labels, but one exemplar per bucket is cheap.  Requests without the header
+// get no request_id, and the request ID is dropped when the exemplar would
+// otherwise grow too long.  It has no effect unless exemplars are enabled.
+func WithRequestIDExemplar(header string) Option {
+	return func(c *config) {
+		c.requestIDHeader = header
+	}
+}
+
+// WithExemplarPolicy attaches exemplars to the duration histogram for the
+// requests policy selects, such as the slowest ones or server errors, so
+// that the one exemplar kept per bucket points at an anomaly rather than at
+// the latest ordinary request.  policy is called with the status and the
+// measured duration of every observed request.  The exemplar carries the
+// trace ID returned by the extractor set with [WithExemplarTraceID] and the
+// request ID configured with [WithRequestIDExemplar]; requests with neither
+// get none.  It works independently of [WithResponseSizeExemplars].
+//
+// Example – keep exemplars of requests slower than a second and of 5xx:
+//
+//	ginprom.WithExemplarPolicy(func(status int, d time.Duration) bool {
+//	    return d > time.Second || status >= 500
+//	})
+func WithExemplarPolicy(policy func(status int, d time.Duration) bool) Option {
+	return func(c *config) {
+		c.exemplarPolicy = policy
+	}
+}
+
+// sampled reports whether the histograms of a response with the given status
+// are observed.
+func (c *config) sampled(status int) bool {
+	if status >= http.StatusBadRequest || c.successSampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < c.successSampleRate
+}
+
+// WithRecordAborts counts, in http_aborted_requests_total, the requests that a
+// middleware or handler registered after this one aborted with c.Abort, e.g.
+// on an authentication failure.  They are still recorded in the other
+// metrics with the status they were aborted with.  Requests rejected by
+// [WithConcurrencyLimit] are aborted too and therefore also counted.
+// Disabled by default.
+func WithRecordAborts(record bool) Option {
+	return func(c *config) {
+		c.recordAborts = record
+	}
+}
+
+// WithRecordCompressionRatio enables the http_response_compression_ratio
+// histogram, which observes the ratio between the uncompressed and the
+// compressed size of gzip-encoded responses.  Responses without a
+// "Content-Encoding: gzip" header are not observed.
+//
+// The middleware measures the bytes actually sent and decodes them on the fly
+// to recover the uncompressed size, so it must be registered before (outside)
+// the compression middleware:
+//
+//	r.Use(ginprom.Middleware(ginprom.WithRecordCompressionRatio(true)))
+//	r.Use(gzip.Gzip(gzip.DefaultCompression))
+//
+// Decoding costs roughly as much CPU as the client spends decompressing the
+// response.  Enabling it wraps the response writer, see
+// [MiddlewareWithMetrics].  Disabled by default.
+func WithRecordCompressionRatio(record bool) Option {
+	return func(c *config) {
+		c.recordCompressionRatio = record
+	}
+}
+
+// WithDetectContentLengthMismatch counts in
+// http_content_length_mismatches_total, labelled by method and path, the
+// responses whose Content-Length header differs from the number of body
+// bytes the handler chain wrote, which usually points at a handler bug.
+// Responses that carry no body by definition, to HEAD requests or with a 1xx,
+// 204 or 304 status, and hijacked connections are not checked.  Enabling it
+// wraps the response writer, see [MiddlewareWithMetrics].  Disabled by
+// default.
+func WithDetectContentLengthMismatch(enabled bool) Option {
+	return func(c *config) {
+		c.detectContentLengthMismatch = enabled
+	}
+}
+
+// RequestSizeMode selects which parts of a request http_request_size_bytes
+// counts.
+type RequestSizeMode int
+
+const (
+	// RequestSizeFull is the default: the Content-Length of requests that
+	// declare one, and the request line, headers and body of the others.
+	RequestSizeFull RequestSizeMode = iota
+	// RequestSizeBodyOnly counts the body only, like nginx's
+	// $content_length.
+	RequestSizeBodyOnly
+	// RequestSizeHeadersOnly counts the request line and headers only, and
+	// never reads the body.
+	RequestSizeHeadersOnly
+)
+
+// WithResponseTimeHeader sets the response header named header, e.g.
+// "X-Response-Time-Ms", to the time in milliseconds, with microsecond
+// precision, elapsed between the start of the request and the moment the
+// response header is sent, for debugging latency from the client side.
+// Handlers that only set a status get the full duration of the chain;
+// streaming handlers get the time to the first byte.  Enabling it wraps the
+// response writer, see [MiddlewareWithMetrics].
+func WithResponseTimeHeader(header string) Option {
+	return func(c *config) {
+		c.responseTimeHeader = header
+	}
+}
+
+// WithTrackWriteErrors counts, in http_response_write_errors_total labelled
+// by path, the responses for which a write of the body returned an error,
+// typically because the client disconnected mid-response.  Each response is
+// counted once however many writes failed.  Enabling it wraps the response
+// writer, see [MiddlewareWithMetrics].  Disabled by default.
+func WithTrackWriteErrors(track bool) Option {
+	return func(c *config) {
+		c.trackWriteErrors = track
+	}
+}
+
+// WithRequestSizeMode selects what the request size counts.  Bodies without a
+// Content-Length are still only read when [WithRequestSizeFromContentLengthOnly]
+// allows it; with that option [RequestSizeBodyOnly] records 0 for them.
+func WithRequestSizeMode(mode RequestSizeMode) Option {
+	return func(c *config) {
+		c.requestSizeMode = mode
+	}
+}
+
+// WithRequestSizeFromContentLengthOnly guarantees that the middleware never
+// reads the request body to measure it.  By default, when a request has no
+// Content-Length (e.g. chunked uploads), the body is buffered to count its
+// bytes; with this option enabled only the request line and headers are
+// counted for such requests.  Use it for services that proxy large streaming
+// uploads.
+func WithRequestSizeFromContentLengthOnly(enabled bool) Option {
+	return func(c *config) {
+		c.requestSizeFromContentLengthOnly = enabled
+	}
+}
+
+// WithStreamingRequestSize measures request bodies as the handler chain reads
+// them, through a counting wrapper around c.Request.Body, instead of relying
+// on Content-Length or reading the rest of the body after the handler
+// returned.  The request size is then the bytes actually read, so a handler
+// that stops reading early records only what it consumed.  Streaming
+// handlers are unaffected as nothing is buffered.  It applies to
+// [RequestSizeFull], which adds the request line and headers, and to
+// [RequestSizeBodyOnly], and takes precedence over
+// [WithRequestSizeFromContentLengthOnly].  Disabled by default.
+func WithStreamingRequestSize(enabled bool) Option {
+	return func(c *config) {
+		c.streamingRequestSize = enabled
+	}
+}
+
+// WithExactResponseSize records the number of body bytes written through the
+// middleware, counted on every Write, instead of the size reported by
+// gin.ResponseWriter.Size.  The two differ when a writer installed further
+// down the chain keeps its own bookkeeping, or replaces c.Writer without
+// restoring it.  Enabling it wraps the response writer, see
+// [MiddlewareWithMetrics], which costs an addition per write.  Disabled by
+// default.
+func WithExactResponseSize(enabled bool) Option {
+	return func(c *config) {
+		c.exactResponseSize = enabled
+	}
+}
+
+// WithAccurateStatusCapture records the status code passed to the last
+// WriteHeader call made through the middleware before the response was sent,
+// such as the upstream status written by an httputil.ReverseProxy, instead
+// of the one reported by gin.ResponseWriter.Status.  The two differ when a
+// writer installed further down the chain keeps its own bookkeeping, or
+// replaces c.Writer without restoring it.  Responses that never called
+// WriteHeader keep the reported status.  Enabling it wraps the response
+// writer, see [MiddlewareWithMetrics].  Disabled by default.
+func WithAccurateStatusCapture(enabled bool) Option {
+	return func(c *config) {
+		c.accurateStatus = enabled
+	}
+}
+
+// WithResponseSizeCap caps the value observed in http_response_size_bytes
+// at bytes, so that a few pathological responses cannot skew the histogram
+// sum, and counts the capped responses in http_oversize_responses_total,
+// labelled by method and path.  A non-positive value disables the cap, which
+// is the default.
+func WithResponseSizeCap(bytes int64) Option {
+	return func(c *config) {
+		c.responseSizeCap = max(bytes, 0)
+	}
+}
+
+// WithResponseSizeFromHeaderFallback records the Content-Length response
+// header as the response size when the writer reports none, as happens when
+// the body is sent with sendfile (e.g. [http.ServeContent] on an
+// [*os.File]).  Disabled by default.
+func WithResponseSizeFromHeaderFallback(enabled bool) Option {
+	return func(c *config) {
+		c.responseSizeFromHeaderFallback = enabled
+	}
+}
+
+// WithIncludeTrailers adds the estimated size of the response trailers, as
+// used by gRPC-web and some chunked responses, to the response size.  Only
+// trailers set in c.Writer.Header() by the time the handler chain returns are
+// counted.  Disabled by default.
+func WithIncludeTrailers(include bool) Option {
+	return func(c *config) {
+		c.includeTrailers = include
+	}
+}
+
+// WithRecordFlushCount observes, in the http_response_flushes histogram
+// labelled by method and path, how many times the handler chain flushed each
+// response, which for streaming and server-sent events endpoints tracks the
+// number of chunks sent.  Flushes are still forwarded to the underlying
+// writer.  Enabling it wraps the response writer, see
+// [MiddlewareWithMetrics].  Disabled by default.
+func WithRecordFlushCount(record bool) Option {
+	return func(c *config) {
+		c.recordFlushCount = record
+	}
+}
+
+// WithRecordPathDepth enables the http_route_path_depth histogram, which
+// observes how many "/"-separated segments the matched route template has
+// (e.g. 3 for "/users/:id/posts").  Since the value derives from the template
+// rather than the raw URL it is cheap and bounded; unmatched requests are not
+// observed.  Disabled by default.
+func WithRecordPathDepth(record bool) Option {
+	return func(c *config) {
+		c.recordPathDepth = record
+	}
+}
+
+// WithClock replaces the clock used to time requests, which defaults to
+// [time.Now].  It is mainly useful in tests, where a fake clock makes the
+// observed durations deterministic.  A nil clock is ignored, keeping the
+// current one.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		if now != nil {
+			c.now = now
+		}
+	}
+}
+
+// WithConcurrencyLimit caps the number of requests served concurrently per
+// route.  limits maps Gin route templates (e.g. "/reports/:id") to their
+// maximum number of requests in flight.  A request arriving while its route is
+// at the limit is aborted with 429 Too Many Requests before the rest of the
+// handler chain runs, and counted in http_requests_rejected_total.  The
+// current load of each limited route is exposed through the
+// http_requests_in_flight gauge.  Entries with a limit of 0 or less are
+// ignored, leaving their route unlimited, so that an unset value does not
+// turn away all of its traffic.
+//
+// Limits are tracked per middleware instance, so register the middleware once
+// per engine or group that shares them.
+func WithConcurrencyLimit(limits map[string]int) Option {
+	return func(c *config) {
+		c.concurrencyLimits = make(map[string]*routeLimit, len(limits))
+		for route, limit := range limits {
+			if limit > 0 {
+				c.concurrencyLimits[route] = &routeLimit{limit: int64(limit)}
+			}
+		}
+	}
+}
+
+// WithDuplicateDetection counts in http_duplicate_requests_total, labelled
+// by method and path, the requests whose header (typically
+// "Idempotency-Key") repeats a value seen less than window earlier, such as
+// requests replayed by a retrying client.  Requests without the header are
+// ignored.  Seen keys are kept in memory for window, so choose it according
+// to the request rate.  A non-positive window disables the detection.
+//
+// Keys are tracked per middleware instance, like [WithConcurrencyLimit].
+func WithDuplicateDetection(header string, window time.Duration) Option {
+	return func(c *config) {
+		if window <= 0 || header == "" {
+			c.duplicates = nil
+			return
+		}
+		c.duplicates = newDuplicateDetector(header, window)
+	}
+}
+
+// WithCardinalityCircuitBreaker is a safety valve against floods of distinct
+// paths, such as scans of unmatched URLs recorded with their raw path: once
+// threshold distinct path labels were recorded, requests with an unseen path
+// are recorded under the single "overflow" path label, and a warning is
+// logged once to the logger set with [WithLogger], or to slog.Default().
+// Paths recorded before the threshold was reached keep their own label.  A
+// non-positive threshold disables the breaker.
+//
+// Paths are tracked per middleware instance, like [WithConcurrencyLimit].
+func WithCardinalityCircuitBreaker(threshold int) Option {
+	return func(c *config) {
+		if threshold <= 0 {
+			c.pathBreaker = nil
+			return
+		}
+		c.pathBreaker = newPathBreaker(threshold)
+	}
+}
+
+// WebSocketMode selects how requests whose connection was hijacked, such as
+// WebSocket upgrades, are recorded.  Once hijacked, the status and size
+// reported by Gin no longer describe what was sent to the client.
+type WebSocketMode int
+
+const (
+	// WebSocketRecord records hijacked requests like any other request.
+	WebSocketRecord WebSocketMode = iota
+	// WebSocketSkip does not record hijacked requests.
+	WebSocketSkip
+	// WebSocketLabel records hijacked requests under the "websocket"
+	// status_code label and does not observe their response size.
+	WebSocketLabel
+)
+
+// WithWebSocketHandling selects how hijacked connections are recorded.  The
+// default, [WebSocketRecord], keeps the behaviour of previous releases; the
+// other modes wrap the response writer, see [MiddlewareWithMetrics].
+func WithWebSocketHandling(mode WebSocketMode) Option {
+	return func(c *config) {
+		c.webSocketMode = mode
+	}
+}
+
+// UpgradeMode selects how CONNECT requests and requests carrying an Upgrade
+// header are recorded.  Such requests turn into tunnels or other protocols,
+// so their request and response sizes do not describe the traffic and their
+// duration is the lifetime of the connection.
+type UpgradeMode int
+
+const (
+	// UpgradeRecord records upgrade requests like any other request.
+	UpgradeRecord UpgradeMode = iota
+	// UpgradeSkip counts upgrade requests but observes neither their sizes
+	// nor their duration.
+	UpgradeSkip
+	// UpgradeLabel records upgrade requests under the "upgrade" status_code
+	// label and does not observe their sizes.
+	UpgradeLabel
+)
+
+// WithUpgradeHandling selects how CONNECT and Upgrade requests are recorded.
+// The default, [UpgradeRecord], keeps the behaviour of previous releases.
+// Hijacked connections labelled by [WithWebSocketHandling] keep the
+// "websocket" label.
+func WithUpgradeHandling(mode UpgradeMode) Option {
+	return func(c *config) {
+		c.upgradeMode = mode
+	}
+}
+
+// WithValidateOrdering is a debugging aid that logs a warning, once per
+// process, when the middleware runs after the response has already been
+// written.  This happens when it is registered after a middleware that
+// replies itself, in which case the recorded status and sizes are wrong.  The
+// warning goes to the logger set with [WithLogger], or to slog.Default().
+// Disabled by default.
+func WithValidateOrdering(validate bool) Option {
+	return func(c *config) {
+		c.validateOrdering = validate
+	}
+}
+
+// WithQueueTimeHeader observes, in the http_request_queue_time_seconds
+// histogram, how long requests waited between the load balancer and the
+// middleware.  header names the request header in which the load balancer
+// stores its arrival time, usually "X-Request-Start", as a Unix timestamp in
+// seconds, milliseconds, microseconds or nanoseconds, optionally prefixed with
+// "t=".  Malformed values are ignored.  The result is only as accurate as the
+// clock synchronisation between the load balancer and this host.
+func WithQueueTimeHeader(header string) Option {
+	return func(c *config) {
+		c.queueTimeHeader = header
+	}
+}
+
+// WithLogger sets the logger that receives the middleware's diagnostics, such
+// as errors it otherwise swallows while measuring a request.  They are logged
+// at debug level, warnings at warn level.  By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
 // defaultConf initializes a default configuration instance for monitoring with pre-defined default settings.
 func defaultConf(options ...Option) *config {
 	return &config{
@@ -147,6 +1143,10 @@ func defaultConf(options ...Option) *config {
 		aggregateStatusCode:   false,
 		handleUnmatchedRoutes: true,
 		groupUnmatchedRoutes:  true,
+		clientCancelLabel:     "client_closed",
+		zeroStatusAs:          http.StatusOK,
+		successSampleRate:     1,
+		now:                   time.Now,
 	}
 }
 
@@ -156,6 +1156,7 @@ func applyOpt(options ...Option) *config {
 	for _, option := range options {
 		option(conf)
 	}
+	conf.resolveRouteConfig()
 
 	return conf
 }
@@ -0,0 +1,45 @@
+package ginprom
+
+import (
+	"strconv"
+	"time"
+)
+
+// Record records an operation that did not go through the middleware, such
+// as a background job or a message handled off a queue, in the four main
+// metrics as if it had been a request with the given method, path, status,
+// sizes and duration.  The status is recorded as its plain code and extra
+// labels, which are extracted from a Gin context, are left empty.  Negative
+// sizes are not observed.  Record is safe for concurrent use.
+//
+// Example:
+//
+//	start := time.Now()
+//	err := job.Run()
+//	status := http.StatusOK
+//	if err != nil {
+//	    status = http.StatusInternalServerError
+//	}
+//	mc.Record("JOB", "/jobs/rebuild-index", status, 0, 0, time.Since(start))
+func (mc *MetricsCollection) Record(method, path string, status int, reqSize, respSize int64, d time.Duration) {
+	statusCode := strconv.Itoa(status)
+	if status >= 0 && status < len(statusAddr) {
+		statusCode = statusAddr[status]
+	}
+	lvs := mc.baseLabelValues(statusCode, method, path)
+	for _, e := range mc.extraLabels {
+		lvs = append(lvs, make([]string, len(e.names))...)
+	}
+
+	mc.add(mc.TotalRequests, "http_requests_total", 1, lvs...)
+	if reqSize >= 0 {
+		mc.observe(mc.requestSizeObserver(), "http_request_size_bytes", float64(reqSize), lvs...)
+	}
+	if respSize >= 0 {
+		mc.observe(mc.responseSizeObserver(), "http_response_size_bytes", float64(respSize), lvs...)
+	}
+	if mc.splitDurationByOutcome {
+		lvs = append(lvs, mc.outcome(status))
+	}
+	mc.observe(mc.Duration, "http_request_duration_seconds", d.Seconds(), lvs...)
+}
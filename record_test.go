@@ -0,0 +1,56 @@
+package ginprom
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	mc.Record("JOB", "/jobs/rebuild", http.StatusOK, 10, 2000, 1500*time.Millisecond)
+	mc.Record("JOB", "/jobs/rebuild", http.StatusInternalServerError, -1, -1, time.Second)
+
+	requests := gatherFamily(t, reg, "http_requests_total")
+	if requests == nil || len(requests.GetMetric()) != 2 {
+		t.Fatalf("expected two request series, got %v", requests)
+	}
+	for _, m := range requests.GetMetric() {
+		if labelValue(m, "method") != "JOB" || labelValue(m, "path") != "/jobs/rebuild" {
+			t.Errorf("unexpected labels %v", m.GetLabel())
+		}
+	}
+
+	durations := gatherFamily(t, reg, "http_request_duration_seconds")
+	if durations == nil {
+		t.Fatal("expected duration series")
+	}
+	var sum float64
+	for _, m := range durations.GetMetric() {
+		sum += m.GetHistogram().GetSampleSum()
+	}
+	if sum != 2.5 {
+		t.Errorf("expected 2.5s of recorded durations, got %v", sum)
+	}
+
+	sizes := gatherFamily(t, reg, "http_response_size_bytes")
+	if sizes == nil || len(sizes.GetMetric()) != 1 {
+		t.Fatalf("expected a single response size series, negative sizes being skipped, got %v", sizes)
+	}
+	if m := sizes.GetMetric()[0]; labelValue(m, "status_code") != "200" || m.GetHistogram().GetSampleSum() != 2000 {
+		t.Errorf("expected 2000 bytes for the 200, got %v", m)
+	}
+}
+
+func TestRecord_ExtraLabelsLeftEmpty(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithProtocolLabel(true))
+	mc.Record("JOB", "/jobs/rebuild", http.StatusOK, 0, 0, time.Millisecond)
+
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "http_version"); got != "" {
+		t.Errorf("expected an empty http_version, got %q", got)
+	}
+}
@@ -0,0 +1,290 @@
+package ginprom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteConfig holds the settings of a remote writer started by
+// [StartRemoteWriter].
+type remoteWriteConfig struct {
+	client   *http.Client
+	username string
+	password string
+	headers  map[string]string
+	onError  func(error)
+}
+
+// RemoteWriteOption is a functional option that configures the remote writer
+// started by [StartRemoteWriter].
+type RemoteWriteOption func(*remoteWriteConfig)
+
+// WithRemoteWriteBasicAuth sends HTTP Basic Authentication credentials with
+// every push.
+func WithRemoteWriteBasicAuth(username, password string) RemoteWriteOption {
+	return func(c *remoteWriteConfig) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithRemoteWriteHeaders adds extra headers, such as a tenant ID or a bearer
+// token, to every push.
+func WithRemoteWriteHeaders(headers map[string]string) RemoteWriteOption {
+	return func(c *remoteWriteConfig) {
+		for k, v := range headers {
+			c.headers[k] = v
+		}
+	}
+}
+
+// WithRemoteWriteClient sets the HTTP client used to push samples.  The
+// default client times out after 30 seconds.
+func WithRemoteWriteClient(client *http.Client) RemoteWriteOption {
+	return func(c *remoteWriteConfig) {
+		c.client = client
+	}
+}
+
+// WithRemoteWriteErrorHandler is called with every failed gather or push.
+// Failures are otherwise dropped and retried on the next tick.
+func WithRemoteWriteErrorHandler(handler func(error)) RemoteWriteOption {
+	return func(c *remoteWriteConfig) {
+		c.onError = handler
+	}
+}
+
+// StartRemoteWriter periodically gathers the registry of mc (the default
+// Prometheus registry when mc has none) and pushes it to a Prometheus
+// remote-write endpoint as snappy-compressed protobuf.  It is meant for
+// environments that cannot scrape the metrics endpoint.
+//
+// The writer runs until ctx is cancelled, stop is called or mc is closed;
+// stop waits for an in-flight push to finish.  [MetricsCollection.Close]
+// also pushes the samples recorded since the last tick.
+//
+// Example:
+//
+//	stop, err := ginprom.StartRemoteWriter(ctx, mc,
+//	    "https://prometheus.example.com/api/v1/write", 15*time.Second,
+//	    ginprom.WithRemoteWriteBasicAuth("user", "s3cr3t"),
+//	)
+func StartRemoteWriter(ctx context.Context, mc *MetricsCollection, endpoint string, interval time.Duration, opts ...RemoteWriteOption) (stop func(), err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ginprom: invalid remote-write endpoint %q", endpoint)
+	}
+	if interval <= 0 {
+		return nil, errors.New("ginprom: remote-write interval must be positive")
+	}
+
+	conf := remoteWriteConfig{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		headers: map[string]string{},
+	}
+	for _, o := range opts {
+		o(&conf)
+	}
+
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if mc != nil && mc.Registry != nil {
+		gatherer = mc.Registry
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := pushRemoteWrite(ctx, &conf, endpoint, gatherer); err != nil && conf.onError != nil {
+					conf.onError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			wg.Wait()
+		})
+	}
+	if mc != nil {
+		// Close stops the writer and pushes the samples recorded since the
+		// last tick, unless stop was called first
+		registered := mc.onClose(func(closeCtx context.Context) error {
+			stopped := false
+			once.Do(func() {
+				cancel()
+				wg.Wait()
+				stopped = true
+			})
+			if !stopped {
+				return nil
+			}
+			return pushRemoteWrite(closeCtx, &conf, endpoint, gatherer)
+		})
+		if !registered {
+			stop()
+			return nil, errors.New("ginprom: metrics collection is closed")
+		}
+	}
+	return stop, nil
+}
+
+// pushRemoteWrite gathers the current samples and sends them in a single
+// remote-write request.
+func pushRemoteWrite(ctx context.Context, conf *remoteWriteConfig, endpoint string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("ginprom: gathering metrics for remote write: %w", err)
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(families, time.Now()))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("ginprom: building remote-write request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range conf.headers {
+		req.Header.Set(k, v)
+	}
+	if conf.username != "" || conf.password != "" {
+		req.SetBasicAuth(conf.username, conf.password)
+	}
+
+	resp, err := conf.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ginprom: pushing remote write: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ginprom: remote-write endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// remoteLabel is a label of a remote-write time series.
+type remoteLabel struct {
+	name, value string
+}
+
+// encodeWriteRequest encodes the gathered families as a remote-write
+// WriteRequest protobuf message.  Histograms and summaries are flattened into
+// their classic _bucket/quantile, _sum and _count series; samples without an
+// explicit timestamp are stamped with now.
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	var buf []byte
+	ts := now.UnixMilli()
+
+	series := func(name string, labels []remoteLabel, value float64, timestamp int64) {
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, encodeTimeSeries(name, labels, value, timestamp))
+	}
+	withLabel := func(labels []remoteLabel, name, value string) []remoteLabel {
+		return append(append([]remoteLabel(nil), labels...), remoteLabel{name, value})
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := make([]remoteLabel, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, remoteLabel{lp.GetName(), lp.GetValue()})
+			}
+			timestamp := ts
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				series(name, labels, m.GetCounter().GetValue(), timestamp)
+			case dto.MetricType_GAUGE:
+				series(name, labels, m.GetGauge().GetValue(), timestamp)
+			case dto.MetricType_UNTYPED:
+				series(name, labels, m.GetUntyped().GetValue(), timestamp)
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				hasInf := false
+				for _, b := range h.GetBucket() {
+					hasInf = hasInf || math.IsInf(b.GetUpperBound(), +1)
+					series(name+"_bucket", withLabel(labels, "le", formatFloat(b.GetUpperBound())), float64(b.GetCumulativeCount()), timestamp)
+				}
+				if !hasInf {
+					series(name+"_bucket", withLabel(labels, "le", "+Inf"), float64(h.GetSampleCount()), timestamp)
+				}
+				series(name+"_sum", labels, h.GetSampleSum(), timestamp)
+				series(name+"_count", labels, float64(h.GetSampleCount()), timestamp)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					series(name, withLabel(labels, "quantile", formatFloat(q.GetQuantile())), q.GetValue(), timestamp)
+				}
+				series(name+"_sum", labels, s.GetSampleSum(), timestamp)
+				series(name+"_count", labels, float64(s.GetSampleCount()), timestamp)
+			}
+		}
+	}
+	return buf
+}
+
+// encodeTimeSeries encodes a single-sample TimeSeries message.  Labels are
+// sorted by name, as required by the remote-write protocol.
+func encodeTimeSeries(name string, labels []remoteLabel, value float64, timestamp int64) []byte {
+	all := append([]remoteLabel{{"__name__", name}}, labels...)
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	var buf []byte
+	for _, l := range all {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, lb)
+	}
+
+	var sb []byte
+	sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+	sb = protowire.AppendFixed64(sb, math.Float64bits(value))
+	sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+	sb = protowire.AppendVarint(sb, uint64(timestamp))
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendBytes(buf, sb)
+	return buf
+}
+
+// formatFloat formats a bucket bound or quantile like the text exposition
+// format does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,172 @@
+package ginprom
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries is a remote-write time series decoded by the test.
+type decodedSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// decodeWriteRequest parses a WriteRequest message, failing the test on any
+// framing error.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	t.Helper()
+	var out []decodedSeries
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected WriteRequest field %d/%d", num, typ)
+		}
+		b = b[n:]
+		tsb, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatal("truncated TimeSeries")
+		}
+		b = b[n:]
+
+		ds := decodedSeries{labels: map[string]string{}}
+		for len(tsb) > 0 {
+			num, _, n := protowire.ConsumeTag(tsb)
+			tsb = tsb[n:]
+			msg, n := protowire.ConsumeBytes(tsb)
+			if n < 0 {
+				t.Fatal("truncated TimeSeries field")
+			}
+			tsb = tsb[n:]
+			fields := map[protowire.Number][]byte{}
+			var fixed uint64
+			for len(msg) > 0 {
+				fnum, ftyp, n := protowire.ConsumeTag(msg)
+				msg = msg[n:]
+				n = protowire.ConsumeFieldValue(fnum, ftyp, msg)
+				if n < 0 {
+					t.Fatal("truncated field value")
+				}
+				if ftyp == protowire.BytesType {
+					fields[fnum], _ = protowire.ConsumeBytes(msg)
+				} else if ftyp == protowire.Fixed64Type {
+					fixed, _ = protowire.ConsumeFixed64(msg)
+				}
+				msg = msg[n:]
+			}
+			switch num {
+			case 1:
+				ds.labels[string(fields[1])] = string(fields[2])
+			case 2:
+				ds.value = math.Float64frombits(fixed)
+			}
+		}
+		out = append(out, ds)
+	}
+	return out
+}
+
+func TestStartRemoteWriter_PayloadFraming(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/items")
+
+	received := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Content-Encoding"); got != "snappy" {
+			t.Errorf("expected snappy encoding, got %q", got)
+		}
+		if got := req.Header.Get("Content-Type"); got != "application/x-protobuf" {
+			t.Errorf("expected protobuf content type, got %q", got)
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			t.Errorf("expected basic auth credentials, got %q/%q", user, pass)
+		}
+		body, _ := io.ReadAll(req.Body)
+		select {
+		case received <- body:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	stop, err := StartRemoteWriter(context.Background(), mc, srv.URL, 10*time.Millisecond,
+		WithRemoteWriteBasicAuth("user", "pass"))
+	if err != nil {
+		t.Fatalf("StartRemoteWriter: %v", err)
+	}
+	defer stop()
+
+	var body []byte
+	select {
+	case body = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a push")
+	}
+
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("payload is not snappy-compressed: %v", err)
+	}
+	var found, foundInf bool
+	for _, s := range decodeWriteRequest(t, raw) {
+		switch s.labels["__name__"] {
+		case "http_requests_total":
+			found = s.labels["path"] == "/items" && s.labels["status_code"] == "200" && s.value == 1
+		case "http_request_duration_seconds_bucket":
+			foundInf = foundInf || (s.labels["le"] == "+Inf" && s.value == 1)
+		}
+	}
+	if !found {
+		t.Error("expected http_requests_total{path=\"/items\",status_code=\"200\"} 1 in the payload")
+	}
+	if !foundInf {
+		t.Error("expected a +Inf duration bucket in the payload")
+	}
+}
+
+func TestMetricsCollectionClose_FlushesRemoteWriter(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	var pushes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pushes.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// The interval is long enough that only Close pushes
+	if _, err := StartRemoteWriter(context.Background(), mc, srv.URL, time.Hour); err != nil {
+		t.Fatalf("StartRemoteWriter: %v", err)
+	}
+	if err := mc.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := pushes.Load(); got != 1 {
+		t.Errorf("expected Close to flush once, got %d pushes", got)
+	}
+
+	if _, err := StartRemoteWriter(context.Background(), mc, srv.URL, time.Hour); err == nil {
+		t.Error("expected an error when starting a writer on a closed collection")
+	}
+}
+
+func TestStartRemoteWriter_InvalidArguments(t *testing.T) {
+	if _, err := StartRemoteWriter(context.Background(), nil, "not a url", time.Second); err == nil {
+		t.Error("expected an error for an invalid endpoint")
+	}
+	if _, err := StartRemoteWriter(context.Background(), nil, "http://localhost/write", 0); err == nil {
+		t.Error("expected an error for a non-positive interval")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,6 +13,27 @@ import (
 // It avoids reading the entire request body when possible by using Content-Length.
 // Returns the calculated size in bytes and an error if the request cannot be processed.
 func calculateRequestSize(r *http.Request) (int64, error) {
+	size := requestHeaderSize(r)
+
+	// For the body size, prefer using Content-Length when available
+	if r.ContentLength > 0 {
+		size += r.ContentLength
+	} else if r.ContentLength < 0 && r.Body != nil {
+		// Only read the body if Content-Length is not available (-1)
+		// and the request has a body
+		bodySize, err := calculateBodySizeStream(r)
+		if err != nil {
+			return 0, err
+		}
+		size += bodySize
+	}
+
+	return size, nil
+}
+
+// requestHeaderSize estimates the size of the request line and headers of an
+// HTTP request.  It never touches the request body.
+func requestHeaderSize(r *http.Request) int64 {
 	var size int64
 
 	// Add the request line size: method + " " + URL + " " + proto + "\r\n"
@@ -26,20 +48,46 @@ func calculateRequestSize(r *http.Request) (int64, error) {
 	}
 	size += 2 // Extra \r\n after headers
 
-	// For the body size, prefer using Content-Length when available
-	if r.ContentLength > 0 {
-		size += r.ContentLength
-	} else if r.ContentLength < 0 && r.Body != nil {
-		// Only read the body if Content-Length is not available (-1)
-		// and the request has a body
-		bodySize, err := calculateBodySizeStream(r)
-		if err != nil {
-			return 0, err
+	return size
+}
+
+// isUpgradeRequest reports whether r is a CONNECT request or asks for a
+// protocol upgrade, such as a WebSocket handshake.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.Header.Get("Upgrade") != ""
+}
+
+// trailerSize estimates the wire size of the trailers set in the response
+// header h, both those announced in the "Trailer" header and those set with
+// the [http.TrailerPrefix] convention.  Like requestHeaderSize it counts each
+// "Name: value\r\n" line, plus the final "\r\n".
+func trailerSize(h http.Header) int64 {
+	var size int64
+	add := func(name string, values []string) {
+		size += int64(len(name) + 2) // Trailer name and ": "
+		for _, value := range values {
+			size += int64(len(value) + 2) // Trailer value and "\r\n"
 		}
-		size += bodySize
 	}
 
-	return size, nil
+	for _, declared := range h.Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values := h[name]; name != "" && len(values) > 0 {
+				add(name, values)
+			}
+		}
+	}
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			add(name, values)
+		}
+	}
+
+	if size > 0 {
+		size += 2 // Extra \r\n after trailers
+	}
+	return size
 }
 
 // calculateBodySizeStream calculates the size of the request body using a streaming approach
@@ -258,3 +258,201 @@ func TestComputeResponseSize_WithResponse(t *testing.T) {
 		t.Errorf("expected positive size, got %d", size)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// recordedRequestSize
+// ---------------------------------------------------------------------------
+
+// trackingReader records whether anything tried to read from it.
+type trackingReader struct {
+	io.Reader
+	read bool
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestRecordedRequestSize_ContentLengthOnly(t *testing.T) {
+	body := &trackingReader{Reader: strings.NewReader("streamed upload")}
+	req, _ := http.NewRequest("POST", "/upload", body)
+	req.ContentLength = -1
+	req.Header.Set("Transfer-Encoding", "chunked")
+
+	conf := applyOpt(WithRequestSizeFromContentLengthOnly(true))
+	size := recordedRequestSize(conf, req)
+
+	if body.read {
+		t.Error("expected the body not to be read")
+	}
+	if want := requestHeaderSize(req); size != want {
+		t.Errorf("expected header-only size %d, got %d", want, size)
+	}
+}
+
+func TestRecordedRequestSize_DefaultReadsUnknownLength(t *testing.T) {
+	body := &trackingReader{Reader: strings.NewReader("streamed upload")}
+	req, _ := http.NewRequest("POST", "/upload", body)
+	req.ContentLength = -1
+
+	size := recordedRequestSize(defaultConf(), req)
+
+	if !body.read {
+		t.Error("expected the default behaviour to read the body")
+	}
+	if size <= requestHeaderSize(req) {
+		t.Errorf("expected the body to be counted, got %d", size)
+	}
+}
+
+func TestWithRequestSizeMode(t *testing.T) {
+	newRequest := func(contentLength int64) *http.Request {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("hello"))
+		req.Header = http.Header{"X-A": {"b"}}
+		req.ContentLength = contentLength
+		return req
+	}
+	// "POST /upload HTTP/1.1\r\n" + "X-A: b\r\n" + "\r\n"
+	const headers = 23 + 8 + 2
+
+	tests := []struct {
+		name          string
+		mode          RequestSizeMode
+		contentLength int64
+		want          int64
+	}{
+		{"full declared", RequestSizeFull, 5, 5},
+		{"full chunked", RequestSizeFull, -1, headers + 5},
+		{"body only declared", RequestSizeBodyOnly, 5, 5},
+		{"body only chunked", RequestSizeBodyOnly, -1, 5},
+		{"headers only declared", RequestSizeHeadersOnly, 5, headers},
+		{"headers only chunked", RequestSizeHeadersOnly, -1, headers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := applyOpt(WithRequestSizeMode(tt.mode))
+			if got := recordedRequestSize(conf, newRequest(tt.contentLength)); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWithRequestSizeMode_HeadersOnlyNeverReadsBody(t *testing.T) {
+	body := &trackingReader{Reader: strings.NewReader("streamed upload")}
+	req, _ := http.NewRequest("POST", "/upload", body)
+	req.ContentLength = -1
+
+	recordedRequestSize(applyOpt(WithRequestSizeMode(RequestSizeHeadersOnly)), req)
+	if body.read {
+		t.Error("expected the body not to be read")
+	}
+}
+
+func TestWithStreamingRequestSize(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc,
+		WithStreamingRequestSize(true),
+		WithRequestSizeMode(RequestSizeBodyOnly),
+	))
+	r.POST("/partial", func(c *gin.Context) {
+		buf := make([]byte, 4)
+		_, _ = io.ReadFull(c.Request.Body, buf)
+		c.Status(http.StatusOK)
+	})
+	r.POST("/full", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		c.Status(http.StatusOK)
+	})
+	r.POST("/ignore", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	const upload = "0123456789abcdef"
+	var bodies []*trackingReader
+	for _, path := range []string{"/partial", "/full", "/ignore"} {
+		body := &trackingReader{Reader: strings.NewReader(upload)}
+		bodies = append(bodies, body)
+		req, _ := http.NewRequest("POST", path, body)
+		req.ContentLength = -1
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mf := gatherFamily(t, reg, "http_request_size_bytes")
+	if mf == nil {
+		t.Fatal("expected the request size to be recorded")
+	}
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		got[labelValue(m, "path")] = m.GetHistogram().GetSampleSum()
+	}
+	want := map[string]float64{"/partial": 4, "/full": float64(len(upload)), "/ignore": 0}
+	for path, size := range want {
+		if got[path] != size {
+			t.Errorf("%s: expected a size of %v, got %v", path, size, got[path])
+		}
+	}
+	if bodies[2].read {
+		t.Error("expected the middleware not to read a body the handler ignored")
+	}
+}
+
+func TestWithStreamingRequestSize_FullAddsHeaders(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithStreamingRequestSize(true)))
+	var headers int64
+	r.POST("/upload", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		headers = requestHeaderSize(c.Request)
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	mf := gatherFamily(t, reg, "http_request_size_bytes")
+	if mf == nil || mf.GetMetric()[0].GetHistogram().GetSampleSum() != float64(headers+5) {
+		t.Errorf("expected the headers plus the 5 bytes read, got %v", mf)
+	}
+}
+
+func TestTrailerSize(t *testing.T) {
+	h := http.Header{}
+	if got := trailerSize(h); got != 0 {
+		t.Errorf("expected no trailer size without trailers, got %d", got)
+	}
+
+	h.Set("Trailer", "X-Checksum")
+	h.Set("X-Checksum", "abc")
+	h.Set(http.TrailerPrefix+"Grpc-Status", "0")
+	// "X-Checksum: abc\r\n" + "Grpc-Status: 0\r\n" + "\r\n"
+	if got, want := trailerSize(h), int64(17+16+2); got != want {
+		t.Errorf("expected trailer size %d, got %d", want, got)
+	}
+}
+
+func TestWithIncludeTrailers_GrowsResponseSize(t *testing.T) {
+	sizeFor := func(include bool) float64 {
+		mc, reg := newTestMetricsWithRegistry()
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, WithIncludeTrailers(include)))
+		r.GET("/stream", func(c *gin.Context) {
+			c.Header("Trailer", "X-Checksum")
+			c.String(http.StatusOK, "chunk")
+			c.Writer.Header().Set("X-Checksum", "abc")
+		})
+		performRequest(r, "GET", "/stream")
+
+		mf := gatherFamily(t, reg, "http_response_size_bytes")
+		if mf == nil {
+			t.Fatal("expected the response size to be recorded")
+		}
+		return mf.GetMetric()[0].GetHistogram().GetSampleSum()
+	}
+
+	without, with := sizeFor(false), sizeFor(true)
+	if want := without + float64(len("X-Checksum: abc\r\n\r\n")); with != want {
+		t.Errorf("expected response size %v with trailers, got %v (without: %v)", want, with, without)
+	}
+}
@@ -0,0 +1,280 @@
+package ginprom
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseWriter wraps the Gin response writer so the middleware can observe
+// what the rest of the handler chain writes.  It is only installed when an
+// option needs information that gin.ResponseWriter does not expose.
+type responseWriter struct {
+	gin.ResponseWriter
+	conf *config
+	// start is when the middleware started timing the request
+	start time.Time
+
+	// wireBytes counts the bytes passed through this writer, i.e. after any
+	// encoding applied by handlers further down the chain.
+	wireBytes int64
+	// attemptedBytes counts the bytes handed to Write, including those the
+	// wrapped writer refused
+	attemptedBytes int64
+	// inflater decodes gzip-encoded output to measure its logical size,
+	// which is stored in logicalBytes by finish (-1 when unknown).
+	inflater     *inflateCounter
+	logicalBytes int64
+
+	// headerStatus is the status of the last WriteHeader call made before
+	// the response was sent, 0 if there was none
+	headerStatus int
+
+	// hijacked is set once a handler took over the connection
+	hijacked bool
+
+	// writeFailed is set once writing the body returned an error
+	writeFailed bool
+
+	// flushes counts the calls to Flush
+	flushes int
+
+	// closeNotified is set once a handler asked to be told when the client
+	// goes away, as streaming handlers do
+	closeNotified bool
+
+	// errorBody holds the start of a server error response body
+	errorBody []byte
+}
+
+// responseWriterPool recycles wrappers so that options needing one do not
+// cost an allocation per request.
+var responseWriterPool = sync.Pool{
+	New: func() any { return new(responseWriter) },
+}
+
+// newResponseWriter wraps w for a single request.  The wrapper must be handed
+// back with release once the request was recorded.
+func newResponseWriter(w gin.ResponseWriter, conf *config, start time.Time) *responseWriter {
+	rw := responseWriterPool.Get().(*responseWriter)
+	*rw = responseWriter{ResponseWriter: w, conf: conf, start: start, logicalBytes: -1}
+	return rw
+}
+
+// release returns the wrapper to the pool.  It must not be used afterwards.
+// Wrappers of hijacked or streamed responses are left to the garbage
+// collector instead: the goroutine serving the connection or the stream may
+// outlive the handler and must not reach a wrapper reused by another request.
+func (w *responseWriter) release() {
+	if w.hijacked || w.flushes > 0 || w.closeNotified {
+		return
+	}
+	*w = responseWriter{}
+	responseWriterPool.Put(w)
+}
+
+// finish releases the resources held for the request.  It must be called once
+// the handler chain has returned, and is safe to call more than once.
+func (w *responseWriter) finish() {
+	if w.inflater != nil {
+		w.logicalBytes = w.inflater.Close()
+		w.inflater = nil
+	}
+}
+
+// needsResponseWriter reports whether any enabled option requires the
+// response writer to be wrapped.  The wrapper is recycled once the request
+// was recorded, so c.Writer must not be used after the handler returned,
+// except by hijacked connections and streamed responses, see release.
+func (c *config) needsResponseWriter() bool {
+	return c.recordCompressionRatio || c.webSocketMode != WebSocketRecord || c.errorBodyCapture != nil || c.exactResponseSize || c.accurateStatus || c.detectContentLengthMismatch || c.trackWriteErrors || c.responseTimeHeader != "" || c.recordFlushCount
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CloseNotify remembers that the response is streamed, see release.
+func (w *responseWriter) CloseNotify() <-chan bool {
+	w.closeNotified = true
+	return w.ResponseWriter.CloseNotify()
+}
+
+// Hijack takes over the connection and remembers that the response status and
+// size no longer describe what was sent to the client.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// WriteHeader remembers the status actually requested by the handler chain.
+// Informational statuses other than 101 are not final and are ignored, as are
+// calls made once the response was sent.
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.ResponseWriter.Written() && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		w.headerStatus = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// WriteHeaderNow sends the response header, stamping the elapsed time first.
+func (w *responseWriter) WriteHeaderNow() {
+	w.stampResponseTime()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush sends what was written so far, stamping the elapsed time first if the
+// response header was not sent yet, and counts the call.
+func (w *responseWriter) Flush() {
+	w.stampResponseTime()
+	w.flushes++
+	w.ResponseWriter.Flush()
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	w.stampResponseTime()
+	w.observeWrite(data)
+	w.attemptedBytes += int64(len(data))
+	n, err := w.ResponseWriter.Write(data)
+	w.wireBytes += int64(n)
+	if err != nil {
+		w.writeFailed = true
+	}
+	return n, err
+}
+
+func (w *responseWriter) WriteString(s string) (int, error) {
+	w.stampResponseTime()
+	// Converting s allocates, so only do it when the bytes are looked at
+	if w.conf.errorBodyCapture != nil || w.conf.recordCompressionRatio {
+		w.observeWrite([]byte(s))
+	}
+	w.attemptedBytes += int64(len(s))
+	n, err := w.ResponseWriter.WriteString(s)
+	w.wireBytes += int64(n)
+	if err != nil {
+		w.writeFailed = true
+	}
+	return n, err
+}
+
+// stampResponseTime sets the header configured with [WithResponseTimeHeader]
+// to the time elapsed since the request started, as long as the response
+// header was not sent yet.  It is called before anything is sent, so the
+// last call before the header goes out wins.
+func (w *responseWriter) stampResponseTime() {
+	if w.conf.responseTimeHeader == "" || w.ResponseWriter.Written() {
+		return
+	}
+	ms := float64(w.conf.now().Sub(w.start)) / float64(time.Millisecond)
+	w.Header().Set(w.conf.responseTimeHeader, strconv.FormatFloat(ms, 'f', 3, 64))
+}
+
+// observeWrite feeds the encoded bytes to the inflater, starting it on the
+// first write of a gzip-encoded response.
+func (w *responseWriter) observeWrite(data []byte) {
+	if w.conf.errorBodyCapture != nil {
+		w.captureErrorBody(data)
+	}
+	if !w.conf.recordCompressionRatio {
+		return
+	}
+	if w.inflater == nil && w.wireBytes == 0 && w.Header().Get("Content-Encoding") == "gzip" {
+		w.inflater = newInflateCounter()
+	}
+	if w.inflater != nil {
+		w.inflater.Write(data)
+	}
+}
+
+// captureErrorBody keeps the first bytes of server error responses for the
+// [WithErrorBodyCapture] callback.  Other responses are not copied.
+func (w *responseWriter) captureErrorBody(data []byte) {
+	if w.Status() < http.StatusInternalServerError {
+		return
+	}
+	if room := w.conf.errorBodyMaxBytes - len(w.errorBody); room > 0 {
+		if len(data) > room {
+			data = data[:room]
+		}
+		w.errorBody = append(w.errorBody, data...)
+	}
+}
+
+// contentLengthMismatch reports whether the declared Content-Length of the
+// response differs from the number of bytes written for it.  Responses
+// without a valid Content-Length or that must not carry a body never
+// mismatch.
+func (w *responseWriter) contentLengthMismatch(r *http.Request) bool {
+	if w.hijacked || r.Method == http.MethodHead {
+		return false
+	}
+	if status := w.Status(); status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	declared, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if err != nil || declared < 0 {
+		return false
+	}
+	return declared != w.attemptedBytes
+}
+
+// compressionRatio returns the ratio between the uncompressed and the
+// compressed size of the response.  ok is false when the response was not
+// gzip-encoded or could not be decoded.
+func (w *responseWriter) compressionRatio() (ratio float64, ok bool) {
+	if w.logicalBytes < 0 || w.wireBytes == 0 {
+		return 0, false
+	}
+	return float64(w.logicalBytes) / float64(w.wireBytes), true
+}
+
+// inflateCounter decodes a gzip stream written to it and counts the
+// uncompressed bytes without buffering the response.
+type inflateCounter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	n    int64
+}
+
+func newInflateCounter() *inflateCounter {
+	pr, pw := io.Pipe()
+	ic := &inflateCounter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(ic.done)
+		zr, err := gzip.NewReader(pr)
+		if err == nil {
+			ic.n, err = io.Copy(io.Discard, zr)
+		}
+		if err != nil {
+			ic.n = -1
+		}
+		// Keep draining so writes never block on a stream we failed to decode
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	return ic
+}
+
+// Write hands data to the decoder; it blocks until the decoder consumed it.
+func (ic *inflateCounter) Write(data []byte) {
+	_, _ = ic.pw.Write(data)
+}
+
+// Close ends the stream and returns the number of uncompressed bytes, or -1
+// if the stream was not valid gzip.  It must be called exactly once.
+func (ic *inflateCounter) Close() int64 {
+	_ = ic.pw.Close()
+	<-ic.done
+	return ic.n
+}
@@ -0,0 +1,491 @@
+package ginprom
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipWriter is a minimal stand-in for gin-contrib/gzip's writer.
+type gzipWriter struct {
+	gin.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipWriter) Write(data []byte) (int, error) {
+	return g.gz.Write(data)
+}
+
+func (g *gzipWriter) WriteString(s string) (int, error) {
+	return g.gz.Write([]byte(s))
+}
+
+// gzipMiddleware compresses every response, like gin-contrib/gzip.
+func gzipMiddleware(c *gin.Context) {
+	c.Header("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(c.Writer)
+	c.Writer = &gzipWriter{ResponseWriter: c.Writer, gz: gz}
+	c.Next()
+	_ = gz.Close()
+}
+
+// ---------------------------------------------------------------------------
+// WithRecordCompressionRatio
+// ---------------------------------------------------------------------------
+
+func TestWithRecordCompressionRatio(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordCompressionRatio(true)))
+	r.Use(gzipMiddleware)
+	body := strings.Repeat("compressible ", 1000)
+	r.GET("/text", func(c *gin.Context) { c.String(http.StatusOK, body) })
+
+	w := performRequest(r, "GET", "/text")
+	wireSize := w.Body.Len()
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("response is not gzip: %v", err)
+	}
+	zr.Close()
+
+	mf := gatherFamily(t, reg, "http_response_compression_ratio")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one ratio series, got %v", mf)
+	}
+	h := mf.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 1 {
+		t.Fatalf("expected one observation, got %d", h.GetSampleCount())
+	}
+	if want := float64(len(body)) / float64(wireSize); h.GetSampleSum() < want*0.99 || h.GetSampleSum() > want*1.01 {
+		t.Errorf("expected ratio ~%.2f, got %.2f", want, h.GetSampleSum())
+	}
+}
+
+func TestWithRecordCompressionRatio_PanicDoesNotLeak(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(gin.CustomRecovery(func(c *gin.Context, _ any) { c.AbortWithStatus(http.StatusInternalServerError) }))
+	r.Use(MiddlewareWithMetrics(mc, WithRecordCompressionRatio(true)))
+	r.GET("/panic", func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(c.Writer)
+		_, _ = gz.Write([]byte(strings.Repeat("partial ", 100)))
+		_ = gz.Flush()
+		panic("handler failed mid-response")
+	})
+
+	before := runtime.NumGoroutine()
+	performRequest(r, "GET", "/panic")
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("expected no goroutine left after the panic, %d running instead of %d", n, before)
+	}
+}
+
+func TestWithRecordCompressionRatio_Uncompressed(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordCompressionRatio(true)))
+	r.GET("/plain", func(c *gin.Context) { c.String(http.StatusOK, "plain") })
+
+	performRequest(r, "GET", "/plain")
+
+	if mf := gatherFamily(t, reg, "http_response_compression_ratio"); mf != nil {
+		t.Errorf("expected no ratio for an uncompressed response, got %v", mf)
+	}
+}
+
+func TestInflateCounter_InvalidStream(t *testing.T) {
+	ic := newInflateCounter()
+	ic.Write([]byte("definitely not gzip"))
+	if n := ic.Close(); n != -1 {
+		t.Errorf("expected -1 for an invalid stream, got %d", n)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithWebSocketHandling
+// ---------------------------------------------------------------------------
+
+// performHijackedRequest serves a request whose handler hijacks the
+// connection, as WebSocket libraries do, and waits until the middleware ran.
+func performHijackedRequest(t *testing.T, mc *MetricsCollection, options ...Option) {
+	t.Helper()
+	done := make(chan struct{})
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		defer close(done)
+		c.Next()
+	})
+	r.Use(MiddlewareWithMetrics(mc, options...))
+	r.GET("/ws", func(c *gin.Context) {
+		conn, buf, err := c.Writer.Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+	})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatalf("reading upgrade response: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handler chain")
+	}
+}
+
+func TestWithWebSocketHandling_Skip(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performHijackedRequest(t, mc, WithWebSocketHandling(WebSocketSkip))
+
+	for _, name := range []string{"http_requests_total", "http_response_size_bytes", "http_request_duration_seconds"} {
+		if mf := gatherFamily(t, reg, name); mf != nil {
+			t.Errorf("%s: expected no series for a hijacked request, got %v", name, mf)
+		}
+	}
+}
+
+func TestWithWebSocketHandling_Label(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	performHijackedRequest(t, mc, WithWebSocketHandling(WebSocketLabel))
+
+	if mf := gatherFamily(t, reg, "http_response_size_bytes"); mf != nil {
+		t.Errorf("expected no response size for a hijacked request, got %v", mf)
+	}
+	mf := gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one request series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "status_code"); got != "websocket" {
+		t.Errorf("expected status_code %q, got %q", "websocket", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithErrorBodyCapture
+// ---------------------------------------------------------------------------
+
+func TestWithErrorBodyCapture(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	var calls int
+	var gotStatus int
+	var gotBody string
+	capture := WithErrorBodyCapture(8, func(c *gin.Context, status int, body []byte) {
+		calls++
+		gotStatus = status
+		gotBody = string(body)
+	})
+
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, capture))
+	r.GET("/fail", func(c *gin.Context) {
+		c.String(http.StatusBadGateway, "upstream timed out")
+	})
+	r.GET("/ok", func(c *gin.Context) {
+		c.String(http.StatusOK, "fine")
+	})
+
+	performRequest(r, "GET", "/ok")
+	if calls != 0 {
+		t.Fatalf("expected no capture for a successful response, got %d calls", calls)
+	}
+
+	performRequest(r, "GET", "/fail")
+	if calls != 1 {
+		t.Fatalf("expected 1 capture, got %d", calls)
+	}
+	if gotStatus != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d", http.StatusBadGateway, gotStatus)
+	}
+	if gotBody != "upstream" {
+		t.Errorf("expected body truncated to %q, got %q", "upstream", gotBody)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WithExactResponseSize
+// ---------------------------------------------------------------------------
+
+// uncountedWriter writes straight through but keeps no bookkeeping of its
+// own, like third-party writers that embed gin.ResponseWriter only to satisfy
+// the interface.
+type uncountedWriter struct {
+	gin.ResponseWriter
+}
+
+func (u *uncountedWriter) Size() int { return 0 }
+
+func TestWithExactResponseSize(t *testing.T) {
+	sizeFor := func(opts ...Option) float64 {
+		mc, reg := newTestMetricsWithRegistry()
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, opts...))
+		r.GET("/raw", func(c *gin.Context) {
+			c.Writer = &uncountedWriter{ResponseWriter: c.Writer}
+			c.Writer.WriteHeader(http.StatusOK)
+			_, _ = c.Writer.Write([]byte("0123456789"))
+			_, _ = c.Writer.WriteString("abc")
+		})
+		performRequest(r, "GET", "/raw")
+
+		mf := gatherFamily(t, reg, "http_response_size_bytes")
+		if mf == nil {
+			t.Fatal("expected a response size series")
+		}
+		return mf.GetMetric()[0].GetHistogram().GetSampleSum()
+	}
+
+	if got := sizeFor(); got != 0 {
+		t.Errorf("expected the writer's own size of 0 by default, got %v", got)
+	}
+	if got := sizeFor(WithExactResponseSize(true)); got != 13 {
+		t.Errorf("expected the exact size of 13 bytes, got %v", got)
+	}
+}
+
+// staleStatusWriter reports a fixed status whatever was written, like
+// writers that forward WriteHeader without tracking it.
+type staleStatusWriter struct {
+	gin.ResponseWriter
+}
+
+func (s *staleStatusWriter) Status() int { return http.StatusOK }
+
+func TestWithAccurateStatusCapture(t *testing.T) {
+	statusFor := func(wrap bool, opts ...Option) string {
+		mc, reg := newTestMetricsWithRegistry()
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, opts...))
+		r.GET("/proxy", func(c *gin.Context) {
+			if wrap {
+				c.Writer = &staleStatusWriter{ResponseWriter: c.Writer}
+			}
+			c.Writer.WriteHeader(http.StatusBadGateway)
+			_, _ = c.Writer.Write([]byte("upstream failed"))
+			// Too late to change the status sent to the client
+			c.Writer.WriteHeader(http.StatusOK)
+		})
+		performRequest(r, "GET", "/proxy")
+
+		mf := gatherFamily(t, reg, "http_requests_total")
+		if mf == nil || len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected one series, got %v", mf)
+		}
+		return labelValue(mf.GetMetric()[0], "status_code")
+	}
+
+	if got := statusFor(false, WithAccurateStatusCapture(true)); got != "502" {
+		t.Errorf("expected the written status 502, got %q", got)
+	}
+	if got := statusFor(true); got != "200" {
+		t.Errorf("expected the writer's own status by default, got %q", got)
+	}
+	if got := statusFor(true, WithAccurateStatusCapture(true)); got != "502" {
+		t.Errorf("expected the written status 502 behind a stale writer, got %q", got)
+	}
+}
+
+func TestWithDetectContentLengthMismatch(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithDetectContentLengthMismatch(true)))
+	r.GET("/liar", func(c *gin.Context) {
+		c.Header("Content-Length", "100")
+		c.String(http.StatusOK, "short")
+	})
+	r.GET("/honest", func(c *gin.Context) {
+		c.Header("Content-Length", "5")
+		c.String(http.StatusOK, "exact")
+	})
+	r.GET("/undeclared", func(c *gin.Context) { c.String(http.StatusOK, "whatever") })
+	r.GET("/cached", func(c *gin.Context) {
+		c.Header("Content-Length", "1234")
+		c.Status(http.StatusNotModified)
+	})
+	for _, p := range []string{"/liar", "/honest", "/undeclared", "/cached"} {
+		performRequest(r, "GET", p)
+	}
+
+	mf := gatherFamily(t, reg, "http_content_length_mismatches_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected a single mismatch series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "path") != "/liar" || m.GetCounter().GetValue() != 1 {
+		t.Errorf("expected one mismatch for /liar, got %v", m)
+	}
+}
+
+// disconnectedWriter fails every write, like the connection of a client that
+// went away mid-response.
+type disconnectedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (d disconnectedWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestWithTrackWriteErrors(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithTrackWriteErrors(true)))
+	r.GET("/stream", func(c *gin.Context) {
+		c.String(http.StatusOK, "first")
+		c.String(http.StatusOK, "second")
+	})
+
+	r.ServeHTTP(disconnectedWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/stream", nil))
+	performRequest(r, "GET", "/stream")
+
+	mf := gatherFamily(t, reg, "http_response_write_errors_total")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected a single write error series, got %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if labelValue(m, "path") != "/stream" || m.GetCounter().GetValue() != 1 {
+		t.Errorf("expected one failed response for /stream, got %v", m)
+	}
+}
+
+func TestWithResponseTimeHeader(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mc, _ := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithClock(clock.Now), WithResponseTimeHeader("X-Response-Time-Ms")))
+	r.GET("/body", func(c *gin.Context) {
+		clock.Advance(250 * time.Millisecond)
+		c.String(http.StatusOK, "hello")
+		clock.Advance(time.Second)
+	})
+	r.GET("/empty", func(c *gin.Context) {
+		clock.Advance(40 * time.Millisecond)
+		c.Status(http.StatusNoContent)
+	})
+
+	for p, want := range map[string]float64{"/body": 250, "/empty": 40} {
+		header := performRequest(r, "GET", p).Header().Get("X-Response-Time-Ms")
+		got, err := strconv.ParseFloat(header, 64)
+		if err != nil {
+			t.Errorf("%s: expected a numeric header, got %q", p, header)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %vms, got %v", p, want, got)
+		}
+	}
+}
+
+func TestWithRecordFlushCount(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordFlushCount(true)))
+	r.GET("/events", func(c *gin.Context) {
+		for i := 0; i < 3; i++ {
+			c.SSEvent("tick", i)
+			c.Writer.Flush()
+		}
+	})
+
+	w := performRequest(r, "GET", "/events")
+	if !w.Flushed {
+		t.Error("expected the flushes to reach the underlying writer")
+	}
+
+	mf := gatherFamily(t, reg, "http_response_flushes")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected a single flush series, got %v", mf)
+	}
+	h := mf.GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() != 3 {
+		t.Errorf("expected one observation of 3 flushes, got count %d sum %v", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
+
+func TestResponseWriter_RestoredAfterRequest(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	var before, after gin.ResponseWriter
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		before = c.Writer
+		c.Next()
+		after = c.Writer
+	})
+	r.Use(MiddlewareWithMetrics(mc, WithWebSocketHandling(WebSocketLabel)))
+	r.GET("/items", func(c *gin.Context) {
+		if _, ok := c.Writer.(*responseWriter); !ok {
+			t.Error("expected the handler to see the wrapper")
+		}
+		c.Status(http.StatusOK)
+	})
+	performRequest(r, "GET", "/items")
+
+	if after != before {
+		t.Error("expected the original writer to be restored once the wrapper was released")
+	}
+}
+
+func TestResponseWriter_StreamedNotRecycled(t *testing.T) {
+	mc, _ := newTestMetricsWithRegistry()
+	var plain, streamed *responseWriter
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRecordFlushCount(true)))
+	r.GET("/plain", func(c *gin.Context) {
+		plain = c.Writer.(*responseWriter)
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		streamed = c.Writer.(*responseWriter)
+		c.Stream(func(w io.Writer) bool {
+			_, _ = w.Write([]byte("chunk"))
+			return false
+		})
+	})
+	// Streaming needs a writer supporting CloseNotify, which the recorder
+	// lacks
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	performRequest(r, "GET", "/plain")
+
+	if plain.ResponseWriter != nil {
+		t.Error("expected the wrapper of a plain response to be reset for reuse")
+	}
+	if streamed.ResponseWriter == nil {
+		t.Error("expected the wrapper of a streamed response to be left intact")
+	}
+}
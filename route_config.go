@@ -0,0 +1,73 @@
+package ginprom
+
+import "sync"
+
+// RouteConfig holds per-route overrides of the middleware options, so that
+// large applications can opt individual routes in or out of measurements
+// declaratively instead of maintaining filter lists.  Attach it to a
+// middleware with [WithRouteConfig].
+//
+// Example:
+//
+//	rc := ginprom.NewRouteConfig()
+//	rc.ConfigureRoute("/api/v1/users/:id", ginprom.WithRecordDuration(false))
+//	r.Use(ginprom.Middleware(ginprom.WithRouteConfig(rc)))
+type RouteConfig struct {
+	mu     sync.RWMutex
+	routes map[string][]Option
+}
+
+// NewRouteConfig returns an empty [RouteConfig].
+func NewRouteConfig() *RouteConfig {
+	return &RouteConfig{routes: make(map[string][]Option)}
+}
+
+// ConfigureRoute adds options for the Gin route pattern route (e.g.
+// "/users/:id").  They are applied on top of the middleware options, so they
+// only need to cover what differs for that route.  Calling it again for the
+// same route appends to the earlier options.
+func (rc *RouteConfig) ConfigureRoute(route string, options ...Option) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.routes[route] = append(rc.routes[route], options...)
+}
+
+// WithRouteConfig applies the per-route overrides registered in rc.  The
+// overrides are resolved when the middleware is created, so routes must be
+// configured before calling [Middleware] or [MiddlewareWithMetrics].  Routes
+// without overrides use the middleware options unchanged.
+func WithRouteConfig(rc *RouteConfig) Option {
+	return func(c *config) {
+		c.routeConfig = rc
+	}
+}
+
+// resolveRouteConfig builds the configuration of every route overridden in
+// c.routeConfig, starting from a copy of c.
+func (c *config) resolveRouteConfig() {
+	if c.routeConfig == nil {
+		return
+	}
+	rc := c.routeConfig
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	c.routeOverrides = make(map[string]*config, len(rc.routes))
+	for route, options := range rc.routes {
+		rconf := *c
+		rconf.routeConfig = nil
+		rconf.routeOverrides = nil
+		for _, option := range options {
+			option(&rconf)
+		}
+		c.routeOverrides[route] = &rconf
+	}
+}
+
+// forRoute returns the configuration to use for route.
+func (c *config) forRoute(route string) *config {
+	if rconf, ok := c.routeOverrides[route]; ok {
+		return rconf
+	}
+	return c
+}
@@ -0,0 +1,35 @@
+package ginprom
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRouteConfig_OverridesOneRoute(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	rc := NewRouteConfig()
+	rc.ConfigureRoute("/users/:id", WithRecordDuration(false))
+
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc, WithRouteConfig(rc)))
+	r.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/orders", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	performRequest(r, "GET", "/users/42")
+	performRequest(r, "GET", "/orders")
+
+	mf := gatherFamily(t, reg, "http_request_duration_seconds")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected exactly one duration series, got %v", mf)
+	}
+	if got := labelValue(mf.GetMetric()[0], "path"); got != "/orders" {
+		t.Errorf("expected duration only for /orders, got %q", got)
+	}
+
+	mf = gatherFamily(t, reg, "http_requests_total")
+	if mf == nil || len(mf.GetMetric()) != 2 {
+		t.Errorf("expected both routes to be counted, got %v", mf)
+	}
+}
@@ -0,0 +1,39 @@
+package ginprom
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterRouteInfo records in mc.RouteMethods every method each route of r
+// is registered for.  Compared with the method label of the request metrics,
+// which only shows the methods that were exercised, it helps detect drift
+// between the routes an API declares and the ones its clients use.  Call it
+// once all routes have been added; calling it again adds the routes
+// registered since.  The first call builds and registers mc.RouteMethods,
+// and panics if it cannot be registered.
+//
+// Example:
+//
+//	ginprom.RegisterRouteInfo(r, mc)
+//
+// Unexercised methods can then be found with:
+//
+//	http_route_methods_info unless on (path, method) http_requests_total
+func RegisterRouteInfo(r *gin.Engine, mc *MetricsCollection) {
+	err := enableVec(mc, &mc.RouteMethods, func() *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: mc.metricName("http_route_methods_info"),
+				Help: "Methods each route is registered for, always 1.",
+			},
+			[]string{mc.pathLabelName(), mc.methodLabelName()},
+		)
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, route := range r.Routes() {
+		mc.RouteMethods.WithLabelValues(route.Path, route.Method).Set(1)
+	}
+}
@@ -0,0 +1,42 @@
+package ginprom
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegisterRouteInfo(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry()
+	r := gin.New()
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/items", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	r.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	if mc.RouteMethods != nil {
+		t.Fatal("expected RouteMethods to be built by RegisterRouteInfo only")
+	}
+	RegisterRouteInfo(r, mc)
+	RegisterRouteInfo(r, mc)
+
+	mf := gatherFamily(t, reg, "http_route_methods_info")
+	if mf == nil {
+		t.Fatal("expected http_route_methods_info to be exported")
+	}
+	got := map[string]bool{}
+	for _, m := range mf.GetMetric() {
+		if m.GetGauge().GetValue() != 1 {
+			t.Errorf("expected info value 1, got %v", m.GetGauge().GetValue())
+		}
+		got[labelValue(m, "method")+" "+labelValue(m, "path")] = true
+	}
+	for _, want := range []string{"GET /items", "POST /items", "GET /items/:id"} {
+		if !got[want] {
+			t.Errorf("expected %q in %v", want, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("expected 3 route methods, got %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package ginprom
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scrapeLimiter is a token bucket per client IP allowing perMinute requests
+// per minute, with bursts of up to perMinute.  Buckets that refilled
+// completely are swept at most once a minute, so memory is bounded by the
+// number of clients seen in the last two minutes.
+type scrapeLimiter struct {
+	perMinute float64
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the tokens left for a client as of updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newScrapeLimiter(perMinute int) *scrapeLimiter {
+	return &scrapeLimiter{
+		perMinute: float64(perMinute),
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of client and reports whether one was
+// left.  When none is left, retryAfter is the time until the next token.
+func (l *scrapeLimiter) allow(client string) (ok bool, retryAfter time.Duration) {
+	now := l.now()
+	rate := l.perMinute / time.Minute.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= time.Minute {
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*rate >= l.perMinute {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, found := l.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: l.perMinute, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*rate, l.perMinute)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// withScrapeRateLimit answers 429 Too Many Requests, with a Retry-After
+// header, to clients that exhausted their tokens.  Clients are identified by
+// the IP address of the connection.
+func withScrapeRateLimit(handler http.Handler, limiter *scrapeLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, retryAfter := limiter.allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
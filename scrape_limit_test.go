@@ -0,0 +1,72 @@
+package ginprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithScrapeRateLimit(t *testing.T) {
+	handler := GetMetricHandler(WithScrapeRateLimit(3))
+	scrape := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := scrape("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("scrape %d: expected 200 within the limit, got %d", i+1, w.Code)
+		}
+	}
+	w := scrape("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the limit, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if w := scrape("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to be unaffected, got %d", w.Code)
+	}
+}
+
+func TestScrapeLimiter_Refills(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := newScrapeLimiter(60)
+	l.now = clock.Now
+
+	for i := 0; i < 60; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d: expected the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.allow("a")
+	if ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("expected a refusal with a retry within a second, got ok=%v retryAfter=%v", ok, retryAfter)
+	}
+	clock.Advance(time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("expected a token to be back after a second")
+	}
+
+	clock.Advance(2 * time.Minute)
+	l.allow("b")
+	if _, found := l.buckets["a"]; found {
+		t.Error("expected the refilled bucket to be swept")
+	}
+}
+
+func TestWithScrapeRateLimit_DefaultUnlimited(t *testing.T) {
+	handler := GetMetricHandler()
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("scrape %d: expected 200 without a limit, got %d", i+1, w.Code)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package ginprom
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slidingWindowSamples is the number of most recent durations kept per path.
+// Older samples are dropped even if they are still inside the window.
+const slidingWindowSamples = 1024
+
+// WithRecordSlidingPercentiles exports the request-duration quantiles of the
+// last window per path as the http_request_duration_window_seconds gauge,
+// labelled by path and quantile, so that e.g. an instantaneous p99 is
+// available without a histogram_quantile query.  quantiles default to 0.99
+// and must lie strictly between 0 and 1; window must be positive.  Invalid
+// values make [NewMetricsCollectionE] return an error.
+//
+// The gauge is available as ResponseTimePercentiles.  Each path keeps its
+// last 1024 durations, which are sorted on every scrape; this costs more
+// memory and CPU than a histogram and the resulting quantiles cannot be
+// aggregated across instances, so use it for dashboards of individual
+// instances rather than as a replacement for the duration histogram.  Only
+// the durations observed by the duration histogram enter the window, so
+// sampled-out requests and upgrades skipped by [WithUpgradeHandling] do not
+// skew it.
+func WithRecordSlidingPercentiles(window time.Duration, quantiles ...float64) MetricsOption {
+	return func(mc *MetricsCollection) {
+		if window <= 0 {
+			mc.setErr(fmt.Errorf("ginprom: sliding percentile window must be positive, got %v", window))
+			return
+		}
+		if len(quantiles) == 0 {
+			quantiles = []float64{0.99}
+		}
+		for _, q := range quantiles {
+			if !(q > 0 && q < 1) {
+				mc.setErr(fmt.Errorf("ginprom: invalid sliding percentile quantile %v, must be in (0, 1)", q))
+				return
+			}
+		}
+		mc.slidingWindow = window
+		mc.slidingQuantiles = quantiles
+	}
+}
+
+// slidingSample is a duration observed at a point in time.
+type slidingSample struct {
+	at    time.Time
+	value float64
+}
+
+// slidingWindow is a fixed-size ring of the most recent samples of a path.
+type slidingWindow struct {
+	mu      sync.Mutex
+	samples [slidingWindowSamples]slidingSample
+	next    int
+	count   int
+}
+
+func (w *slidingWindow) add(at time.Time, value float64) {
+	w.mu.Lock()
+	w.samples[w.next] = slidingSample{at: at, value: value}
+	w.next = (w.next + 1) % slidingWindowSamples
+	if w.count < slidingWindowSamples {
+		w.count++
+	}
+	w.mu.Unlock()
+}
+
+// values returns the samples observed after since, in no particular order.
+func (w *slidingWindow) values(since time.Time) []float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	values := make([]float64, 0, w.count)
+	for i := 0; i < w.count; i++ {
+		if s := w.samples[i]; s.at.After(since) {
+			values = append(values, s.value)
+		}
+	}
+	return values
+}
+
+// slidingPercentiles keeps a sliding window of durations per path and
+// refreshes the quantile gauge from them whenever it is collected.
+type slidingPercentiles struct {
+	window         time.Duration
+	quantiles      []float64
+	quantileLabels []string
+	now            func() time.Time
+	gauge          *prometheus.GaugeVec
+
+	mu    sync.RWMutex
+	paths map[string]*slidingWindow
+}
+
+func newSlidingPercentiles(gauge *prometheus.GaugeVec, window time.Duration, quantiles []float64) *slidingPercentiles {
+	labels := make([]string, len(quantiles))
+	for i, q := range quantiles {
+		labels[i] = strconv.FormatFloat(q, 'g', -1, 64)
+	}
+	return &slidingPercentiles{
+		window:         window,
+		quantiles:      quantiles,
+		quantileLabels: labels,
+		now:            time.Now,
+		gauge:          gauge,
+		paths:          make(map[string]*slidingWindow),
+	}
+}
+
+// observe adds a duration, in seconds, to the window of path.
+func (sp *slidingPercentiles) observe(path string, seconds float64) {
+	sp.mu.RLock()
+	w, ok := sp.paths[path]
+	sp.mu.RUnlock()
+	if !ok {
+		sp.mu.Lock()
+		if w, ok = sp.paths[path]; !ok {
+			w = &slidingWindow{}
+			sp.paths[path] = w
+		}
+		sp.mu.Unlock()
+	}
+	w.add(sp.now(), seconds)
+}
+
+// refresh recomputes the quantiles of every path and forgets the paths that
+// saw no request during the window.
+func (sp *slidingPercentiles) refresh() {
+	since := sp.now().Add(-sp.window)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for path, w := range sp.paths {
+		values := w.values(since)
+		if len(values) == 0 {
+			delete(sp.paths, path)
+			for _, ql := range sp.quantileLabels {
+				sp.gauge.DeleteLabelValues(path, ql)
+			}
+			continue
+		}
+		sort.Float64s(values)
+		for i, q := range sp.quantiles {
+			sp.gauge.WithLabelValues(path, sp.quantileLabels[i]).Set(nearestRank(values, q))
+		}
+	}
+}
+
+// nearestRank returns the q-quantile of the sorted values.
+func nearestRank(sorted []float64, q float64) float64 {
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func (sp *slidingPercentiles) Describe(ch chan<- *prometheus.Desc) {
+	sp.gauge.Describe(ch)
+}
+
+func (sp *slidingPercentiles) Collect(ch chan<- prometheus.Metric) {
+	sp.refresh()
+	sp.gauge.Collect(ch)
+}
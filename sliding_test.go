@@ -0,0 +1,93 @@
+package ginprom
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSlidingPercentiles_KnownDurations(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRecordSlidingPercentiles(time.Minute, 0.5, 0.99))
+	clock := time.Unix(1000, 0)
+	mc.sliding.now = func() time.Time { return clock }
+
+	// 1ms .. 100ms, so the median is 50ms and the p99 is 99ms
+	for i := 1; i <= 100; i++ {
+		mc.sliding.observe("/items", float64(i)/1000)
+	}
+
+	mf := gatherFamily(t, reg, "http_request_duration_window_seconds")
+	if mf == nil {
+		t.Fatal("expected the sliding percentile gauge to be exported")
+	}
+	want := map[string]float64{"0.5": 0.050, "0.99": 0.099}
+	for _, m := range mf.GetMetric() {
+		q := labelValue(m, "quantile")
+		if got := m.GetGauge().GetValue(); math.Abs(got-want[q]) > 0.002 {
+			t.Errorf("quantile %s: expected ~%v, got %v", q, want[q], got)
+		}
+	}
+	if len(mf.GetMetric()) != len(want) {
+		t.Errorf("expected %d series, got %d", len(want), len(mf.GetMetric()))
+	}
+
+	// Once the window has passed the path is dropped
+	clock = clock.Add(2 * time.Minute)
+	if mf := gatherFamily(t, reg, "http_request_duration_window_seconds"); mf != nil {
+		t.Errorf("expected expired samples to be dropped, got %v", mf)
+	}
+}
+
+func TestSlidingPercentiles_Middleware(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(WithRecordSlidingPercentiles(time.Minute))
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.GET("/items", func(c *gin.Context) { c.Status(http.StatusOK) })
+	performRequest(r, "GET", "/items")
+
+	mf := gatherFamily(t, reg, "http_request_duration_window_seconds")
+	if mf == nil || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected one p99 series, got %v", mf)
+	}
+	if m := mf.GetMetric()[0]; labelValue(m, "path") != "/items" || labelValue(m, "quantile") != "0.99" {
+		t.Errorf("unexpected labels %v", m.GetLabel())
+	}
+}
+
+func TestSlidingPercentiles_SkipsUnrecordedDurations(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"upgrade skip":    {WithUpgradeHandling(UpgradeSkip)},
+		"duration off":    {WithRecordDuration(false)},
+		"sampled out 2xx": {WithErrorAwareSampling(0)},
+	} {
+		mc, reg := newTestMetricsWithRegistry(WithRecordSlidingPercentiles(time.Minute))
+		r := gin.New()
+		r.Use(MiddlewareWithMetrics(mc, opts...))
+		r.GET("/ws", func(c *gin.Context) { c.Status(http.StatusSwitchingProtocols) })
+
+		req, _ := http.NewRequest("GET", "/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if mf := gatherFamily(t, reg, "http_request_duration_window_seconds"); mf != nil {
+			t.Errorf("%s: expected the window to stay empty, got %v", name, mf)
+		}
+	}
+}
+
+func TestWithRecordSlidingPercentiles_Invalid(t *testing.T) {
+	for _, opt := range []MetricsOption{
+		WithRecordSlidingPercentiles(0),
+		WithRecordSlidingPercentiles(time.Minute, 1.5),
+	} {
+		if _, err := NewMetricsCollectionE(WithCustomRegistry(prometheus.NewRegistry()), opt); err == nil {
+			t.Error("expected an error for invalid sliding percentile settings")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package ginprom
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultSummaryObjectives are the quantiles, with their allowed error,
+// computed by size summaries when no objectives are given: the median, the
+// 90th and the 99th percentile.
+var DefaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// summarySettings records how a size summary should be built.
+type summarySettings struct {
+	objectives map[float64]float64
+	maxAge     time.Duration
+}
+
+// WithRequestSizeSummary exports http_request_size_bytes as a summary with
+// pre-computed quantiles instead of a histogram.  objectives maps each
+// quantile to its allowed error and defaults to [DefaultSummaryObjectives]
+// when nil; maxAge is how long observations are kept and defaults to
+// [prometheus.DefMaxAge] when zero.
+//
+// The summary is available as RequestSizeSummary and RequestSize stays nil.
+// Summaries cannot be aggregated across instances, so prefer the histogram
+// unless per-instance percentiles are what you need.
+func WithRequestSizeSummary(objectives map[float64]float64, maxAge time.Duration) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.requestSizeSummary = &summarySettings{objectives: objectives, maxAge: maxAge}
+	}
+}
+
+// WithResponseSizeSummary is the response-size counterpart of
+// [WithRequestSizeSummary]: http_response_size_bytes is exported as a summary,
+// available as ResponseSizeSummary, and ResponseSize stays nil.
+func WithResponseSizeSummary(objectives map[float64]float64, maxAge time.Duration) MetricsOption {
+	return func(mc *MetricsCollection) {
+		mc.responseSizeSummary = &summarySettings{objectives: objectives, maxAge: maxAge}
+	}
+}
+
+// newSizeSummary builds a size summary from its settings.
+func (mc *MetricsCollection) newSizeSummary(name, help string, s *summarySettings, labels []string) *prometheus.SummaryVec {
+	objectives := s.objectives
+	if objectives == nil {
+		objectives = DefaultSummaryObjectives
+	}
+	return prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       mc.metricName(name),
+			Help:       help,
+			Objectives: objectives,
+			MaxAge:     s.maxAge,
+		},
+		labels,
+	)
+}
+
+// buildSizeSummaries creates the size summaries requested by
+// [WithRequestSizeSummary] and [WithResponseSizeSummary].  It fails when a
+// custom histogram was supplied for the same metric.
+func (mc *MetricsCollection) buildSizeSummaries(labels []string) error {
+	if s := mc.requestSizeSummary; s != nil && mc.RequestSizeSummary == nil {
+		if mc.RequestSize != nil {
+			return errors.New("ginprom: WithRequestSizeSummary cannot be combined with WithCustomRequestSizeHistogram")
+		}
+		if mc.requestSizeOpts != nil {
+			return errors.New("ginprom: WithRequestSizeSummary cannot be combined with WithRequestSizeHistogramOpts")
+		}
+		mc.RequestSizeSummary = mc.newSizeSummary("http_request_size_bytes", mc.help.requestSize, s, labels)
+	}
+	if s := mc.responseSizeSummary; s != nil && mc.ResponseSizeSummary == nil {
+		if mc.ResponseSize != nil {
+			return errors.New("ginprom: WithResponseSizeSummary cannot be combined with WithCustomResponseSizeHistogram")
+		}
+		if mc.responseSizeOpts != nil {
+			return errors.New("ginprom: WithResponseSizeSummary cannot be combined with WithResponseSizeHistogramOpts")
+		}
+		mc.ResponseSizeSummary = mc.newSizeSummary("http_response_size_bytes", mc.help.responseSize, s, labels)
+	}
+	return nil
+}
+
+// requestSizeObserver returns the active request-size collector.
+func (mc *MetricsCollection) requestSizeObserver() prometheus.ObserverVec {
+	if mc.RequestSizeSummary != nil {
+		return mc.RequestSizeSummary
+	}
+	return mc.RequestSize
+}
+
+// responseSizeObserver returns the active response-size collector.
+func (mc *MetricsCollection) responseSizeObserver() prometheus.ObserverVec {
+	if mc.ResponseSizeSummary != nil {
+		return mc.ResponseSizeSummary
+	}
+	return mc.ResponseSize
+}
@@ -0,0 +1,61 @@
+package ginprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWithSizeSummaries_ExportQuantiles(t *testing.T) {
+	mc, reg := newTestMetricsWithRegistry(
+		WithRequestSizeSummary(map[float64]float64{0.5: 0.05, 0.99: 0.001}, time.Minute),
+		WithResponseSizeSummary(nil, 0),
+	)
+	if mc.RequestSize != nil || mc.ResponseSize != nil {
+		t.Fatal("expected the size histograms to be replaced by summaries")
+	}
+
+	r := gin.New()
+	r.Use(MiddlewareWithMetrics(mc))
+	r.POST("/upload", func(c *gin.Context) { c.String(http.StatusOK, "stored") })
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("payload"))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	cases := map[string]int{
+		"http_request_size_bytes":  2,
+		"http_response_size_bytes": len(DefaultSummaryObjectives),
+	}
+	for name, quantiles := range cases {
+		mf := gatherFamily(t, reg, name)
+		if mf == nil || mf.GetType() != dto.MetricType_SUMMARY {
+			t.Fatalf("%s: expected a summary, got %v", name, mf)
+		}
+		s := mf.GetMetric()[0].GetSummary()
+		if s.GetSampleCount() != 3 {
+			t.Errorf("%s: expected 3 observations, got %d", name, s.GetSampleCount())
+		}
+		if len(s.GetQuantile()) != quantiles {
+			t.Errorf("%s: expected %d quantiles, got %d", name, quantiles, len(s.GetQuantile()))
+		}
+	}
+}
+
+func TestWithRequestSizeSummary_ConflictsWithCustomHistogram(t *testing.T) {
+	custom := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "custom_request_size"}, []string{"status_code", "method", "path"})
+	_, err := NewMetricsCollectionE(
+		WithCustomRegistry(prometheus.NewRegistry()),
+		WithCustomRequestSizeHistogram(custom),
+		WithRequestSizeSummary(nil, 0),
+	)
+	if err == nil {
+		t.Error("expected an error when combining a custom histogram with a summary")
+	}
+}